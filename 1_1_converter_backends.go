@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Cheminformatics backend used by every conversion stage. Formats are taken from the file extensions.
+// hydrogens is "add", "remove" or anything else to leave hydrogens alone, as in the stage functions
+type converter interface {
+	name() string
+	// converts inPath to outPath, optionally changing hydrogens and generating 3D coordinates
+	convert(inPath string, outPath string, hydrogens string, gen3d bool) error
+	// returns the canonical SMILES of a structure file
+	canonicalSMILES(inPath string) (string, error)
+}
+
+// returned by backends for conversions they cannot do
+var errConversionNotSupported = errors.New("conversion not supported by backend")
+
+// Backend used by the conversion stages. main() sets it from converterBackend
+var activeConverter converter = newObabelConverter()
+
+// Creates a backend by name: "obabel", "rdkit" (reading and writing TXYZ through obabel), "native" (pure Go,
+// falling back to obabel where it has to) or "fake"
+func newConverter(backend string) converter {
+	switch backend {
+	case "obabel":
+		return newObabelConverter()
+	case "rdkit":
+		return newRDKitConverter(newObabelConverter())
+	case "native":
+		return &nativeConverter{fallback: newObabelConverter()}
+	case "fake":
+		return newFakeConverter()
+	}
+	log.Fatal("Unknown converter backend: " + backend + " (expected obabel, rdkit, native or fake)")
+	return nil
+}
+
+// converts a file with the active backend and stops the program on failure, like the rest of the pipeline
+func convertFile(inPath string, outPath string, hydrogens string, gen3d bool) {
+	err := activeConverter.convert(inPath, outPath, hydrogens, gen3d)
+	if err != nil {
+		fmt.Println(activeConverter.name() + " failed to convert " + inPath + " to " + outPath)
+		log.Fatal(err)
+	}
+}
+
+func getFormat(path string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath2.Ext(path)), ".")
+}
+
+///////////////////
+// Open Babel
+///////////////////
+
+type obabelConverter struct {
+	exe string
+}
+
+// Uses obabel from PATH, or the install location in the obabel constant if it is not on PATH
+func newObabelConverter() *obabelConverter {
+	exe, err := exec.LookPath("obabel")
+	if err != nil {
+		exe = obabel
+	}
+	return &obabelConverter{exe: exe}
+}
+
+func (c *obabelConverter) name() string {
+	return "obabel"
+}
+
+func (c *obabelConverter) convert(inPath string, outPath string, hydrogens string, gen3d bool) error {
+	cmdArgs := []string{inPath, "-O", outPath}
+	if hydrogens == "add" {
+		cmdArgs = append(cmdArgs, "-h")
+	} else if hydrogens == "remove" {
+		cmdArgs = append(cmdArgs, "-d")
+	}
+	if gen3d {
+		cmdArgs = append(cmdArgs, "--gen3d")
+	}
+
+	out, err := exec.Command(c.exe, cmdArgs...).CombinedOutput()
+	if err != nil {
+		return errors.New(err.Error() + ": " + string(out))
+	}
+	return nil
+}
+
+func (c *obabelConverter) canonicalSMILES(inPath string) (string, error) {
+	out, err := exec.Command(c.exe, inPath, "-ocan").Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", errors.New("obabel returned no SMILES for " + inPath)
+	}
+	return fields[0], nil
+}
+
+///////////////////
+// RDKit
+///////////////////
+
+// Runs RDKit through a python interpreter. RDKit cannot read or write Tinker XYZ, so fallback converts between
+// TXYZ and a temporary SDF that RDKit works on. RDKit's canonical SMILES differ from Open Babel's, so a library and
+// the molecules matched against it must be built with the same backend
+type rdkitConverter struct {
+	python string
+	fallback converter
+}
+
+const rdkitScript = `
+import sys
+from rdkit import Chem
+from rdkit.Chem import AllChem
+inPath, outPath, hydrogens, gen3d = sys.argv[1:5]
+inFormat = inPath.rsplit(".", 1)[-1].lower()
+outFormat = outPath.rsplit(".", 1)[-1].lower()
+if inFormat in ("sdf", "mol"):
+    mol = Chem.MolFromMolFile(inPath, removeHs=False)
+elif inFormat in ("smi", "can", "smiles"):
+    mol = Chem.MolFromSmiles(open(inPath).read().split()[0])
+elif inFormat == "pdb":
+    mol = Chem.MolFromPDBFile(inPath, removeHs=False)
+else:
+    sys.exit("unsupported input format " + inFormat)
+if mol is None:
+    sys.exit("could not parse " + inPath)
+if hydrogens == "add" or gen3d == "1":
+    mol = Chem.AddHs(mol, addCoords=True)
+elif hydrogens == "remove":
+    mol = Chem.RemoveHs(mol)
+if gen3d == "1":
+    AllChem.EmbedMolecule(mol, randomSeed=61453)
+    AllChem.MMFFOptimizeMolecule(mol)
+    if hydrogens == "remove":
+        mol = Chem.RemoveHs(mol)
+name = inPath.replace("\\", "/").rsplit("/", 1)[-1].rsplit(".", 1)[0]
+if outFormat in ("sdf", "mol"):
+    Chem.MolToMolFile(mol, outPath)
+elif outFormat in ("smi", "can"):
+    open(outPath, "w").write(Chem.MolToSmiles(mol) + "\t" + name + "\n")
+elif outFormat == "pdb":
+    Chem.MolToPDBFile(mol, outPath)
+elif outFormat == "-":
+    print(Chem.MolToSmiles(mol))
+else:
+    sys.exit("unsupported output format " + outFormat)
+`
+
+func newRDKitConverter(fallback converter) *rdkitConverter {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		python = "python"
+	}
+	return &rdkitConverter{python: python, fallback: fallback}
+}
+
+func (c *rdkitConverter) name() string {
+	if c.fallback != nil {
+		return "rdkit+" + c.fallback.name()
+	}
+	return "rdkit"
+}
+
+func (c *rdkitConverter) run(inPath string, outPath string, hydrogens string, gen3d bool) (string, error) {
+	if getFormat(inPath) == "txyz" || getFormat(outPath) == "txyz" {
+		return "", errConversionNotSupported
+	}
+	gen3dArg := "0"
+	if gen3d {
+		gen3dArg = "1"
+	}
+	out, err := exec.Command(c.python, "-c", rdkitScript, inPath, outPath, hydrogens, gen3dArg).CombinedOutput()
+	if err != nil {
+		return "", errors.New(err.Error() + ": " + string(out))
+	}
+	return string(out), nil
+}
+
+func (c *rdkitConverter) convert(inPath string, outPath string, hydrogens string, gen3d bool) error {
+	inTXYZ := getFormat(inPath) == "txyz"
+	outTXYZ := getFormat(outPath) == "txyz"
+	if !inTXYZ && !outTXYZ {
+		_, err := c.run(inPath, outPath, hydrogens, gen3d)
+		return err
+	}
+	if c.fallback == nil {
+		return errConversionNotSupported
+	}
+	if inTXYZ && outTXYZ {
+		return c.fallback.convert(inPath, outPath, hydrogens, gen3d)
+	}
+
+	// RDKit does the chemistry on an SDF copy, the fallback only changes the file format
+	sdfPath, err := getTemporarySDFPath()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sdfPath)
+	if inTXYZ {
+		if err := c.fallback.convert(inPath, sdfPath, "no", false); err != nil {
+			return err
+		}
+		_, err = c.run(sdfPath, outPath, hydrogens, gen3d)
+		return err
+	}
+	if _, err := c.run(inPath, sdfPath, hydrogens, gen3d); err != nil {
+		return err
+	}
+	return c.fallback.convert(sdfPath, outPath, "no", false)
+}
+
+func (c *rdkitConverter) canonicalSMILES(inPath string) (string, error) {
+	if getFormat(inPath) == "txyz" {
+		if c.fallback == nil {
+			return "", errConversionNotSupported
+		}
+		sdfPath, err := getTemporarySDFPath()
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(sdfPath)
+		if err := c.fallback.convert(inPath, sdfPath, "no", false); err != nil {
+			return "", err
+		}
+		inPath = sdfPath
+	}
+	out, err := c.run(inPath, "stdout.-", "no", false)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Reserves a file name in the temporary directory for an intermediate SDF
+func getTemporarySDFPath() (string, error) {
+	file, err := ioutil.TempFile("", "conversion*.sdf")
+	if err != nil {
+		return "", err
+	}
+	path := file.Name()
+	return path, file.Close()
+}
+
+///////////////////
+// Native
+///////////////////
+
+// Pure Go conversions on the molecule graph: TXYZ to TXYZ with hydrogens removed, TXYZ to XYZ, and reading the
+// canonical SMILES out of .can files. Anything else is handed to fallback, or fails if fallback is nil
+type nativeConverter struct {
+	fallback converter
+}
+
+func (c *nativeConverter) name() string {
+	if c.fallback != nil {
+		return "native+" + c.fallback.name()
+	}
+	return "native"
+}
+
+func (c *nativeConverter) convert(inPath string, outPath string, hydrogens string, gen3d bool) error {
+	err := c.convertNative(inPath, outPath, hydrogens, gen3d)
+	if err == errConversionNotSupported && c.fallback != nil {
+		return c.fallback.convert(inPath, outPath, hydrogens, gen3d)
+	}
+	return err
+}
+
+func (c *nativeConverter) convertNative(inPath string, outPath string, hydrogens string, gen3d bool) error {
+	if getFormat(inPath) != "txyz" || gen3d || hydrogens == "add" {
+		return errConversionNotSupported
+	}
+	molName, atoms := loadLipid(inPath)
+	if hydrogens == "remove" {
+		atoms = removeHydrogenAtoms(atoms)
+	}
+	switch getFormat(outPath) {
+	case "txyz":
+		return writeTXYZ(atoms, outPath, molName)
+	case "xyz":
+		return writeXYZ(atoms, outPath, molName)
+	}
+	return errConversionNotSupported
+}
+
+func (c *nativeConverter) canonicalSMILES(inPath string) (string, error) {
+	format := getFormat(inPath)
+	if format == "can" {
+		return getSMIString(inPath), nil
+	}
+	if c.fallback != nil {
+		return c.fallback.canonicalSMILES(inPath)
+	}
+	return "", errConversionNotSupported
+}
+
+// Returns a copy of a molecule without its hydrogens, renumbered from 1
+func removeHydrogenAtoms(atoms map[int]*atom) map[int]*atom {
+	heavyAtoms := make(map[int]*atom)
+	for atomID, thisAtom := range atoms {
+		if thisAtom.element != "H" {
+			newAtom := copyAtom(thisAtom)
+			var bonds []int
+			for _, bondedAtom := range newAtom.bondedAtoms {
+				if atoms[bondedAtom].element != "H" {
+					bonds = append(bonds, bondedAtom)
+				}
+			}
+			newAtom.bondedAtoms = bonds
+			heavyAtoms[atomID] = &newAtom
+		}
+	}
+	return renumberAtoms(heavyAtoms)
+}
+
+// Returns a copy of a molecule renumbered from 1 in order of its current IDs, with bonds updated
+func renumberAtoms(atoms map[int]*atom) map[int]*atom {
+	var oldIDs []int
+	for atomID := range atoms {
+		oldIDs = append(oldIDs, atomID)
+	}
+	sort.Ints(oldIDs)
+	oldToNew := make(map[int]int)
+	for i, oldID := range oldIDs {
+		oldToNew[oldID] = i + 1
+	}
+	renumbered := make(map[int]*atom)
+	for _, oldID := range oldIDs {
+		newAtom := copyAtom(atoms[oldID])
+		for j := range newAtom.bondedAtoms {
+			newAtom.bondedAtoms[j] = oldToNew[newAtom.bondedAtoms[j]]
+		}
+		newAtom.parent = oldToNew[oldID]
+		renumbered[oldToNew[oldID]] = &newAtom
+	}
+	return renumbered
+}
+
+// Writes a molecule numbered 1..n as Tinker XYZ
+func writeTXYZ(atoms map[int]*atom, outPath string, title string) error {
+	var builder strings.Builder
+	builder.WriteString(strconv.Itoa(len(atoms)) + "\t " + title + "\n")
+	for i := 1; i <= len(atoms); i++ {
+		line := strconv.Itoa(i) + "\t" + atoms[i].element + "\t" + fmt.Sprintf("%.6f", atoms[i].pos[0]) + "\t" +
+			fmt.Sprintf("%.6f", atoms[i].pos[1]) + "\t" + fmt.Sprintf("%.6f", atoms[i].pos[2]) + "\t" +
+			strconv.Itoa(atoms[i].atomType)
+		for _, bondedAtom := range atoms[i].bondedAtoms {
+			line += "\t" + strconv.Itoa(bondedAtom)
+		}
+		builder.WriteString(line + "\n")
+	}
+	return ioutil.WriteFile(outPath, []byte(builder.String()), 0644)
+}
+
+// Writes a molecule numbered 1..n as plain XYZ
+func writeXYZ(atoms map[int]*atom, outPath string, title string) error {
+	var builder strings.Builder
+	builder.WriteString(strconv.Itoa(len(atoms)) + "\n" + title + "\n")
+	for i := 1; i <= len(atoms); i++ {
+		builder.WriteString(atoms[i].element + "\t" + fmt.Sprintf("%.6f", atoms[i].pos[0]) + "\t" +
+			fmt.Sprintf("%.6f", atoms[i].pos[1]) + "\t" + fmt.Sprintf("%.6f", atoms[i].pos[2]) + "\n")
+	}
+	return ioutil.WriteFile(outPath, []byte(builder.String()), 0644)
+}
+
+///////////////////
+// Fake
+///////////////////
+
+// Backend for tests and dry runs, see 1_1_converter_backends_test.go. Records every call, copies input files to output files and writes SMILES files
+// from the smiles map (keyed by input base name, "C" if absent)
+type fakeConverter struct {
+	mutex sync.Mutex
+	calls []string
+	smiles map[string]string
+}
+
+func newFakeConverter() *fakeConverter {
+	return &fakeConverter{smiles: make(map[string]string)}
+}
+
+func (c *fakeConverter) name() string {
+	return "fake"
+}
+
+func (c *fakeConverter) convert(inPath string, outPath string, hydrogens string, gen3d bool) error {
+	c.mutex.Lock()
+	c.calls = append(c.calls, inPath+" -> "+outPath+" hydrogens="+hydrogens+" gen3d="+strconv.FormatBool(gen3d))
+	c.mutex.Unlock()
+
+	format := getFormat(outPath)
+	if format == "can" || format == "smi" {
+		smiles, _ := c.canonicalSMILES(inPath)
+		baseName := strings.Split(filepath2.Base(inPath), ".")[0]
+		return ioutil.WriteFile(outPath, []byte(smiles+"\t"+baseName+"\n"), 0644)
+	}
+	_, err := copyFile(inPath, outPath)
+	return err
+}
+
+func (c *fakeConverter) canonicalSMILES(inPath string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if smiles, ok := c.smiles[strings.Split(filepath2.Base(inPath), ".")[0]]; ok {
+		return smiles, nil
+	}
+	return "C", nil
+}
+
+// Returns the calls recorded so far
+func (c *fakeConverter) getCalls() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	calls := make([]string, len(c.calls))
+	copy(calls, c.calls)
+	return calls
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	filepath2 "path/filepath"
+	"strings"
+	"testing"
+)
+
+// Methanol numbered with gaps: C 3, O 7, H 10-13
+func getTestMethanol() map[int]*atom {
+	atoms := map[int]*atom{
+		3:  {element: "C", atomType: 1, pos: []float64{0, 0, 0}, bondedAtoms: []int{7, 10, 11, 12}},
+		7:  {element: "O", atomType: 2, pos: []float64{1.43, 0, 0}, bondedAtoms: []int{3, 13}},
+		10: {element: "H", atomType: 3, pos: []float64{-0.36, 1.03, 0}, bondedAtoms: []int{3}},
+		11: {element: "H", atomType: 3, pos: []float64{-0.36, -0.51, 0.89}, bondedAtoms: []int{3}},
+		12: {element: "H", atomType: 3, pos: []float64{-0.36, -0.51, -0.89}, bondedAtoms: []int{3}},
+		13: {element: "H", atomType: 4, pos: []float64{1.75, 0.9, 0}, bondedAtoms: []int{7}},
+	}
+	for atomID, thisAtom := range atoms {
+		thisAtom.parent = atomID
+	}
+	return atoms
+}
+
+func TestRenumberAtomsLeavesInputUnchanged(t *testing.T) {
+	atoms := getTestMethanol()
+	renumbered := renumberAtoms(atoms)
+
+	if len(renumbered) != 6 || renumbered[1].element != "C" || renumbered[2].element != "O" {
+		t.Fatalf("unexpected renumbering: C %v, O %v", renumbered[1], renumbered[2])
+	}
+	if got := renumbered[2].bondedAtoms; len(got) != 2 || got[0] != 1 || got[1] != 6 {
+		t.Errorf("bonds of O renumbered to %v, want [1 6]", got)
+	}
+	if got := atoms[7].bondedAtoms; got[0] != 3 || got[1] != 13 || atoms[7].parent != 7 {
+		t.Errorf("input atom O changed to bonds %v, parent %d", got, atoms[7].parent)
+	}
+}
+
+func TestRemoveHydrogenAtoms(t *testing.T) {
+	heavyAtoms := removeHydrogenAtoms(getTestMethanol())
+	if len(heavyAtoms) != 2 {
+		t.Fatalf("got %d heavy atoms, want 2", len(heavyAtoms))
+	}
+	if got := heavyAtoms[1].bondedAtoms; len(got) != 1 || got[0] != 2 {
+		t.Errorf("bonds of C are %v, want [2]", got)
+	}
+}
+
+func writeTestMethanol(t *testing.T, dir string) string {
+	path := filepath2.Join(dir, "methanol.txyz")
+	if err := writeTXYZ(renumberAtoms(getTestMethanol()), path, "methanol"); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRDKitConverterHandsTXYZToFallback(t *testing.T) {
+	dir := t.TempDir()
+	inPath := writeTestMethanol(t, dir)
+	fallback := newFakeConverter()
+	c := &rdkitConverter{python: filepath2.Join(dir, "no_python"), fallback: fallback}
+
+	// TXYZ to TXYZ is left to the fallback entirely
+	outPath := filepath2.Join(dir, "copy.txyz")
+	if err := c.convert(inPath, outPath, "remove", false); err != nil {
+		t.Fatalf("TXYZ to TXYZ failed: %v", err)
+	}
+	if _, err := os.Stat(outPath); err != nil {
+		t.Errorf("no output written: %v", err)
+	}
+	calls := fallback.getCalls()
+	if len(calls) != 1 || !strings.HasSuffix(calls[0], "copy.txyz hydrogens=remove gen3d=false") {
+		t.Errorf("fallback calls %v", calls)
+	}
+
+	// TXYZ to SDF goes through a temporary SDF from the fallback, then RDKit, which is missing here
+	err := c.convert(inPath, filepath2.Join(dir, "methanol.sdf"), "no", false)
+	if err == nil || err == errConversionNotSupported {
+		t.Errorf("expected RDKit to fail without python, got %v", err)
+	}
+	calls = fallback.getCalls()
+	if len(calls) != 2 || !strings.Contains(calls[1], ".sdf hydrogens=no") {
+		t.Fatalf("fallback calls %v", calls)
+	}
+	tmpPath := strings.Fields(strings.SplitN(calls[1], " -> ", 2)[1])[0]
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("temporary SDF %s was not removed", tmpPath)
+	}
+}
+
+func TestRDKitConverterWithoutFallback(t *testing.T) {
+	c := &rdkitConverter{python: "python3"}
+	if err := c.convert("in.txyz", "out.sdf", "no", false); err != errConversionNotSupported {
+		t.Errorf("got %v, want errConversionNotSupported", err)
+	}
+	if _, err := c.canonicalSMILES("in.txyz"); err != errConversionNotSupported {
+		t.Errorf("got %v, want errConversionNotSupported", err)
+	}
+}
+
+func TestNativeConverter(t *testing.T) {
+	dir := t.TempDir()
+	inPath := writeTestMethanol(t, dir)
+	fallback := newFakeConverter()
+	c := &nativeConverter{fallback: fallback}
+
+	// removing hydrogens is done natively
+	outPath := filepath2.Join(dir, "heavy.txyz")
+	if err := c.convert(inPath, outPath, "remove", false); err != nil {
+		t.Fatal(err)
+	}
+	_, atoms := loadLipid(outPath)
+	if len(atoms) != 2 || len(fallback.getCalls()) != 0 {
+		t.Errorf("got %d atoms and fallback calls %v", len(atoms), fallback.getCalls())
+	}
+
+	// generating SMILES is not
+	fallback.smiles["methanol"] = "CO"
+	canPath := filepath2.Join(dir, "methanol.can")
+	if err := c.convert(inPath, canPath, "no", false); err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadFile(canPath)
+	if len(fallback.getCalls()) != 1 || getSMIString(canPath) != "CO" {
+		t.Errorf("got %q and fallback calls %v", contents, fallback.getCalls())
+	}
+	if smiles, err := c.canonicalSMILES(canPath); err != nil || smiles != "CO" {
+		t.Errorf("canonical SMILES of .can file: %q, %v", smiles, err)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	filepath2 "path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 )
 
 func fragmentManager(moleculesDir string, singleFragmentsDir string, doubleFragmentsDir string, dimersDir string) {
@@ -28,6 +27,11 @@ func fragmentManager(moleculesDir string, singleFragmentsDir string, doubleFragm
 	if dimersExist {
 		_ = os.RemoveAll(dimersDir)
 	}
+	for _, fragmentsDir := range []string{singleFragmentsDir, doubleFragmentsDir, dimersDir} {
+		if fragmentDB.holds(fragmentsDir) {
+			fragmentDB.clearFragments(fragmentsDir)
+		}
+	}
 
 	fileInfo, err := ioutil.ReadDir(moleculesDir)
 	if err != nil {
@@ -35,40 +39,27 @@ func fragmentManager(moleculesDir string, singleFragmentsDir string, doubleFragm
 		log.Fatal(err)
 	}
 
-	maxFrame := min(goRoutinesBatchSize,len(fileInfo)-1)
-	frame := []int{0,maxFrame}
-
-	for frame[0] < len(fileInfo) {
-
-		wg := sync.WaitGroup{}
-
-		for i := frame[0]; i <= frame[1]; i++ {
-			if filepath2.Ext(fileInfo[i].Name()) == ".txyz" {
-				molPath := filepath2.Join(moleculesDir, fileInfo[i].Name())
-
-				wg.Add(1)
-				go fragmentMoleculeShellFunc(molPath, singleFragmentsDir, doubleFragmentsDir, dimersDir, &wg)
-				// fragmentMoleculeShellFunc(molPath, singleFragmentsDir, doubleFragmentsDir, dimersDir, &wg)
-
-			}
+	var molPaths []string
+	for i := 0; i < len(fileInfo); i++ {
+		if filepath2.Ext(fileInfo[i].Name()) == ".txyz" {
+			molPaths = append(molPaths, filepath2.Join(moleculesDir, fileInfo[i].Name()))
 		}
+	}
 
-
-		frame[0] += goRoutinesBatchSize
-		frame[1] += goRoutinesBatchSize
-		frame[1] = min(frame[1], len(fileInfo)-1)
-		wg.Wait()
+	err = runWorkerPool(pipelineContext, "fragmenting molecules", len(molPaths), func(i int) {
+		fragmentMoleculeShellFunc(molPaths[i], singleFragmentsDir, doubleFragmentsDir, dimersDir)
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
 }
 
-func fragmentMoleculeShellFunc(filePath string, singleFragmentsDir string, doubleFragmentsDir string, dimersDir string, wg *sync.WaitGroup) {
+func fragmentMoleculeShellFunc(filePath string, singleFragmentsDir string, doubleFragmentsDir string, dimersDir string) {
 
 	lipidName, atoms := loadLipid(filePath)
 	fragmentMolecule(atoms, lipidName, singleFragmentsDir, doubleFragmentsDir, dimersDir)
 
-	wg.Done()
-
 }
 
 func fragmentMolecule(atoms map[int]*atom, lipidName string, singleFragmentsDir string, doubleFragmentsDir string, dimersDir string) {
@@ -103,6 +94,18 @@ func fragmentMolecule(atoms map[int]*atom, lipidName string, singleFragmentsDir
 	// doubleFrags, doubleFragsIsHydrocarbon := getDoubleFragments(atoms,borderBonds)
 	// fmt.Println("BDouble Fragments found.")
 
+	if relaxCapsOnFragmentation {
+		settings := minimizationSettings{method: "builtin", algorithm: "lbfgs", steps: fragmentationCapSteps, convergence: 1e-6}
+		for _, frags := range [][]map[int]*atom{singleFrags, doubleFrags, dimers} {
+			for _, frag := range frags {
+				_, err := relaxCaps(frag, settings)
+				if err != nil {
+					fmt.Println("Warning: failed to relax caps of a fragment of " + lipidName + ": " + err.Error())
+				}
+			}
+		}
+	}
+
 	//fmt.Println("\nWriting single fragments to disk...")
 	// fmt.Println(len(singleFrags))
 	for i := 0; i < len(singleFrags); i++ {
@@ -134,11 +137,12 @@ func loadLipid(filePath string) (string, map[int]*atom) {
 	atoms := make(map[int]*atom)
 
 	// open file
-	file, err := os.Open(filePath)
+	file, err := openFragmentFile(filePath)
 	if err != nil {
 		fmt.Println("Failed to open molecule file: " + filePath)
 		log.Fatal(err)
 	}
+	defer file.Close()
 	lipidName := strings.Split(filepath2.Base(filePath),".")[0]
 
 
@@ -155,7 +159,9 @@ func loadLipid(filePath string) (string, map[int]*atom) {
 		// split by whitespace
 		tokens := strings.Fields(line)
 		// check line length before proceeding
-		if len(tokens) >= 6 {
+		if isTXYZBoxLine(tokens) {
+			// periodic box of a simulation system
+		} else if len(tokens) >= 6 {
 
 			// create new atom
 			var newAtom atom
@@ -245,22 +251,23 @@ func getFragmentCharge(atoms map[int]*atom) int {
 	return charge
 }
 
+// Writes a fragment to <fragSubDir>/<fragName>.txyz, or stores it in fragmentDB if that holds fragSubDir
 func writeFragment(atoms map[int]*atom, fragSubDir string, fragName string) {
-	os.MkdirAll(fragSubDir, 0755)
-	thisPath := filepath2.Join(fragSubDir, fragName + ".txyz")
-	// fmt.Println(thisPath)
-	thisFile, err := os.Create(thisPath)
-	if err != nil {
-		fmt.Println("Failed to create new fragment file: " + thisPath)
-		log.Fatal(err)
-	}
+	var builder strings.Builder
 
 	// write header
-	_, err = thisFile.WriteString(strconv.Itoa(len(atoms)) + "\t Fragment " + fragName + "charge=" + strconv.Itoa(getFragmentCharge(atoms)) + "\n")
-	if err != nil {
-		fmt.Println("Failed to write header line to key: " + thisPath)
-		log.Fatal(err)
+	// cap atoms are listed in the header so later stages can tell them apart from atoms of the parent molecule
+	var capAtoms []string
+	for i := 1; i <= len(atoms); i++ {
+		if atoms[i].isCap {
+			capAtoms = append(capAtoms, strconv.Itoa(i))
+		}
+	}
+	header := strconv.Itoa(len(atoms)) + "\t Fragment " + fragName + "charge=" + strconv.Itoa(getFragmentCharge(atoms))
+	if len(capAtoms) > 0 {
+		header += " caps=" + strings.Join(capAtoms, ",")
 	}
+	builder.WriteString(header + "\n")
 
 	// write body
 	for i := 1; i <= len(atoms); i++ {
@@ -271,12 +278,45 @@ func writeFragment(atoms map[int]*atom, fragSubDir string, fragName string) {
 			line += "\t" + strconv.Itoa(bondedAtom)
 		}
 
-		_, err = thisFile.WriteString(line + "\n")
-		if err != nil {
-			fmt.Println("Failed to write header line to key: " + thisPath)
-			log.Fatal(err)
-		}
+		builder.WriteString(line + "\n")
 	}
 
+	if fragmentDB.holds(fragSubDir) {
+		fragmentDB.putFragment(fragSubDir, fragName, builder.String())
+		return
+	}
+	os.MkdirAll(fragSubDir, 0755)
+	thisPath := filepath2.Join(fragSubDir, fragName + ".txyz")
+	err := ioutil.WriteFile(thisPath, []byte(builder.String()), 0644)
+	if err != nil {
+		fmt.Println("Failed to create new fragment file: " + thisPath)
+		log.Fatal(err)
+	}
 }
 
+
+// Returns the IDs of cap atoms listed in the header of a fragment TXYZ written by writeFragment
+func getCapAtoms(filePath string) map[int]bool {
+	capAtoms := make(map[int]bool)
+
+	file, err := openFragmentFile(filePath)
+	if err != nil {
+		fmt.Println("Failed to open molecule file: " + filePath)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan()
+	for _, token := range strings.Fields(scanner.Text()) {
+		if strings.HasPrefix(token, "caps=") {
+			for _, capAtom := range strings.Split(strings.TrimPrefix(token, "caps="), ",") {
+				atomID, err := strconv.Atoi(capAtom)
+				if err == nil {
+					capAtoms[atomID] = true
+				}
+			}
+		}
+	}
+	return capAtoms
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"log"
+	"math"
 	"strconv"
 )
 
@@ -32,6 +33,9 @@ type atom struct {
 	// used for fragment to dimer recombination (this process also uses the ring detection vars)
 	isTerminus bool
 	isAnteTerminus bool
+
+	// true for the methyl atoms added by capWithMethylGroup
+	isCap bool
 }
 
 func copyAtom(thisAtom *atom) atom {
@@ -63,6 +67,8 @@ func copyAtom(thisAtom *atom) atom {
 	newAtom.isTerminus = thisAtom.isTerminus
 	newAtom.isAnteTerminus  = thisAtom.isAnteTerminus
 
+	newAtom.isCap = thisAtom.isCap
+
 	return newAtom
 }
 
@@ -338,9 +344,11 @@ func deleteAtomsNotOfGroup(atoms map[int]*atom, groups []int) {
 
 // removes bond between two atoms and adds methyls to molecule ends in its place
 func removeBondAndCapEnds(atoms map[int]*atom, atom1 int, atom2 int) {
+	pos1 := atoms[atom1].pos
+	pos2 := atoms[atom2].pos
 	disconnect(atoms,atom1,atom2)
-	capWithMethylGroup(atoms,atom1)
-	capWithMethylGroup(atoms,atom2)
+	capWithMethylGroup(atoms,atom1,pos2)
+	capWithMethylGroup(atoms,atom2,pos1)
 }
 
 // removes each atom from the other's list of bonded atoms
@@ -357,21 +365,22 @@ func disconnect(atoms map[int]*atom, atom1 int, atom2 int) {
 	}
 }
 
-// currently places atoms w/o coordinates
-func capWithMethylGroup(atoms map[int]*atom, atom1 int) {
+// places a methyl group on atom1 along the direction of the removed bond to the atom at partnerPos
+func capWithMethylGroup(atoms map[int]*atom, atom1 int, partnerPos []float64) {
 	// calculate location of new methyl group
-	// carbPos := getMethylCoordinates(atoms,atom1,atom2)
+	carbPos, hydrogenPositions := getMethylCoordinates(atoms[atom1].pos, partnerPos)
 
 	// create new c atom and set parameters
 	var carbon atom
 	newCarbIndex := len(atoms)+1
 	carbon.element = "C"
-	carbon.pos = []float64{0.0,0.0,0.0}
+	carbon.pos = carbPos
 	carbon.parent = newCarbIndex
 	carbon.atomType = 1
 	carbon.bondedAtoms = []int{atom1}
 	carbon.treeSize = 1
 	carbon.isInFuncGroup = true
+	carbon.isCap = true
 
 	// adjust tree size of root
 	atoms[root(atoms,atom1)].treeSize++
@@ -387,12 +396,13 @@ func capWithMethylGroup(atoms map[int]*atom, atom1 int) {
 		var hydrogen atom
 		newHydrogenIndex := len(atoms)+1
 		hydrogen.element = "H"
-		hydrogen.pos = []float64{0.0,0.0,0.0}
+		hydrogen.pos = hydrogenPositions[i]
 		hydrogen.parent = newHydrogenIndex
 		hydrogen.atomType = 5
 		hydrogen.bondedAtoms = []int{newCarbIndex}
 		hydrogen.treeSize = 1
 		hydrogen.isInFuncGroup = true
+		hydrogen.isCap = true
 
 		// adjust tree size of root
 		atoms[root(atoms,atom1)].treeSize++
@@ -407,6 +417,28 @@ func capWithMethylGroup(atoms map[int]*atom, atom1 int) {
 
 }
 
+// Returns the position of a methyl carbon on the atom at anchorPos, pointing at partnerPos, and of its three
+// hydrogens in a staggered tetrahedral arrangement
+func getMethylCoordinates(anchorPos []float64, partnerPos []float64) ([]float64, [][]float64) {
+	axis := vecUnit(vecSub(partnerPos, anchorPos))
+	carbPos := vecAdd(anchorPos, vecScale(axis, carbonCarbonBondDistance))
+
+	// C-H bonds make the tetrahedral angle with the C-anchor bond
+	cosTheta := math.Cos(math.Pi - tetrahedralAngle)
+	sinTheta := math.Sin(math.Pi - tetrahedralAngle)
+	perp1 := vecPerpendicular(axis)
+	perp2 := vecCross(axis, perp1)
+
+	hydrogenPositions := make([][]float64, 3)
+	for i := 0; i < 3; i++ {
+		phi := 2 * math.Pi * float64(i) / 3
+		radial := vecAdd(vecScale(perp1, math.Cos(phi)), vecScale(perp2, math.Sin(phi)))
+		direction := vecAdd(vecScale(axis, cosTheta), vecScale(radial, sinTheta))
+		hydrogenPositions[i] = vecAdd(carbPos, vecScale(direction, hydrogenCarbonBondDistance))
+	}
+	return carbPos, hydrogenPositions
+}
+
 
 ////////////////
 // Union Find Alg
@@ -475,34 +507,34 @@ func root(atoms map[int]*atom, atom1 int) int {
 // Ring Detection Alg
 /////////////////////
 
-var Time = 0
-
 func bridge(atoms map[int]*atom) {
 
+	// discovery clock is local to each call so molecules can be fragmented concurrently
+	time := 0
 	for atomID, atom := range atoms {
 		//fmt.Println(atom.element)
 		if atom.visited == false {
-			dfs(atoms,atomID)
+			dfs(atoms,atomID,&time)
 		}
 	}
 }
 
-func dfs(atoms map[int]*atom, u int) {
+func dfs(atoms map[int]*atom, u int, time *int) {
 
 	// mark current node as visited
 	atoms[u].visited = true
 
 	// initialize discovery time and low value
-	atoms[u].discTime = Time
-	atoms[u].minDiscTime = Time
-	Time++
+	atoms[u].discTime = *time
+	atoms[u].minDiscTime = *time
+	*time++
 
 	// recurse for all bonded atoms
 	for _, v := range atoms[u].bondedAtoms {
 		// if bonded atom v is not visited, recurse for it and make it a child of u
 		if atoms[v].visited == false {
 			atoms[v].parentBF = u
-			dfs(atoms, v)
+			dfs(atoms, v, time)
 
 			// check if subtree rooted at v has a connection to an ancestor of u
 			atoms[u].minDiscTime = min(atoms[u].minDiscTime, atoms[v].minDiscTime)
@@ -3,25 +3,27 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	filepath2 "path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-func fragSelector(dir string, singleFragmentsDir string, doubleFragmentsDir string, uniqueSFDir string, uniqueDFDir string) {
+func fragSelector(dir string, singleFragmentsDir string, doubleFragmentsDir string, uniqueSFDir string, uniqueDFDir string, settings representativeSettings) {
 
 	singleFragRankedKeys, singleFragRankedVals, singleFragStringToFragLocations, isSFhydrocarbon := countFrags(singleFragmentsDir)
 	outPath := filepath2.Join(dir,"top_single_fragments.txt")
 	outPathHC := filepath2.Join(dir,"top_single_fragments_HC.txt")
-	writeTopFrags(outPath, outPathHC, singleFragRankedKeys, singleFragRankedVals, singleFragStringToFragLocations, isSFhydrocarbon)
+	singleFragRepresentatives := chooseRepresentatives(singleFragRankedKeys, singleFragStringToFragLocations, settings)
+	writeTopFrags(outPath, outPathHC, singleFragRankedKeys, singleFragRankedVals, singleFragRepresentatives, isSFhydrocarbon)
 
 	doubleFragRankedKeys, doubleFragRankedVals, doubleFragStringToFragLocations, isDFhydrocarbon := countFrags(doubleFragmentsDir)
 	outPath = filepath2.Join(dir,"top_double_fragments.txt")
 	outPathHC = filepath2.Join(dir,"top_double_fragments_HC.txt")
-	writeTopFrags(outPath, outPathHC, doubleFragRankedKeys, doubleFragRankedVals, doubleFragStringToFragLocations, isDFhydrocarbon)
+	doubleFragRepresentatives := chooseRepresentatives(doubleFragRankedKeys, doubleFragStringToFragLocations, settings)
+	writeTopFrags(outPath, outPathHC, doubleFragRankedKeys, doubleFragRankedVals, doubleFragRepresentatives, isDFhydrocarbon)
 
 	_ = os.MkdirAll(uniqueSFDir, 0755)
 	_ = os.MkdirAll(uniqueDFDir, 0755)
@@ -59,12 +61,6 @@ func fragSelector(dir string, singleFragmentsDir string, doubleFragmentsDir stri
 }
 func countFrags(fragmentsDir string) ([]string, []int, map[string][]string, map[string]bool) {
 
-	fragDirFileInfo, err := ioutil.ReadDir(fragmentsDir)
-	if err != nil {
-		fmt.Println("failed to read directory: " + fragmentsDir)
-		log.Fatal(err)
-	}
-
 	fragStringToFragCount := make(map[string]int)
 	fragStringToFragLocations := make(map[string][]string)
 	isFragHydrocarbon := make(map[string]bool)
@@ -73,33 +69,31 @@ func countFrags(fragmentsDir string) ([]string, []int, map[string][]string, map[
 
 	fmt.Println("Identifying all non-alkane fragments...")
 
-	for i := 0; i < len(fragDirFileInfo); i++ {
-		fileName := fragDirFileInfo[i].Name()
-		if filepath2.Ext(fileName) == ".can" {
-
-			canFilePath := filepath2.Join(fragmentsDir, fileName)
-			txyzFilePath := strings.Split(canFilePath,".")[0] + ".txyz"
-
-
-			smiString := getSMIString(canFilePath)
-			smiString = makeSMILESUnique(smiString)
-			isHydrocarbon := isSMILESHydrocarbon(smiString)
-			
-			// if smiles string not in map already
-			if _, ok := fragStringToFragCount[smiString]; !ok {
-				// add string to maps
-				fragStringToFragCount[smiString] = 1
-				fragStringToFragLocations[smiString] = []string{txyzFilePath}
-				isFragHydrocarbon[smiString] = isHydrocarbon
-			} else {
-				// amend entry of string in maps
-				fragStringToFragCount[smiString] += 1
-				fragStringToFragLocations[smiString] = append(fragStringToFragLocations[smiString], txyzFilePath)
-			}
-			
+	// from the .can files of the directory, or fragmentDB if it holds the directory
+	fragNameToSMILES := getFragmentSMILES(fragmentsDir)
+	fragNames := make([]string, 0, len(fragNameToSMILES))
+	for fragName := range fragNameToSMILES {
+		fragNames = append(fragNames, fragName)
+	}
+	sort.Strings(fragNames)
+
+	for _, fragName := range fragNames {
+		txyzFilePath := filepath2.Join(fragmentsDir, fragName + ".txyz")
+
+		smiString := fragNameToSMILES[fragName]
+		isHydrocarbon := isSMILESHydrocarbon(smiString)
+
+		// if smiles string not in map already
+		if _, ok := fragStringToFragCount[smiString]; !ok {
+			// add string to maps
+			fragStringToFragCount[smiString] = 1
+			fragStringToFragLocations[smiString] = []string{txyzFilePath}
+			isFragHydrocarbon[smiString] = isHydrocarbon
+		} else {
+			// amend entry of string in maps
+			fragStringToFragCount[smiString] += 1
+			fragStringToFragLocations[smiString] = append(fragStringToFragLocations[smiString], txyzFilePath)
 		}
-			
-		
 	}
 
 	fmt.Println("Sorting fragments...")
@@ -155,11 +149,12 @@ func makeSMILESUnique(smiString string) string {
 // retrieves the canonical smiles string from a .can file
 func getSMIString(smiFilePath string) string {
 	// open file
-	file, err := os.Open(smiFilePath)
+	file, err := openFragmentFile(smiFilePath)
 	if err != nil {
 		fmt.Println("Failed to open molecule file: " + smiFilePath)
 		log.Fatal(err)
 	}
+	defer file.Close()
 	// Initialize scanner
 	scanner := bufio.NewScanner(file)
 	// ignore first line
@@ -174,6 +169,8 @@ func getSMIString(smiFilePath string) string {
 	}
 }
 
+// Writes the ranked fragments with their representative instance, the first of keyToLocns, followed by any
+// alternative instances
 func writeTopFrags(outPath string, outPathHC string, topKeys []string, topVals []int, keyToLocns map[string][]string, isHC map[string]bool) {
 
 	outFile, _ := os.Create(outPath)
@@ -181,10 +178,11 @@ func writeTopFrags(outPath string, outPathHC string, topKeys []string, topVals [
 
 	for i := 0; i < len(topKeys); i++ {
 
+		line := topKeys[i] + "\t" + strconv.Itoa(topVals[i]) + "\t" + strings.Join(keyToLocns[topKeys[i]], "\t") + "\n"
 		if isHC[topKeys[i]] == true {
-			_, _ = outFileHC.WriteString(topKeys[i] + "\t" + strconv.Itoa(topVals[i]) + "\t" + keyToLocns[topKeys[i]][0] + "\n")
+			_, _ = outFileHC.WriteString(line)
 		} else {
-			_, _ = outFile.WriteString(topKeys[i] + "\t" + strconv.Itoa(topVals[i]) + "\t" + keyToLocns[topKeys[i]][0] + "\n")
+			_, _ = outFile.WriteString(line)
 		}
 
 	}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Settings for choosing which instance of a fragment represents it in the top fragment lists and the library
+type representativeSettings struct {
+	// "cluster" for the medoid of the largest geometry cluster, "first" for the first instance found
+	method string
+	// heavy atom RMSD (A) within which two instances belong to the same cluster
+	rmsdThreshold float64
+	// instances clustered per fragment, evenly sampled from all of them when there are more
+	maxInstances int
+	// number of cluster representatives kept, the extra ones are exported as alternative conformers
+	numRepresentatives int
+}
+
+// Chooses the representative instances of every fragment from all of its locations. The first entry of each
+// returned list is the representative, any further entries are the medoids of the next largest clusters
+func chooseRepresentatives(keys []string, keyToLocns map[string][]string, settings representativeSettings) map[string][]string {
+	representatives := make(map[string][]string)
+	if settings.method == "first" {
+		for _, key := range keys {
+			representatives[key] = keyToLocns[key][:1]
+		}
+		return representatives
+	} else if settings.method != "cluster" {
+		log.Fatal("Unknown representative selection method: " + settings.method + " (expected \"cluster\" or \"first\")")
+	}
+
+	results := make([][]string, len(keys))
+	err := runWorkerPool(pipelineContext, "clustering fragment instances", len(keys), func(i int) {
+		results[i] = clusterFragmentInstances(keyToLocns[keys[i]], settings)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, key := range keys {
+		representatives[key] = results[i]
+	}
+	return representatives
+}
+
+// Aligns the instances of one fragment, clusters them by RMSD and returns the medoids of the largest clusters,
+// largest first. The RMSD of two instances is the lowest over the symmetries of the fragment. Instances whose
+// atoms cannot be mapped onto the first one are left out
+func clusterFragmentInstances(locations []string, settings representativeSettings) []string {
+	if len(locations) <= 1 {
+		return locations
+	}
+	sampled := locations
+	if settings.maxInstances > 0 && len(locations) > settings.maxInstances {
+		sampled = make([]string, settings.maxInstances)
+		for i := range sampled {
+			sampled[i] = locations[i*len(locations)/settings.maxInstances]
+		}
+	}
+
+	// heavy atom coordinates of every instance in the atom order of the first one
+	_, reference := loadLipid(sampled[0])
+	permutations := getSymmetryPermutations(reference, true)
+	var paths []string
+	var coords [][][]float64
+	for _, path := range sampled {
+		_, atoms := loadLipid(path)
+		mapping, ok := getAtomMapping(reference, atoms)
+		if !ok {
+			fmt.Println("Warning: could not map atoms of " + path + " onto " + sampled[0] + ", leaving it out of clustering")
+			continue
+		}
+		_, instance := getMappedCoords(reference, atoms, mapping, true)
+		paths = append(paths, path)
+		coords = append(coords, instance)
+	}
+
+	rmsd := make([][]float64, len(paths))
+	for i := range rmsd {
+		rmsd[i] = make([]float64, len(paths))
+	}
+	for i := 0; i < len(paths); i++ {
+		for j := i + 1; j < len(paths); j++ {
+			rmsd[i][j] = getSymmetricRMSD(coords[i], coords[j], permutations)
+			rmsd[j][i] = rmsd[i][j]
+		}
+	}
+
+	var representatives []string
+	for _, cluster := range butinaClusters(rmsd, settings.rmsdThreshold) {
+		if len(representatives) >= settings.numRepresentatives {
+			break
+		}
+		representatives = append(representatives, paths[getMedoid(rmsd, cluster)])
+	}
+	if len(representatives) == 0 {
+		return locations[:1]
+	}
+	return representatives
+}
+
+// Taylor-Butina clustering: repeatedly takes the unassigned item with the most unassigned neighbours within the
+// threshold as a cluster together with those neighbours. Clusters are returned largest first
+func butinaClusters(distances [][]float64, threshold float64) [][]int {
+	assigned := make([]bool, len(distances))
+	var clusters [][]int
+	for {
+		best := -1
+		var bestMembers []int
+		for i := range distances {
+			if assigned[i] {
+				continue
+			}
+			members := []int{i}
+			for j := range distances {
+				if j != i && !assigned[j] && distances[i][j] <= threshold {
+					members = append(members, j)
+				}
+			}
+			if len(members) > len(bestMembers) {
+				best = i
+				bestMembers = members
+			}
+		}
+		if best < 0 {
+			return clusters
+		}
+		for _, member := range bestMembers {
+			assigned[member] = true
+		}
+		clusters = append(clusters, bestMembers)
+	}
+}
+
+// returns the member of a cluster with the smallest summed distance to the other members
+func getMedoid(distances [][]float64, cluster []int) int {
+	medoid := cluster[0]
+	bestSum := -1.0
+	for _, i := range cluster {
+		sum := 0.0
+		for _, j := range cluster {
+			sum += distances[i][j]
+		}
+		if bestSum < 0 || sum < bestSum {
+			medoid = i
+			bestSum = sum
+		}
+	}
+	return medoid
+}
+
+// Reads the alternative instances listed after the representative in a top fragments file
+func loadAlternativeInstances(inPath string) map[string][]string {
+	alternatives := make(map[string][]string)
+	file, err := os.Open(inPath)
+	if err != nil {
+		fmt.Println("Failed to open ranked fragment file: " + inPath)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) > 3 {
+			alternatives[tokens[0]] = tokens[3:]
+		}
+	}
+	return alternatives
+}
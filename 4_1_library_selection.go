@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Exact selection is a branch and bound over candidate fragments, so it is only attempted for small problems
+const exactSelectionMaxFragments int = 40
+
+// A molecule as seen by library selection: the indices (into the ranked fragment list) of the fragments it needs
+type selectionMolecule struct {
+	lipid string
+	frags []int
+	weight float64
+}
+
+// Chooses up to budget fragments from a ranked fragment list so that the (class weighted) number of fully covered
+// molecules is as large as possible, then writes them in the same catalog format as generateLibrary.
+// mode is "greedy" or "exact"; classWeightsPath may be "" to weight every molecule equally
+func selectLibrary(inPath string, fragmentsDir string, outPath string, outDir string, budget int, mode string, classWeightsPath string) {
+
+	_ = os.MkdirAll(outDir, 0755)
+
+	keys, vals, paths := loadRankedFragments(inPath)
+	alternatives := loadAlternativeInstances(inPath)
+	classWeights := loadClassWeights(classWeightsPath)
+	molecules := getSelectionMolecules(keys, getMoleculeFragments(fragmentsDir), classWeights)
+
+	var chosen []bool
+	if mode == "exact" {
+		chosen = exactSelection(molecules, len(keys), budget)
+	} else if mode == "greedy" {
+		chosen = greedySelection(molecules, len(keys), budget)
+	} else {
+		log.Fatal("Unknown library selection mode: " + mode + " (expected \"greedy\" or \"exact\")")
+	}
+
+	// spend any budget the molecules could not use on the most frequent remaining fragments
+	numChosen := countChosen(chosen)
+	for i := 0; i < len(keys) && numChosen < budget; i++ {
+		if !chosen[i] {
+			chosen[i] = true
+			numChosen++
+		}
+	}
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to open molecule file: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	for i := 0; i < len(keys); i++ {
+		if chosen[i] {
+			addToLibrary(keys[i], vals[i], append([]string{paths[i]}, alternatives[keys[i]]...), outDir, outFile)
+		}
+	}
+
+	covered, coveredWeight, totalWeight := getSelectionCoverage(molecules, chosen)
+	fmt.Println("Selected " + strconv.Itoa(numChosen) + " fragments covering " + strconv.Itoa(covered) + " of " +
+		strconv.Itoa(len(molecules)) + " molecules (weighted coverage " + fmt.Sprintf("%.1f", coveredWeight) + " of " +
+		fmt.Sprintf("%.1f", totalWeight) + ")")
+}
+
+// Loads lipid class weights from a file of "prefix weight" lines, e.g. "LMGP0101 2.0".
+// A molecule takes the weight of the longest prefix of its name found in the file, and 1.0 otherwise
+func loadClassWeights(classWeightsPath string) map[string]float64 {
+	classWeights := make(map[string]float64)
+	if classWeightsPath == "" {
+		return classWeights
+	}
+
+	file, err := os.Open(classWeightsPath)
+	if err != nil {
+		fmt.Println("Failed to open class weights file: " + classWeightsPath)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) > 1 && !strings.HasPrefix(tokens[0], "#") {
+			weight, err := strconv.ParseFloat(tokens[1], 64)
+			if err != nil {
+				fmt.Println("Warning: could not parse weight " + tokens[1] + " in file: " + classWeightsPath)
+				continue
+			}
+			classWeights[tokens[0]] = weight
+		}
+	}
+	return classWeights
+}
+
+func getClassWeight(lipid string, classWeights map[string]float64) float64 {
+	weight := 1.0
+	bestLength := -1
+	for prefix, prefixWeight := range classWeights {
+		if strings.HasPrefix(lipid, prefix) && len(prefix) > bestLength {
+			weight = prefixWeight
+			bestLength = len(prefix)
+		}
+	}
+	return weight
+}
+
+// Builds the selection problem. Molecules with no library-relevant fragments are trivially covered and molecules
+// needing a fragment that is absent from the ranked list can never be covered; both are left out
+func getSelectionMolecules(keys []string, moleculeFragments map[string][]string, classWeights map[string]float64) []selectionMolecule {
+	keyToIndex := make(map[string]int)
+	for i, key := range keys {
+		keyToIndex[key] = i
+	}
+
+	var lipids []string
+	for lipid := range moleculeFragments {
+		lipids = append(lipids, lipid)
+	}
+	sort.Strings(lipids)
+
+	var molecules []selectionMolecule
+	for _, lipid := range lipids {
+		if len(moleculeFragments[lipid]) == 0 {
+			continue
+		}
+		var thisMolecule selectionMolecule
+		thisMolecule.lipid = lipid
+		thisMolecule.weight = getClassWeight(lipid, classWeights)
+		isCoverable := true
+		for _, fragment := range moleculeFragments[lipid] {
+			index, ok := keyToIndex[fragment]
+			if !ok {
+				isCoverable = false
+				break
+			}
+			thisMolecule.frags = append(thisMolecule.frags, index)
+		}
+		if isCoverable {
+			molecules = append(molecules, thisMolecule)
+		}
+	}
+	return molecules
+}
+
+// Greedy budgeted coverage: repeatedly add the missing fragments of whichever molecule completes the most molecule
+// weight per added fragment, until no molecule fits in the remaining budget
+func greedySelection(molecules []selectionMolecule, numFrags int, budget int) []bool {
+	chosen := make([]bool, numFrags)
+	numChosen := 0
+
+	// fragment index -> molecules that need it
+	fragToMolecules := make([][]int, numFrags)
+	for i, thisMolecule := range molecules {
+		for _, frag := range thisMolecule.frags {
+			fragToMolecules[frag] = append(fragToMolecules[frag], i)
+		}
+	}
+
+	for numChosen < budget {
+		// missing fragment count of every molecule under the current choice
+		numMissing := make([]int, len(molecules))
+		for i, thisMolecule := range molecules {
+			for _, frag := range thisMolecule.frags {
+				if !chosen[frag] {
+					numMissing[i]++
+				}
+			}
+		}
+
+		best := -1
+		bestRatio := 0.0
+		// molecules with the same missing set give the same candidate, only evaluate one of them
+		evaluated := make(map[string]bool)
+		for i, thisMolecule := range molecules {
+			if numMissing[i] == 0 || numMissing[i] > budget-numChosen {
+				continue
+			}
+			missing := getMissingFrags(thisMolecule, chosen)
+			signature := fmt.Sprint(missing)
+			if evaluated[signature] {
+				continue
+			}
+			evaluated[signature] = true
+
+			// count for every molecule how many of its missing fragments this candidate supplies
+			supplied := make(map[int]int)
+			gain := 0.0
+			for _, frag := range missing {
+				for _, j := range fragToMolecules[frag] {
+					supplied[j]++
+					if supplied[j] == numMissing[j] {
+						gain += molecules[j].weight
+					}
+				}
+			}
+			ratio := gain / float64(len(missing))
+			if ratio > bestRatio {
+				best = i
+				bestRatio = ratio
+			}
+		}
+		if best < 0 {
+			break
+		}
+		for _, frag := range getMissingFrags(molecules[best], chosen) {
+			chosen[frag] = true
+			numChosen++
+		}
+	}
+	return chosen
+}
+
+func getMissingFrags(thisMolecule selectionMolecule, chosen []bool) []int {
+	var missing []int
+	for _, frag := range thisMolecule.frags {
+		if !chosen[frag] {
+			missing = append(missing, frag)
+		}
+	}
+	sort.Ints(missing)
+	return missing
+}
+
+// Exact budgeted coverage by branch and bound over the fragments used by any molecule, seeded with the greedy
+// solution. Falls back to the greedy solution when there are too many candidate fragments
+func exactSelection(molecules []selectionMolecule, numFrags int, budget int) []bool {
+	greedy := greedySelection(molecules, numFrags, budget)
+
+	isCandidate := make([]bool, numFrags)
+	var candidates []int
+	for _, thisMolecule := range molecules {
+		for _, frag := range thisMolecule.frags {
+			if !isCandidate[frag] {
+				isCandidate[frag] = true
+				candidates = append(candidates, frag)
+			}
+		}
+	}
+	if len(candidates) > exactSelectionMaxFragments {
+		fmt.Println("Warning: " + strconv.Itoa(len(candidates)) + " candidate fragments is too many for exact " +
+			"selection (limit " + strconv.Itoa(exactSelectionMaxFragments) + "), using greedy selection instead")
+		return greedy
+	}
+	// most frequent fragments first, so good solutions are found early
+	sort.Ints(candidates)
+
+	_, bestWeight, _ := getSelectionCoverage(molecules, greedy)
+	best := make([]bool, numFrags)
+	copy(best, greedy)
+
+	chosen := make([]bool, numFrags)
+	// decided[frag] is true once the search has included or excluded frag
+	decided := make([]bool, numFrags)
+
+	var search func(depth int, numChosen int)
+	search = func(depth int, numChosen int) {
+		weight, bound := getSelectionBound(molecules, chosen, decided, budget-numChosen)
+		if weight > bestWeight {
+			bestWeight = weight
+			copy(best, chosen)
+		}
+		if depth == len(candidates) || numChosen == budget || bound <= bestWeight {
+			return
+		}
+		frag := candidates[depth]
+		decided[frag] = true
+		chosen[frag] = true
+		search(depth+1, numChosen+1)
+		chosen[frag] = false
+		search(depth+1, numChosen)
+		decided[frag] = false
+	}
+	search(0, 0)
+
+	return best
+}
+
+// Returns the weight covered by the current partial choice, and an upper bound on the weight reachable from it:
+// molecules that are covered, or whose missing fragments are all undecided and fit in the remaining budget
+func getSelectionBound(molecules []selectionMolecule, chosen []bool, decided []bool, remaining int) (float64, float64) {
+	weight := 0.0
+	bound := 0.0
+	for _, thisMolecule := range molecules {
+		numMissing := 0
+		isReachable := true
+		for _, frag := range thisMolecule.frags {
+			if !chosen[frag] {
+				if decided[frag] {
+					isReachable = false
+					break
+				}
+				numMissing++
+			}
+		}
+		if !isReachable || numMissing > remaining {
+			continue
+		}
+		if numMissing == 0 {
+			weight += thisMolecule.weight
+		}
+		bound += thisMolecule.weight
+	}
+	return weight, bound
+}
+
+func getSelectionCoverage(molecules []selectionMolecule, chosen []bool) (int, float64, float64) {
+	covered := 0
+	coveredWeight := 0.0
+	totalWeight := 0.0
+	for _, thisMolecule := range molecules {
+		totalWeight += thisMolecule.weight
+		if len(getMissingFrags(thisMolecule, chosen)) == 0 {
+			covered++
+			coveredWeight += thisMolecule.weight
+		}
+	}
+	return covered, coveredWeight, totalWeight
+}
+
+func countChosen(chosen []bool) int {
+	numChosen := 0
+	for _, isChosen := range chosen {
+		if isChosen {
+			numChosen++
+		}
+	}
+	return numChosen
+}
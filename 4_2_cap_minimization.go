@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Settings of the optional cap minimization stage run on library fragments before SDF export
+type minimizationSettings struct {
+	// "obminimize" or "builtin"
+	method string
+	// force field name understood by the method, e.g. MMFF94 or UFF for obminimize
+	forceField string
+	// optimizer of the builtin method, "sd" or "lbfgs"
+	algorithm string
+	steps int
+	// energy change below which the minimization counts as converged
+	convergence float64
+}
+
+type minimizationResult struct {
+	energy float64
+	converged bool
+}
+
+// Relaxes the atoms of a molecule that are not frozen, leaving frozen atoms where they are
+type capMinimizer interface {
+	minimize(atoms map[int]*atom, frozen map[int]bool, settings minimizationSettings) (minimizationResult, error)
+}
+
+func newCapMinimizer(method string) capMinimizer {
+	switch method {
+	case "obminimize":
+		return newObminimizeMinimizer()
+	case "builtin":
+		return &builtinMinimizer{}
+	}
+	log.Fatal("Unknown cap minimization method: " + method)
+	return nil
+}
+
+// Minimizes the cap atoms of every fragment TXYZ in a library directory in place. All atoms taken from the parent
+// molecule stay fixed. Converged energies are written to minimization.txt in the library directory
+func minimizeLibraryCaps(libraryDir string, settings minimizationSettings) {
+	minimizer := newCapMinimizer(settings.method)
+	txyzPaths := getLibraryFragmentPaths(libraryDir)
+
+	results := make([]minimizationResult, len(txyzPaths))
+	errs := make([]error, len(txyzPaths))
+	err := runWorkerPool(pipelineContext, "minimizing caps", len(txyzPaths), func(i int) {
+		results[i], errs[i] = minimizeFragmentCaps(txyzPaths[i], minimizer, settings)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	outPath := filepath2.Join(libraryDir, "minimization.txt")
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create minimization record: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	_, _ = outFile.WriteString("# fragment\tmethod\tforce_field\tsteps\tenergy\tconverged\n")
+	for i, txyzPath := range txyzPaths {
+		fragName := strings.Split(filepath2.Base(txyzPath), ".")[0]
+		if errs[i] != nil {
+			fmt.Println("Warning: cap minimization failed for " + txyzPath + ": " + errs[i].Error())
+			_, _ = outFile.WriteString(fragName + "\t" + settings.method + "\t" + settings.forceField + "\t" +
+				strconv.Itoa(settings.steps) + "\tfailed\tfalse\n")
+			continue
+		}
+		_, _ = outFile.WriteString(fragName + "\t" + settings.method + "\t" + settings.forceField + "\t" +
+			strconv.Itoa(settings.steps) + "\t" + fmt.Sprintf("%.4f", results[i].energy) + "\t" +
+			strconv.FormatBool(results[i].converged) + "\n")
+	}
+}
+
+// Returns the sorted paths of the library fragments <libraryDir>/<frag>/<frag>.txyz, leaving out alternative
+// instances and conformers in the subdirectories of each fragment directory
+func getLibraryFragmentPaths(libraryDir string) []string {
+	fileInfo, err := ioutil.ReadDir(libraryDir)
+	if err != nil {
+		fmt.Println("failed to read directory: " + libraryDir)
+		log.Fatal(err)
+	}
+	var txyzPaths []string
+	for i := 0; i < len(fileInfo); i++ {
+		if !fileInfo[i].IsDir() {
+			continue
+		}
+		txyzPath := filepath2.Join(libraryDir, fileInfo[i].Name(), fileInfo[i].Name()+".txyz")
+		if txyzExists, _ := exists(txyzPath); txyzExists {
+			txyzPaths = append(txyzPaths, txyzPath)
+		}
+	}
+	sort.Strings(txyzPaths)
+	return txyzPaths
+}
+
+// Minimizes the caps of one fragment file and rewrites it with the original header
+func minimizeFragmentCaps(txyzPath string, minimizer capMinimizer, settings minimizationSettings) (minimizationResult, error) {
+	_, atoms := loadLipid(txyzPath)
+	capAtoms := getCapAtoms(txyzPath)
+	if len(capAtoms) == 0 {
+		return minimizationResult{}, errors.New("no cap atoms listed in header")
+	}
+
+	frozen := make(map[int]bool)
+	for atomID := range atoms {
+		if !capAtoms[atomID] {
+			frozen[atomID] = true
+		}
+	}
+
+	result, err := minimizer.minimize(atoms, frozen, settings)
+	if err != nil {
+		return result, err
+	}
+	return result, writeTXYZ(atoms, txyzPath, getTXYZTitle(txyzPath))
+}
+
+// Returns the title of a TXYZ file: the header line without the atom count
+func getTXYZTitle(txyzPath string) string {
+	file, err := os.Open(txyzPath)
+	if err != nil {
+		fmt.Println("Failed to open molecule file: " + txyzPath)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan()
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 2 {
+		return ""
+	}
+	return strings.Join(fields[1:], " ")
+}
+
+///////////////////
+// obminimize
+///////////////////
+
+// RMSD (A) of the frozen atoms between input and obminimize output above which a warning is given
+const maxFrozenRMSD float64 = 0.3
+
+// Runs Open Babel's obminimize. It cannot hold atoms fixed, so the whole fragment is relaxed, superimposed by its
+// frozen atoms onto their original positions and only then do the movable atoms take their new positions. Caps
+// are thereby placed against the relaxed parent atoms, which are close to the original ones unless the parent
+// itself relaxed a lot, which is warned about
+type obminimizeMinimizer struct {
+	exe string
+}
+
+func newObminimizeMinimizer() *obminimizeMinimizer {
+	exe, err := exec.LookPath("obminimize")
+	if err != nil {
+		exe = obminimize
+	}
+	return &obminimizeMinimizer{exe: exe}
+}
+
+func (m *obminimizeMinimizer) minimize(atoms map[int]*atom, frozen map[int]bool, settings minimizationSettings) (minimizationResult, error) {
+	var result minimizationResult
+
+	tmpFile, err := ioutil.TempFile("", "capmin_*.txyz")
+	if err != nil {
+		return result, err
+	}
+	tmpPath := tmpFile.Name()
+	_ = tmpFile.Close()
+	defer os.Remove(tmpPath)
+	err = writeTXYZ(atoms, tmpPath, "cap minimization")
+	if err != nil {
+		return result, err
+	}
+
+	cmdArgs := []string{"-ff", settings.forceField, "-n", strconv.Itoa(settings.steps),
+		"-c", strconv.FormatFloat(settings.convergence, 'g', -1, 64), "-o", "xyz", tmpPath}
+	cmd := exec.Command(m.exe, cmdArgs...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return result, errors.New(err.Error() + ": " + stderr.String())
+	}
+
+	relaxed, err := parseXYZPositions(stdout.String(), len(atoms))
+	if err != nil {
+		return result, err
+	}
+	var frozenIDs []int
+	for atomID := range atoms {
+		if frozen[atomID] {
+			frozenIDs = append(frozenIDs, atomID)
+		}
+	}
+	sort.Ints(frozenIDs)
+	relaxedFrozen := make([][]float64, len(frozenIDs))
+	originalFrozen := make([][]float64, len(frozenIDs))
+	for i, atomID := range frozenIDs {
+		relaxedFrozen[i] = relaxed[atomID]
+		originalFrozen[i] = atoms[atomID].pos
+	}
+	rotation, relaxedCenter, originalCenter, rmsd := kabsch(relaxedFrozen, originalFrozen)
+	if rmsd > maxFrozenRMSD {
+		fmt.Println("Warning: obminimize moved the frozen atoms by " + strconv.FormatFloat(rmsd, 'f', 2, 64) +
+			" A RMSD, caps may not fit the parent geometry")
+	}
+	for atomID := range atoms {
+		if !frozen[atomID] {
+			atoms[atomID].pos = vecAdd(rotate(rotation, vecSub(relaxed[atomID], relaxedCenter)), originalCenter)
+		}
+	}
+
+	result.energy, result.converged = parseObminimizeLog(stderr.String() + stdout.String())
+	return result, nil
+}
+
+// Reads atom positions, numbered from 1, from plain XYZ text
+func parseXYZPositions(xyz string, numAtoms int) (map[int][]float64, error) {
+	positions := make(map[int][]float64)
+	lines := strings.Split(xyz, "\n")
+	for i := 2; i < len(lines) && len(positions) < numAtoms; i++ {
+		fields := strings.Fields(lines[i])
+		if len(fields) < 4 {
+			continue
+		}
+		pos := make([]float64, 3)
+		for j := 0; j < 3; j++ {
+			value, err := strconv.ParseFloat(fields[j+1], 64)
+			if err != nil {
+				return nil, errors.New("could not parse coordinate in line: " + lines[i])
+			}
+			pos[j] = value
+		}
+		positions[len(positions)+1] = pos
+	}
+	if len(positions) != numAtoms {
+		return nil, errors.New("expected " + strconv.Itoa(numAtoms) + " atoms in minimized structure, found " + strconv.Itoa(len(positions)))
+	}
+	return positions, nil
+}
+
+// Takes the energy from the last "step energy ..." line of the obminimize log
+func parseObminimizeLog(output string) (float64, bool) {
+	energy := 0.0
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue
+		}
+		if value, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			energy = value
+		}
+	}
+	return energy, strings.Contains(output, "HAS CONVERGED")
+}
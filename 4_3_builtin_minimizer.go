@@ -0,0 +1,592 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// Native force field minimizer with UFF style generic parameters, so caps can be relaxed without external tools.
+// Terms are harmonic bonds, cosine harmonic angles, cosine torsions and Lennard-Jones van der Waals between atoms
+// more than two bonds apart. Energies are in kcal/mol. Only terms that involve a movable atom are evaluated
+
+// Generic UFF parameters for one atom type
+type uffParameters struct {
+	// bond radius (A), natural angle (degrees), effective charge
+	radius float64
+	theta0 float64
+	charge float64
+	// van der Waals distance (A) and well depth (kcal/mol)
+	vdwDistance float64
+	vdwDepth float64
+	// sp3 torsion barrier (kcal/mol)
+	torsionBarrier float64
+}
+
+// Keyed by UFF atom type label
+var uffTable = map[string]uffParameters{
+	"H_":    {0.354, 180.0, 0.712, 2.886, 0.044, 0.0},
+	"C_3":   {0.757, 109.47, 1.912, 3.851, 0.105, 2.119},
+	"C_2":   {0.732, 120.0, 1.912, 3.851, 0.105, 0.0},
+	"C_1":   {0.706, 180.0, 1.912, 3.851, 0.105, 0.0},
+	"N_3":   {0.700, 106.7, 2.544, 3.660, 0.069, 0.450},
+	"N_2":   {0.685, 111.2, 2.544, 3.660, 0.069, 0.0},
+	"O_3":   {0.658, 104.51, 2.300, 3.500, 0.060, 0.018},
+	"O_2":   {0.634, 120.0, 2.300, 3.500, 0.060, 0.0},
+	"P_3":   {1.101, 109.47, 2.863, 4.147, 0.305, 2.400},
+	"S_3":   {1.064, 92.1, 2.703, 4.035, 0.274, 0.484},
+	"F_":    {0.668, 180.0, 1.735, 3.364, 0.050, 0.0},
+	"Cl":    {1.044, 180.0, 2.348, 3.947, 0.227, 0.0},
+	"Br":    {1.192, 180.0, 2.519, 4.189, 0.251, 0.0},
+	"I_":    {1.382, 180.0, 2.650, 4.500, 0.339, 0.0},
+	"Na":    {1.539, 180.0, 1.081, 2.983, 0.030, 0.0},
+	"other": {0.757, 109.47, 1.912, 3.851, 0.105, 0.0},
+}
+
+// Picks a UFF type from element and number of bonded atoms
+func getUFFType(thisAtom *atom) string {
+	numBonds := len(thisAtom.bondedAtoms)
+	switch thisAtom.element {
+	case "H":
+		return "H_"
+	case "C":
+		if numBonds >= 4 {
+			return "C_3"
+		} else if numBonds == 3 {
+			return "C_2"
+		}
+		return "C_1"
+	case "N":
+		if numBonds == 4 || numBonds == 3 {
+			return "N_3"
+		}
+		return "N_2"
+	case "O":
+		if numBonds >= 2 {
+			return "O_3"
+		}
+		return "O_2"
+	case "P":
+		return "P_3"
+	case "S":
+		return "S_3"
+	case "F":
+		return "F_"
+	case "Cl", "CL":
+		return "Cl"
+	case "Br", "BR":
+		return "Br"
+	case "I":
+		return "I_"
+	case "Na", "NA":
+		return "Na"
+	}
+	return "other"
+}
+
+type ffBond struct {
+	i, j int
+	k, r0 float64
+}
+
+type ffAngle struct {
+	i, j, k int
+	force, cosTheta0, sinTheta0Sq float64
+}
+
+type ffTorsion struct {
+	i, j, k, l int
+	barrier float64
+	multiplicity float64
+	// torsion energy is barrier/2 * (1 - cosPhase * cos(multiplicity * phi))
+	cosPhase float64
+}
+
+type ffPair struct {
+	i, j int
+	depth, distance float64
+}
+
+// All energy terms that involve at least one movable atom, over coordinates indexed by position in ids
+type forceField struct {
+	ids []int
+	bonds []ffBond
+	angles []ffAngle
+	torsions []ffTorsion
+	pairs []ffPair
+}
+
+// Distance beyond which van der Waals pairs are ignored (A)
+const vdwCutoff float64 = 10.0
+
+func buildForceField(atoms map[int]*atom, frozen map[int]bool) *forceField {
+	var ff forceField
+	for atomID := range atoms {
+		ff.ids = append(ff.ids, atomID)
+	}
+	sort.Ints(ff.ids)
+	index := make(map[int]int)
+	types := make([]uffParameters, len(ff.ids))
+	for i, atomID := range ff.ids {
+		index[atomID] = i
+		types[i] = uffTable[getUFFType(atoms[atomID])]
+	}
+	isMovable := func(atomIDs ...int) bool {
+		for _, atomID := range atomIDs {
+			if !frozen[atomID] {
+				return true
+			}
+		}
+		return false
+	}
+	bondLength := func(a int, b int) float64 {
+		return types[index[a]].radius + types[index[b]].radius
+	}
+
+	// bonds, and the bond separation of every pair within two bonds for the van der Waals exclusions
+	excluded := make(map[[2]int]bool)
+	for _, a := range ff.ids {
+		for _, b := range atoms[a].bondedAtoms {
+			excluded[[2]int{a, b}] = true
+			for _, c := range atoms[b].bondedAtoms {
+				excluded[[2]int{a, c}] = true
+			}
+			if a < b && isMovable(a, b) {
+				r0 := bondLength(a, b)
+				k := 664.12 * types[index[a]].charge * types[index[b]].charge / (r0 * r0 * r0)
+				ff.bonds = append(ff.bonds, ffBond{index[a], index[b], k, r0})
+			}
+		}
+	}
+
+	// angles a-b-c centred on b
+	for _, b := range ff.ids {
+		bonded := atoms[b].bondedAtoms
+		for x := 0; x < len(bonded); x++ {
+			for y := x + 1; y < len(bonded); y++ {
+				a := bonded[x]
+				c := bonded[y]
+				if !isMovable(a, b, c) {
+					continue
+				}
+				theta0 := types[index[b]].theta0 * math.Pi / 180
+				cosTheta0 := math.Cos(theta0)
+				rab := bondLength(a, b)
+				rbc := bondLength(b, c)
+				rac := math.Sqrt(rab*rab + rbc*rbc - 2*rab*rbc*cosTheta0)
+				force := 664.12 * types[index[a]].charge * types[index[c]].charge / math.Pow(rac, 5) *
+					(3*rab*rbc*(1-cosTheta0*cosTheta0) - rac*rac*cosTheta0)
+				sinTheta0Sq := math.Max(1-cosTheta0*cosTheta0, 1e-3)
+				ff.angles = append(ff.angles, ffAngle{index[a], index[b], index[c], force, cosTheta0, sinTheta0Sq})
+			}
+		}
+	}
+
+	// torsions a-b-c-d about the b-c bond
+	for _, b := range ff.ids {
+		for _, c := range atoms[b].bondedAtoms {
+			if b > c {
+				continue
+			}
+			typeB := getUFFType(atoms[b])
+			typeC := getUFFType(atoms[c])
+			barrier, multiplicity, cosPhase := getTorsionParameters(typeB, typeC, types[index[b]], types[index[c]])
+			if barrier == 0 {
+				continue
+			}
+			for _, a := range atoms[b].bondedAtoms {
+				if a == c {
+					continue
+				}
+				for _, d := range atoms[c].bondedAtoms {
+					if d == b || d == a || !isMovable(a, b, c, d) {
+						continue
+					}
+					ff.torsions = append(ff.torsions, ffTorsion{index[a], index[b], index[c], index[d], barrier, multiplicity, cosPhase})
+				}
+			}
+		}
+	}
+
+	// van der Waals pairs more than two bonds apart
+	for x := 0; x < len(ff.ids); x++ {
+		for y := x + 1; y < len(ff.ids); y++ {
+			a := ff.ids[x]
+			b := ff.ids[y]
+			if excluded[[2]int{a, b}] || !isMovable(a, b) {
+				continue
+			}
+			depth := math.Sqrt(types[x].vdwDepth * types[y].vdwDepth)
+			distance := math.Sqrt(types[x].vdwDistance * types[y].vdwDistance)
+			ff.pairs = append(ff.pairs, ffPair{x, y, depth, distance})
+		}
+	}
+	return &ff
+}
+
+// UFF torsion rules for the central bond: sp3-sp3 threefold, sp2-sp3 sixfold, sp2-sp2 twofold
+func getTorsionParameters(typeB string, typeC string, paramsB uffParameters, paramsC uffParameters) (float64, float64, float64) {
+	isSp3B := typeB == "C_3" || typeB == "N_3" || typeB == "O_3" || typeB == "P_3" || typeB == "S_3"
+	isSp3C := typeC == "C_3" || typeC == "N_3" || typeC == "O_3" || typeC == "P_3" || typeC == "S_3"
+	isSp2B := typeB == "C_2" || typeB == "N_2" || typeB == "O_2"
+	isSp2C := typeC == "C_2" || typeC == "N_2" || typeC == "O_2"
+	if isSp3B && isSp3C {
+		return math.Sqrt(paramsB.torsionBarrier * paramsC.torsionBarrier), 3, -1
+	} else if (isSp3B && isSp2C) || (isSp2B && isSp3C) {
+		return 1.0, 6, 1
+	} else if isSp2B && isSp2C {
+		return 5.0, 2, 1
+	}
+	return 0, 0, 0
+}
+
+func (ff *forceField) energy(coords [][]float64) float64 {
+	energy := 0.0
+	for _, bond := range ff.bonds {
+		dr := vecDistance(coords[bond.i], coords[bond.j]) - bond.r0
+		energy += 0.5 * bond.k * dr * dr
+	}
+	for _, angle := range ff.angles {
+		u := vecUnit(vecSub(coords[angle.i], coords[angle.j]))
+		v := vecUnit(vecSub(coords[angle.k], coords[angle.j]))
+		dc := vecDot(u, v) - angle.cosTheta0
+		energy += angle.force / (2 * angle.sinTheta0Sq) * dc * dc
+	}
+	for _, torsion := range ff.torsions {
+		phi := getDihedral(coords[torsion.i], coords[torsion.j], coords[torsion.k], coords[torsion.l])
+		energy += 0.5 * torsion.barrier * (1 - torsion.cosPhase*math.Cos(torsion.multiplicity*phi))
+	}
+	for _, pair := range ff.pairs {
+		r := vecDistance(coords[pair.i], coords[pair.j])
+		if r > vdwCutoff {
+			continue
+		}
+		ratio6 := math.Pow(pair.distance/math.Max(r, 0.1), 6)
+		energy += pair.depth * (ratio6*ratio6 - 2*ratio6)
+	}
+	return energy
+}
+
+///////////////////
+// Minimizer
+///////////////////
+
+// RMS gradient below which a minimization counts as converged regardless of the energy change (kcal/mol/A)
+const gradientTolerance float64 = 1e-3
+
+// Minimizes with the native force field; settings.algorithm selects the optimizer, "sd" or "lbfgs".
+// settings.forceField is ignored, the builtin parameters are always used
+type builtinMinimizer struct{}
+
+func (m *builtinMinimizer) minimize(atoms map[int]*atom, frozen map[int]bool, settings minimizationSettings) (minimizationResult, error) {
+	var result minimizationResult
+
+	ff := buildForceField(atoms, frozen)
+	coords := make([][]float64, len(ff.ids))
+	var movable []int
+	for i, atomID := range ff.ids {
+		coords[i] = []float64{atoms[atomID].pos[0], atoms[atomID].pos[1], atoms[atomID].pos[2]}
+		if !frozen[atomID] {
+			movable = append(movable, i)
+		}
+	}
+
+	switch settings.algorithm {
+	case "sd":
+		result = steepestDescent(ff, coords, movable, settings)
+	case "lbfgs", "":
+		result = lbfgs(ff, coords, movable, settings)
+	default:
+		return result, errors.New("unknown optimizer for builtin minimizer: " + settings.algorithm + " (expected sd or lbfgs)")
+	}
+
+	// write back new slices, fragments may share position slices with their parent molecule
+	for _, i := range movable {
+		atoms[ff.ids[i]].pos = coords[i]
+	}
+	return result, nil
+}
+
+// Analytic gradient of energy, flattened over the movable coordinates
+func (ff *forceField) gradient(coords [][]float64, movable []int) []float64 {
+	forces := make([][]float64, len(coords))
+	for i := range forces {
+		forces[i] = make([]float64, 3)
+	}
+	addGradient := func(i int, dE []float64, scale float64) {
+		for d := 0; d < 3; d++ {
+			forces[i][d] += scale * dE[d]
+		}
+	}
+
+	for _, bond := range ff.bonds {
+		rij := vecSub(coords[bond.i], coords[bond.j])
+		r := vecNorm(rij)
+		if r == 0 {
+			continue
+		}
+		dEdr := bond.k * (r - bond.r0)
+		addGradient(bond.i, rij, dEdr/r)
+		addGradient(bond.j, rij, -dEdr/r)
+	}
+
+	for _, angle := range ff.angles {
+		rij := vecSub(coords[angle.i], coords[angle.j])
+		rkj := vecSub(coords[angle.k], coords[angle.j])
+		lengthIJ := vecNorm(rij)
+		lengthKJ := vecNorm(rkj)
+		if lengthIJ == 0 || lengthKJ == 0 {
+			continue
+		}
+		u := vecScale(rij, 1/lengthIJ)
+		v := vecScale(rkj, 1/lengthKJ)
+		cosTheta := vecDot(u, v)
+		dEdc := angle.force / angle.sinTheta0Sq * (cosTheta - angle.cosTheta0)
+		// derivatives of cos(theta) with respect to the outer atoms, the centre takes minus their sum
+		dci := vecScale(vecSub(v, vecScale(u, cosTheta)), 1/lengthIJ)
+		dck := vecScale(vecSub(u, vecScale(v, cosTheta)), 1/lengthKJ)
+		addGradient(angle.i, dci, dEdc)
+		addGradient(angle.k, dck, dEdc)
+		addGradient(angle.j, vecAdd(dci, dck), -dEdc)
+	}
+
+	for _, torsion := range ff.torsions {
+		// derivatives of the dihedral angle after Blondel and Karplus, J. Comput. Chem. 17, 1132 (1996),
+		// whose angle has the opposite sign of getDihedral
+		f := vecSub(coords[torsion.i], coords[torsion.j])
+		g := vecSub(coords[torsion.j], coords[torsion.k])
+		h := vecSub(coords[torsion.l], coords[torsion.k])
+		a := vecCross(f, g)
+		b := vecCross(h, g)
+		aSq := vecDot(a, a)
+		bSq := vecDot(b, b)
+		lengthG := vecNorm(g)
+		if aSq < 1e-12 || bSq < 1e-12 || lengthG == 0 {
+			continue
+		}
+		phi := getDihedral(coords[torsion.i], coords[torsion.j], coords[torsion.k], coords[torsion.l])
+		dEdphi := -0.5 * torsion.barrier * torsion.cosPhase * torsion.multiplicity * math.Sin(torsion.multiplicity*phi)
+		dphii := vecScale(a, -lengthG/aSq)
+		dphil := vecScale(b, lengthG/bSq)
+		fg := vecDot(f, g) / (aSq * lengthG)
+		hg := vecDot(h, g) / (bSq * lengthG)
+		dphij := vecAdd(vecScale(dphii, -1), vecSub(vecScale(a, fg), vecScale(b, hg)))
+		dphik := vecAdd(vecScale(dphil, -1), vecSub(vecScale(b, hg), vecScale(a, fg)))
+		addGradient(torsion.i, dphii, dEdphi)
+		addGradient(torsion.j, dphij, dEdphi)
+		addGradient(torsion.k, dphik, dEdphi)
+		addGradient(torsion.l, dphil, dEdphi)
+	}
+
+	for _, pair := range ff.pairs {
+		rij := vecSub(coords[pair.i], coords[pair.j])
+		r := vecNorm(rij)
+		// the energy is cut off beyond vdwCutoff and flat below 0.1 A
+		if r > vdwCutoff || r <= 0.1 {
+			continue
+		}
+		ratio6 := math.Pow(pair.distance/r, 6)
+		dEdr := -12 * pair.depth / r * (ratio6*ratio6 - ratio6)
+		addGradient(pair.i, rij, dEdr/r)
+		addGradient(pair.j, rij, -dEdr/r)
+	}
+
+	grad := make([]float64, 3*len(movable))
+	for n, i := range movable {
+		copy(grad[3*n:3*n+3], forces[i])
+	}
+	return grad
+}
+
+func displace(coords [][]float64, movable []int, direction []float64, step float64) {
+	for n, i := range movable {
+		for d := 0; d < 3; d++ {
+			coords[i][d] += step * direction[3*n+d]
+		}
+	}
+}
+
+func getRMS(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, value := range values {
+		sum += value * value
+	}
+	return math.Sqrt(sum / float64(len(values)))
+}
+
+func steepestDescent(ff *forceField, coords [][]float64, movable []int, settings minimizationSettings) minimizationResult {
+	energy := ff.energy(coords)
+	step := 0.01
+	for iteration := 0; iteration < settings.steps; iteration++ {
+		grad := ff.gradient(coords, movable)
+		if getRMS(grad) < gradientTolerance {
+			return minimizationResult{energy: energy, converged: true}
+		}
+		direction := vecUnitN(grad, -1)
+		displace(coords, movable, direction, step)
+		newEnergy := ff.energy(coords)
+		if newEnergy < energy {
+			step *= 1.2
+			converged := energy-newEnergy < settings.convergence
+			energy = newEnergy
+			if converged {
+				return minimizationResult{energy: energy, converged: true}
+			}
+		} else {
+			displace(coords, movable, direction, -step)
+			step *= 0.5
+			if step < 1e-8 {
+				return minimizationResult{energy: energy, converged: false}
+			}
+		}
+	}
+	return minimizationResult{energy: energy, converged: false}
+}
+
+// scales a vector to unit length times sign
+func vecUnitN(a []float64, sign float64) []float64 {
+	norm := math.Sqrt(dotN(a, a))
+	out := make([]float64, len(a))
+	if norm == 0 {
+		return out
+	}
+	for i := range a {
+		out[i] = sign * a[i] / norm
+	}
+	return out
+}
+
+func dotN(a []float64, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// Number of correction pairs kept by L-BFGS
+const lbfgsMemory int = 8
+
+// Limited memory BFGS with a backtracking line search
+func lbfgs(ff *forceField, coords [][]float64, movable []int, settings minimizationSettings) minimizationResult {
+	energy := ff.energy(coords)
+	grad := ff.gradient(coords, movable)
+	var sList, yList [][]float64
+	var rhoList []float64
+
+	for iteration := 0; iteration < settings.steps; iteration++ {
+		if getRMS(grad) < gradientTolerance {
+			return minimizationResult{energy: energy, converged: true}
+		}
+
+		// two loop recursion for the search direction
+		q := make([]float64, len(grad))
+		copy(q, grad)
+		alphas := make([]float64, len(sList))
+		for k := len(sList) - 1; k >= 0; k-- {
+			alphas[k] = rhoList[k] * dotN(sList[k], q)
+			for n := range q {
+				q[n] -= alphas[k] * yList[k][n]
+			}
+		}
+		gamma := 0.01
+		if len(sList) > 0 {
+			last := len(sList) - 1
+			gamma = dotN(sList[last], yList[last]) / dotN(yList[last], yList[last])
+		}
+		for n := range q {
+			q[n] *= gamma
+		}
+		for k := 0; k < len(sList); k++ {
+			beta := rhoList[k] * dotN(yList[k], q)
+			for n := range q {
+				q[n] += sList[k][n] * (alphas[k] - beta)
+			}
+		}
+		direction := make([]float64, len(q))
+		for n := range q {
+			direction[n] = -q[n]
+		}
+		slope := dotN(direction, grad)
+		if slope >= 0 {
+			// not a descent direction, restart from steepest descent
+			sList, yList, rhoList = nil, nil, nil
+			direction = vecUnitN(grad, -0.01)
+			slope = dotN(direction, grad)
+		}
+
+		// backtracking line search on the Armijo condition, capping the largest atom displacement at 0.3 A
+		step := math.Min(1.0, 0.3/math.Max(maxAbs(direction), 1e-12))
+		var newEnergy float64
+		accepted := false
+		for tries := 0; tries < 30; tries++ {
+			displace(coords, movable, direction, step)
+			newEnergy = ff.energy(coords)
+			if newEnergy <= energy+1e-4*step*slope {
+				accepted = true
+				break
+			}
+			displace(coords, movable, direction, -step)
+			step *= 0.5
+		}
+		if !accepted {
+			if len(sList) == 0 {
+				// not even a short steepest descent step lowers the energy
+				return minimizationResult{energy: energy, converged: false}
+			}
+			// the curvature model has gone bad, restart from steepest descent
+			sList, yList, rhoList = nil, nil, nil
+			continue
+		}
+
+		newGrad := ff.gradient(coords, movable)
+		s := make([]float64, len(direction))
+		y := make([]float64, len(direction))
+		for n := range direction {
+			s[n] = step * direction[n]
+			y[n] = newGrad[n] - grad[n]
+		}
+		if sy := dotN(s, y); sy > 1e-10 {
+			sList = append(sList, s)
+			yList = append(yList, y)
+			rhoList = append(rhoList, 1/sy)
+			if len(sList) > lbfgsMemory {
+				sList, yList, rhoList = sList[1:], yList[1:], rhoList[1:]
+			}
+		}
+
+		converged := energy-newEnergy < settings.convergence
+		energy = newEnergy
+		grad = newGrad
+		if converged {
+			return minimizationResult{energy: energy, converged: true}
+		}
+	}
+	return minimizationResult{energy: energy, converged: false}
+}
+
+func maxAbs(values []float64) float64 {
+	largest := 0.0
+	for _, value := range values {
+		largest = math.Max(largest, math.Abs(value))
+	}
+	return largest
+}
+
+// Relaxes the cap atoms of a fragment in memory with the builtin minimizer, all other atoms fixed
+func relaxCaps(atoms map[int]*atom, settings minimizationSettings) (minimizationResult, error) {
+	frozen := make(map[int]bool)
+	for atomID, thisAtom := range atoms {
+		if !thisAtom.isCap {
+			frozen[atomID] = true
+		}
+	}
+	if len(frozen) == len(atoms) {
+		return minimizationResult{converged: true}, nil
+	}
+	var minimizer builtinMinimizer
+	return minimizer.minimize(atoms, frozen, settings)
+}
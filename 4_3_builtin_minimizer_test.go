@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Methanol from getTestMethanol pushed away from its minimum, so that every term has a gradient
+func getDistortedMethanol() map[int]*atom {
+	atoms := getTestMethanol()
+	offsets := map[int][]float64{
+		3:  {0.05, -0.03, 0.02},
+		7:  {-0.1, 0.04, 0.06},
+		10: {0.02, 0.1, -0.05},
+		11: {-0.07, 0.01, 0.03},
+		12: {0.04, -0.06, -0.08},
+		13: {0.1, 0.05, 0.3},
+	}
+	for atomID, offset := range offsets {
+		atoms[atomID].pos = vecAdd(atoms[atomID].pos, offset)
+	}
+	return atoms
+}
+
+func TestForceFieldGradientMatchesFiniteDifferences(t *testing.T) {
+	atoms := getDistortedMethanol()
+	// C frozen, so that terms between frozen and movable atoms are checked too
+	ff := buildForceField(atoms, map[int]bool{3: true})
+	if len(ff.bonds) == 0 || len(ff.angles) == 0 || len(ff.torsions) == 0 || len(ff.pairs) == 0 {
+		t.Fatalf("methanol should have every term, got %d bonds, %d angles, %d torsions, %d pairs",
+			len(ff.bonds), len(ff.angles), len(ff.torsions), len(ff.pairs))
+	}
+	coords := make([][]float64, len(ff.ids))
+	var movable []int
+	for i, atomID := range ff.ids {
+		coords[i] = atoms[atomID].pos
+		if atomID != 3 {
+			movable = append(movable, i)
+		}
+	}
+
+	grad := ff.gradient(coords, movable)
+	const h = 1e-6
+	for n, i := range movable {
+		for d := 0; d < 3; d++ {
+			original := coords[i][d]
+			coords[i][d] = original + h
+			plus := ff.energy(coords)
+			coords[i][d] = original - h
+			minus := ff.energy(coords)
+			coords[i][d] = original
+			numerical := (plus - minus) / (2 * h)
+			if math.Abs(grad[3*n+d]-numerical) > 1e-4*math.Max(1, math.Abs(numerical)) {
+				t.Errorf("atom %d, axis %d: analytic gradient %g, finite differences %g", ff.ids[i], d, grad[3*n+d], numerical)
+			}
+		}
+	}
+}
+
+func TestBuiltinMinimizerConverges(t *testing.T) {
+	for _, algorithm := range []string{"sd", "lbfgs"} {
+		atoms := getDistortedMethanol()
+		ff := buildForceField(atoms, nil)
+		coords := make([][]float64, len(ff.ids))
+		for i, atomID := range ff.ids {
+			coords[i] = atoms[atomID].pos
+		}
+		before := ff.energy(coords)
+
+		settings := minimizationSettings{method: "builtin", algorithm: algorithm, steps: 5000, convergence: 1e-9}
+		result, err := (&builtinMinimizer{}).minimize(atoms, nil, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.converged || result.energy >= before {
+			t.Errorf("%s: converged %v, energy %g from %g", algorithm, result.converged, result.energy, before)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Settings of the conformer search run on library fragments before SDF export
+type conformerSettings struct {
+	// number of torsion driven candidates; every combination of rotamers is tried if there are fewer than this
+	maxConformers int
+	// number of conformers kept after pruning, lowest energy first
+	keepConformers int
+	// heavy atom RMSD (A) below which a conformer counts as a duplicate of a lower energy one
+	rmsdThreshold float64
+	// builtin force field minimization steps per candidate, 0 to rank the unrelaxed candidates
+	minimizationSteps int
+	// also use the poses of the fragment in every parent molecule it was found in, up to maxPoses of them
+	usePoses bool
+	maxPoses int
+	// replace the library TXYZ with the lowest energy conformer. Unless that is the input geometry, whose caps
+	// alone are relaxed, the atoms taken from the parent molecule move too
+	useLowest bool
+	seed int64
+}
+
+type fragmentConformer struct {
+	// coordinates in the atom order of forceField.ids
+	coords [][]float64
+	energy float64
+	rmsdToInput float64
+	// where the candidate came from: input, pose <parent fragment> or torsions <angles>
+	source string
+}
+
+// A rotatable bond b-c and the atoms on the c side, as indices into forceField.ids
+type rotor struct {
+	b, c int
+	side []int
+}
+
+// Staggered rotamers tried about every rotatable bond, relative to the input dihedral (degrees)
+var rotamerOffsets = []float64{0, 120, 240}
+
+// Generates conformers for every fragment in a library catalog. The kept conformers of each fragment are written
+// to a conformers directory beside its TXYZ, and a summary of all of them to conformers.txt in libraryDir.
+// uniqueFragsDir holds the .info files written by fragSelector, listing every occurrence of each fragment.
+// Returns the paths of all conformer TXYZs written
+func generateLibraryConformers(catalogPath string, libraryDir string, uniqueFragsDir string, settings conformerSettings) []string {
+	var smiles []string
+	var txyzPaths []string
+	file, err := os.Open(catalogPath)
+	if err != nil {
+		fmt.Println("Failed to open library catalog: " + catalogPath)
+		log.Fatal(err)
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) >= 3 {
+			smiles = append(smiles, tokens[0])
+			txyzPaths = append(txyzPaths, tokens[2])
+		}
+	}
+	_ = file.Close()
+
+	var poses map[string][]string
+	if settings.usePoses {
+		poses = loadOccurrencePoses(uniqueFragsDir)
+	}
+
+	conformers := make([][]fragmentConformer, len(txyzPaths))
+	err = runWorkerPool(pipelineContext, "generating conformers", len(txyzPaths), func(i int) {
+		conformers[i] = generateFragmentConformers(txyzPaths[i], poses[smiles[i]], settings)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	outPath := filepath2.Join(libraryDir, "conformers.txt")
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create conformer summary: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	var conformerPaths []string
+	_, _ = outFile.WriteString("# fragment\tconformer\tenergy\trmsd_to_input\tsource\n")
+	for i, txyzPath := range txyzPaths {
+		fragName := strings.Split(filepath2.Base(txyzPath), ".")[0]
+		for k, conformer := range conformers[i] {
+			conformerPaths = append(conformerPaths, getConformerPath(txyzPath, k))
+			_, _ = outFile.WriteString(fragName + "\t" + strconv.Itoa(k+1) + "\t" + fmt.Sprintf("%.4f", conformer.energy) +
+				"\t" + fmt.Sprintf("%.3f", conformer.rmsdToInput) + "\t" + conformer.source + "\n")
+		}
+	}
+	return conformerPaths
+}
+
+// Path of the k-th kept conformer (from 0) of the fragment at txyzPath
+func getConformerPath(txyzPath string, k int) string {
+	fragName := strings.Split(filepath2.Base(txyzPath), ".")[0]
+	return filepath2.Join(filepath2.Dir(txyzPath), "conformers", fragName+"_conf"+strconv.Itoa(k+1)+".txyz")
+}
+
+// Maps each fragment SMILES to the TXYZ paths of all of its occurrences, read from the .info files of fragSelector
+func loadOccurrencePoses(uniqueFragsDir string) map[string][]string {
+	poses := make(map[string][]string)
+	fileInfo, err := ioutil.ReadDir(uniqueFragsDir)
+	if err != nil {
+		fmt.Println("failed to read directory: " + uniqueFragsDir)
+		log.Fatal(err)
+	}
+	for i := 0; i < len(fileInfo); i++ {
+		if filepath2.Ext(fileInfo[i].Name()) != ".info" {
+			continue
+		}
+		infoPath := filepath2.Join(uniqueFragsDir, fileInfo[i].Name())
+		file, err := os.Open(infoPath)
+		if err != nil {
+			fmt.Println("Failed to open fragment info file: " + infoPath)
+			log.Fatal(err)
+		}
+		scanner := bufio.NewScanner(file)
+		key := ""
+		if scanner.Scan() {
+			tokens := strings.Fields(scanner.Text())
+			if len(tokens) > 0 {
+				key = tokens[0]
+			}
+		}
+		for scanner.Scan() {
+			path := strings.TrimSpace(scanner.Text())
+			if key != "" && path != "" {
+				poses[key] = append(poses[key], path)
+			}
+		}
+		_ = file.Close()
+	}
+	return poses
+}
+
+// Generates, ranks and prunes the conformers of one library fragment and writes the kept ones to disk
+func generateFragmentConformers(txyzPath string, posePaths []string, settings conformerSettings) []fragmentConformer {
+	_, atoms := loadLipid(txyzPath)
+	capAtoms := getCapAtoms(txyzPath)
+	ff := buildForceField(atoms, map[int]bool{})
+	index := make(map[int]int)
+	all := make([]int, len(ff.ids))
+	var caps []int
+	var heavy []int
+	input := make([][]float64, len(ff.ids))
+	for i, atomID := range ff.ids {
+		index[atomID] = i
+		all[i] = i
+		if capAtoms[atomID] {
+			caps = append(caps, i)
+		}
+		if atoms[atomID].element != "H" {
+			heavy = append(heavy, i)
+		}
+		input[i] = []float64{atoms[atomID].pos[0], atoms[atomID].pos[1], atoms[atomID].pos[2]}
+	}
+
+	candidates := []fragmentConformer{{coords: copyCoords(input), source: "input"}}
+
+	// poses of the same fragment in other parent molecules, renumbered to this fragment's atoms and superimposed
+	// onto the input geometry
+	if settings.usePoses {
+		numPoses := 0
+		for _, posePath := range posePaths {
+			if numPoses >= settings.maxPoses {
+				break
+			}
+			if filepath2.Base(posePath) == filepath2.Base(txyzPath) {
+				continue
+			}
+			if _, err := os.Stat(posePath); err != nil {
+				continue
+			}
+			poseName, poseAtoms := loadLipid(posePath)
+			mapping, ok := getAtomMapping(atoms, poseAtoms)
+			if !ok {
+				fmt.Println("Warning: could not map atoms of " + posePath + " onto " + txyzPath)
+				continue
+			}
+			coords := make([][]float64, len(ff.ids))
+			for i, atomID := range ff.ids {
+				pos := poseAtoms[mapping[atomID]].pos
+				coords[i] = []float64{pos[0], pos[1], pos[2]}
+			}
+			coords = superimpose(coords, input)
+			candidates = append(candidates, fragmentConformer{coords: coords, source: "pose " + poseName})
+			numPoses++
+		}
+	}
+
+	// rotamers about the rotatable bonds of the input geometry
+	rotors := getRotors(atoms, index)
+	for _, offsets := range getRotamerCombinations(len(rotors), settings.maxConformers, settings.seed) {
+		coords := copyCoords(input)
+		var angles []string
+		for r, offset := range offsets {
+			angles = append(angles, strconv.Itoa(int(offset)))
+			if offset == 0 {
+				continue
+			}
+			origin := coords[rotors[r].b]
+			axis := vecSub(coords[rotors[r].c], origin)
+			for _, i := range rotors[r].side {
+				coords[i] = rotateAboutAxis(coords[i], origin, axis, offset*math.Pi/180)
+			}
+		}
+		candidates = append(candidates, fragmentConformer{coords: coords, source: "torsions " + strings.Join(angles, ",")})
+	}
+
+	// heavy atom RMSDs are the lowest over the symmetries of the fragment, so that rotamers of a trimethylammonium
+	// or phosphate group that only swap equivalent atoms count as duplicates
+	permutations := getSymmetryPermutations(atoms, true)
+	minimization := minimizationSettings{method: "builtin", algorithm: "lbfgs", steps: settings.minimizationSteps, convergence: 1e-6}
+	for c := range candidates {
+		// the input keeps its parent atoms fixed as in minimizeLibraryCaps, the other candidates relax entirely
+		movable := all
+		if candidates[c].source == "input" {
+			movable = caps
+		}
+		if settings.minimizationSteps > 0 && len(movable) > 0 {
+			candidates[c].energy = lbfgs(ff, candidates[c].coords, movable, minimization).energy
+		} else {
+			candidates[c].energy = ff.energy(candidates[c].coords)
+		}
+		candidates[c].rmsdToInput = getSymmetricRMSD(selectCoords(candidates[c].coords, heavy), selectCoords(input, heavy), permutations)
+	}
+	sort.SliceStable(candidates, func(x, y int) bool {
+		return candidates[x].energy < candidates[y].energy
+	})
+
+	// keep the lowest energy candidate of every group closer than the RMSD threshold
+	var kept []fragmentConformer
+	for _, candidate := range candidates {
+		if len(kept) >= settings.keepConformers {
+			break
+		}
+		if math.IsNaN(candidate.energy) || math.IsInf(candidate.energy, 0) {
+			continue
+		}
+		duplicate := false
+		for _, other := range kept {
+			if getSymmetricRMSD(selectCoords(candidate.coords, heavy), selectCoords(other.coords, heavy), permutations) < settings.rmsdThreshold {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			kept = append(kept, candidate)
+		}
+	}
+
+	confDir := filepath2.Join(filepath2.Dir(txyzPath), "conformers")
+	_ = os.RemoveAll(confDir)
+	_ = os.MkdirAll(confDir, 0755)
+	title := getTXYZTitle(txyzPath)
+	for k, conformer := range kept {
+		setCoords(atoms, ff.ids, conformer.coords)
+		confPath := getConformerPath(txyzPath, k)
+		err := writeTXYZ(atoms, confPath, title)
+		if err != nil {
+			fmt.Println("Failed to write conformer: " + confPath)
+			log.Fatal(err)
+		}
+	}
+	if settings.useLowest && len(kept) > 0 {
+		setCoords(atoms, ff.ids, kept[0].coords)
+		err := writeTXYZ(atoms, txyzPath, title)
+		if err != nil {
+			fmt.Println("Failed to write lowest energy conformer to " + txyzPath)
+			log.Fatal(err)
+		}
+	}
+	return kept
+}
+
+// Finds the acyclic bonds worth rotating: both ends carry heavy atoms besides each other, and the bond is not
+// double or amide-like (both ends trigonal, or a trigonal carbon on an amine nitrogen)
+func getRotors(atoms map[int]*atom, index map[int]int) []rotor {
+	var atomIDs []int
+	for atomID := range atoms {
+		atomIDs = append(atomIDs, atomID)
+	}
+	sort.Ints(atomIDs)
+
+	hasOtherHeavyNeighbour := func(atomID int, partner int) bool {
+		for _, bondedAtom := range atoms[atomID].bondedAtoms {
+			if bondedAtom != partner && atoms[bondedAtom].element != "H" {
+				return true
+			}
+		}
+		return false
+	}
+
+	var rotors []rotor
+	for _, b := range atomIDs {
+		for _, c := range atoms[b].bondedAtoms {
+			if b > c || atoms[b].element == "H" || atoms[c].element == "H" {
+				continue
+			}
+			if !hasOtherHeavyNeighbour(b, c) || !hasOtherHeavyNeighbour(c, b) {
+				continue
+			}
+			typeB := getUFFType(atoms[b])
+			typeC := getUFFType(atoms[c])
+			isTrigonalB := typeB == "C_2" || typeB == "N_2"
+			isTrigonalC := typeC == "C_2" || typeC == "N_2"
+			isAmide := (typeB == "C_2" && atoms[c].element == "N") || (typeC == "C_2" && atoms[b].element == "N")
+			if (isTrigonalB && isTrigonalC) || isAmide {
+				continue
+			}
+
+			// atoms reached from c without crossing the bond; reaching b means the bond is in a ring
+			visited := map[int]bool{b: true, c: true}
+			queue := []int{c}
+			side := []int{index[c]}
+			inRing := false
+			for len(queue) > 0 && !inRing {
+				current := queue[0]
+				queue = queue[1:]
+				for _, bondedAtom := range atoms[current].bondedAtoms {
+					if bondedAtom == b && current != c {
+						inRing = true
+						break
+					}
+					if !visited[bondedAtom] {
+						visited[bondedAtom] = true
+						queue = append(queue, bondedAtom)
+						side = append(side, index[bondedAtom])
+					}
+				}
+			}
+			if !inRing {
+				rotors = append(rotors, rotor{index[b], index[c], side})
+			}
+		}
+	}
+	return rotors
+}
+
+// Returns the rotamer offsets to apply to numRotors bonds: every combination other than the input if there are at
+// most maxCombinations of them, otherwise maxCombinations random ones
+func getRotamerCombinations(numRotors int, maxCombinations int, seed int64) [][]float64 {
+	var combinations [][]float64
+	if numRotors == 0 || maxCombinations <= 0 {
+		return combinations
+	}
+	total := math.Pow(float64(len(rotamerOffsets)), float64(numRotors))
+	if total-1 <= float64(maxCombinations) {
+		for n := 1; n < int(total); n++ {
+			offsets := make([]float64, numRotors)
+			value := n
+			for r := 0; r < numRotors; r++ {
+				offsets[r] = rotamerOffsets[value%len(rotamerOffsets)]
+				value /= len(rotamerOffsets)
+			}
+			combinations = append(combinations, offsets)
+		}
+		return combinations
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	for n := 0; n < maxCombinations; n++ {
+		offsets := make([]float64, numRotors)
+		for r := range offsets {
+			offsets[r] = rotamerOffsets[rng.Intn(len(rotamerOffsets))]
+		}
+		combinations = append(combinations, offsets)
+	}
+	return combinations
+}
+
+func copyCoords(coords [][]float64) [][]float64 {
+	copied := make([][]float64, len(coords))
+	for i := range coords {
+		copied[i] = []float64{coords[i][0], coords[i][1], coords[i][2]}
+	}
+	return copied
+}
+
+func selectCoords(coords [][]float64, indices []int) [][]float64 {
+	selected := make([][]float64, len(indices))
+	for n, i := range indices {
+		selected[n] = coords[i]
+	}
+	return selected
+}
+
+// writes coordinates in forceField.ids order back onto the atoms as new position slices
+func setCoords(atoms map[int]*atom, ids []int, coords [][]float64) {
+	for i, atomID := range ids {
+		atoms[atomID].pos = []float64{coords[i][0], coords[i][1], coords[i][2]}
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	filepath2 "path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Settings written to every poltype.ini when no config file is given
+var defaultPoltypeSettings = []poltypeSetting{{key: "numproc", value: "4"}, {key: "maxmem", value: "20GB"},
+	{key: "maxdisk", value: "100GB"}, {key: "externalapi", value: "RenLabCluster"}, {key: "username", value: "jtg2769"}}
+
+// POLTYPE input keys a config file may set. Config files can add more in a [keys] section
+var knownPoltypeKeys = []string{"structure", "totalcharge", "numproc", "maxmem", "maxdisk", "externalapi", "username", "atmidx",
+	"optmethod", "toroptmethod", "espmethod", "dmamethod", "optbasisset", "toroptbasisset", "dmabasisset",
+	"espbasisset", "dontfrag", "dontdotor", "dontdotorfit", "onlyrotbndslist", "use_gaus", "use_gausoptonly",
+	"suppressdipoleerr", "optmaxcycle", "maxtorRMSPD"}
+
+// Fragment properties that config rules can test and values can refer to as {name}, {atoms}, ...
+var poltypeFragmentFields = []string{"name", "structure", "atoms", "heavyatoms", "charge", "contains"}
+
+type poltypeSetting struct {
+	key string
+	value string
+	// line of the config file the setting was read from, 0 for built in settings
+	line int
+}
+
+// One test of a rule, e.g. heavyatoms>=20, charge!=0 or contains=P
+type poltypeCondition struct {
+	field string
+	op string
+	value string
+}
+
+// A config section whose settings apply to the fragments meeting all of its conditions
+type poltypeRule struct {
+	header string
+	conditions []poltypeCondition
+	settings []poltypeSetting
+}
+
+// Settings for POLTYPE inputs, read by loadPoltypeConfig. The file holds sections of key=value lines:
+//
+//	[defaults]              settings of every fragment
+//	[rule heavyatoms>=20]   settings of fragments meeting all the space separated conditions, on atoms,
+//	                        heavyatoms or charge (=, !=, <, <=, >, >=), contains (element) or name
+//	[fragment <name>]       settings of one fragment
+//	[keys]                  further valid POLTYPE keys, one per line
+//
+// Rules override the defaults and are applied in file order, later ones overriding earlier ones. [fragment]
+// sections override all rules wherever they are in the file. Values may refer to the fragment as {name},
+// {structure}, {atoms}, {heavyatoms} or {charge}. totalcharge is the perceived charge unless a section sets it
+type poltypeConfig struct {
+	path string
+	defaults []poltypeSetting
+	rules []poltypeRule
+	// [fragment] sections, as rules on the name
+	fragments []poltypeRule
+	knownKeys map[string]bool
+}
+
+// What the rules of a config are tested against
+type poltypeFragmentInfo struct {
+	name string
+	structure string
+	numAtoms int
+	numHeavyAtoms int
+	// perceived formal charge, as in the fragment TXYZ header
+	charge int
+	elements map[string]bool
+	// false if the fragment TXYZ was not found, then only rules on the name can match
+	known bool
+}
+
+// Loads a POLTYPE input config, or the default settings if path is "". Malformed sections, conditions and values
+// and unknown keys stop the program
+func loadPoltypeConfig(path string) poltypeConfig {
+	config := poltypeConfig{path: path, knownKeys: make(map[string]bool)}
+	for _, key := range knownPoltypeKeys {
+		config.knownKeys[strings.ToLower(key)] = true
+	}
+	if path == "" {
+		config.defaults = defaultPoltypeSettings
+		return config
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Failed to open POLTYPE config: " + path)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	section := ""
+	var rule *poltypeRule
+	lineNum := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			header := strings.TrimSpace(line[1 : len(line)-1])
+			fields := strings.Fields(header)
+			if len(fields) == 0 {
+				log.Fatal("Empty section header on line " + strconv.Itoa(lineNum) + " of POLTYPE config " + path)
+			}
+			section = fields[0]
+			rule = nil
+			switch section {
+			case "defaults", "keys":
+				if len(fields) > 1 {
+					log.Fatal("Section [" + section + "] takes no conditions, line " + strconv.Itoa(lineNum) + " of " + path)
+				}
+			case "fragment":
+				if len(fields) != 2 {
+					log.Fatal("Section [fragment] needs one fragment name, line " + strconv.Itoa(lineNum) + " of " + path)
+				}
+				config.fragments = append(config.fragments, poltypeRule{header: header,
+					conditions: []poltypeCondition{{"name", "=", fields[1]}}})
+				rule = &config.fragments[len(config.fragments)-1]
+			case "rule":
+				var conditions []poltypeCondition
+				for _, field := range fields[1:] {
+					condition, ok := parsePoltypeCondition(field)
+					if !ok {
+						log.Fatal("Could not read condition " + field + " on line " + strconv.Itoa(lineNum) + " of " + path)
+					}
+					conditions = append(conditions, condition)
+				}
+				config.rules = append(config.rules, poltypeRule{header: header, conditions: conditions})
+				rule = &config.rules[len(config.rules)-1]
+			default:
+				log.Fatal("Unknown section [" + section + "] on line " + strconv.Itoa(lineNum) + " of " + path)
+			}
+			continue
+		}
+
+		if section == "keys" {
+			config.knownKeys[strings.ToLower(line)] = true
+			continue
+		}
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 || section == "" {
+			log.Fatal("Expected key=value in a section on line " + strconv.Itoa(lineNum) + " of POLTYPE config " + path)
+		}
+		setting := poltypeSetting{strings.TrimSpace(keyValue[0]), strings.TrimSpace(keyValue[1]), lineNum}
+		if err := checkPoltypeSetting(setting); err != "" {
+			log.Fatal(err + " on line " + strconv.Itoa(lineNum) + " of POLTYPE config " + path)
+		}
+		if rule != nil {
+			rule.settings = append(rule.settings, setting)
+		} else {
+			config.defaults = append(config.defaults, setting)
+		}
+	}
+
+	// keys are checked once the whole file, with its [keys] sections, has been read
+	sectionSettings := append([][]poltypeSetting{config.defaults}, getRuleSettings(config.rules)...)
+	for _, settings := range append(sectionSettings, getRuleSettings(config.fragments)...) {
+		for _, setting := range settings {
+			if !config.knownKeys[strings.ToLower(setting.key)] {
+				log.Fatal("Unknown POLTYPE key " + setting.key + " on line " + strconv.Itoa(setting.line) + " of " +
+					path + ", add it to a [keys] section if it is intended")
+			}
+		}
+	}
+	return config
+}
+
+func getRuleSettings(rules []poltypeRule) [][]poltypeSetting {
+	var settings [][]poltypeSetting
+	for _, rule := range rules {
+		settings = append(settings, rule.settings)
+	}
+	return settings
+}
+
+// Parses a condition such as heavyatoms>=20
+func parsePoltypeCondition(text string) (poltypeCondition, bool) {
+	for _, op := range []string{"!=", ">=", "<=", "=", ">", "<"} {
+		i := strings.Index(text, op)
+		if i <= 0 {
+			continue
+		}
+		condition := poltypeCondition{strings.ToLower(text[:i]), op, text[i+len(op):]}
+		switch condition.field {
+		case "atoms", "heavyatoms", "charge":
+			if _, err := strconv.Atoi(condition.value); err != nil {
+				return condition, false
+			}
+		case "name", "contains":
+			if op != "=" && op != "!=" {
+				return condition, false
+			}
+		default:
+			return condition, false
+		}
+		return condition, condition.value != ""
+	}
+	return poltypeCondition{}, false
+}
+
+// Checks the values POLTYPE is known to read as numbers or sizes, and that placeholders name fragment fields.
+// Returns an error message, or "" if the setting is fine
+func checkPoltypeSetting(setting poltypeSetting) string {
+	if setting.key == "" {
+		return "Empty POLTYPE key"
+	}
+	if strings.ToLower(setting.key) == "structure" {
+		return "structure is set to the fragment SDF and cannot be configured"
+	}
+	value := setting.value
+	for strings.Contains(value, "{") {
+		start := strings.Index(value, "{")
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			return "Unclosed placeholder in " + setting.key + "=" + setting.value
+		}
+		field := value[start+1 : start+end]
+		if !containsString(poltypeFragmentFields, field) || field == "contains" {
+			return "Unknown placeholder {" + field + "} in " + setting.key + "=" + setting.value
+		}
+		value = value[start+end+1:]
+	}
+	if strings.Contains(setting.value, "{") {
+		return ""
+	}
+
+	switch strings.ToLower(setting.key) {
+	case "numproc":
+		if n, err := strconv.Atoi(setting.value); err != nil || n < 1 {
+			return "numproc must be a positive integer, not " + setting.value
+		}
+	case "totalcharge":
+		if _, err := strconv.Atoi(setting.value); err != nil {
+			return "totalcharge must be an integer, not " + setting.value
+		}
+	case "maxmem", "maxdisk":
+		size := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(setting.value), "GB"), "MB"), "TB")
+		if n, err := strconv.Atoi(size); err != nil || n < 1 || size == strings.ToUpper(setting.value) {
+			return setting.key + " must be a size such as 20GB, not " + setting.value
+		}
+	}
+	return ""
+}
+
+// Returns the settings of a fragment: its perceived charge, then the defaults overridden by every matching rule
+// in order and by its [fragment] sections, with placeholders filled in. The SDFs made from the TXYZs carry no formal charges, so POLTYPE is
+// given the total charge
+func (config poltypeConfig) getSettings(info poltypeFragmentInfo) []poltypeSetting {
+	var settings []poltypeSetting
+	index := make(map[string]int)
+	apply := func(setting poltypeSetting) {
+		setting.value = fillPoltypePlaceholders(setting.value, info)
+		key := strings.ToLower(setting.key)
+		if i, ok := index[key]; ok {
+			settings[i] = setting
+		} else {
+			index[key] = len(settings)
+			settings = append(settings, setting)
+		}
+	}
+	if info.known {
+		apply(poltypeSetting{key: "totalcharge", value: strconv.Itoa(info.charge)})
+	}
+	for _, setting := range config.defaults {
+		apply(setting)
+	}
+	for _, rule := range append(append([]poltypeRule{}, config.rules...), config.fragments...) {
+		if rule.matches(info) {
+			for _, setting := range rule.settings {
+				apply(setting)
+			}
+		}
+	}
+	return settings
+}
+
+func (rule poltypeRule) matches(info poltypeFragmentInfo) bool {
+	for _, condition := range rule.conditions {
+		if !condition.matches(info) {
+			return false
+		}
+	}
+	return true
+}
+
+func (condition poltypeCondition) matches(info poltypeFragmentInfo) bool {
+	if condition.field == "name" {
+		return (info.name == condition.value) == (condition.op == "=")
+	}
+	if !info.known {
+		return false
+	}
+	if condition.field == "contains" {
+		return info.elements[condition.value] == (condition.op == "=")
+	}
+
+	value := info.numAtoms
+	if condition.field == "heavyatoms" {
+		value = info.numHeavyAtoms
+	} else if condition.field == "charge" {
+		value = info.charge
+	}
+	limit, _ := strconv.Atoi(condition.value)
+	switch condition.op {
+	case "=":
+		return value == limit
+	case "!=":
+		return value != limit
+	case ">":
+		return value > limit
+	case ">=":
+		return value >= limit
+	case "<":
+		return value < limit
+	case "<=":
+		return value <= limit
+	}
+	return false
+}
+
+func fillPoltypePlaceholders(value string, info poltypeFragmentInfo) string {
+	return strings.NewReplacer("{name}", info.name, "{structure}", info.structure, "{atoms}", strconv.Itoa(info.numAtoms),
+		"{heavyatoms}", strconv.Itoa(info.numHeavyAtoms), "{charge}", strconv.Itoa(info.charge)).Replace(value)
+}
+
+// Writes a poltype.ini into every fragment directory of a library directory that holds <fragment>.sdf. SDFs
+// directly in the library directory or in other subdirectories (representatives, conformers) get none
+func createPoltypeINIs(dir string, config poltypeConfig) {
+	fileInfo, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fmt.Println("failed to read directory: " + dir)
+		log.Fatal(err)
+	}
+	for i := 0; i < len(fileInfo); i++ {
+		if !fileInfo[i].IsDir() {
+			if filepath2.Ext(fileInfo[i].Name()) == ".sdf" {
+				fmt.Println("Warning: no poltype.ini for " + fileInfo[i].Name() + ", which is not in a fragment directory")
+			}
+			continue
+		}
+		fragDir := filepath2.Join(dir, fileInfo[i].Name())
+		sdfName := fileInfo[i].Name() + ".sdf"
+		if sdfExists, _ := exists(filepath2.Join(fragDir, sdfName)); !sdfExists {
+			continue
+		}
+		info := getPoltypeFragmentInfo(fragDir, fileInfo[i].Name(), sdfName)
+		createPoltypeINI(filepath2.Join(fragDir, "poltype.ini"), sdfName, config.getSettings(info))
+	}
+}
+
+// Reads the size, elements and perceived charge of a fragment from its TXYZ
+func getPoltypeFragmentInfo(fragDir string, fragName string, sdfName string) poltypeFragmentInfo {
+	info := poltypeFragmentInfo{name: fragName, structure: sdfName, elements: make(map[string]bool)}
+	txyzPath := filepath2.Join(fragDir, fragName+".txyz")
+	if txyzExists, _ := exists(txyzPath); !txyzExists {
+		fmt.Println("Warning: " + txyzPath + " not found, only [fragment] rules apply to " + fragName)
+		return info
+	}
+	_, atoms := loadLipid(txyzPath)
+	info.known = true
+	info.numAtoms = len(atoms)
+	for _, thisAtom := range atoms {
+		info.elements[thisAtom.element] = true
+		if thisAtom.element != "H" {
+			info.numHeavyAtoms++
+		}
+	}
+	info.charge = getFragmentCharge(atoms)
+	return info
+}
+
+func createPoltypeINI(thisPath string, sdfName string, settings []poltypeSetting) {
+	thisFile, err := os.Create(thisPath)
+	if err != nil {
+		fmt.Println("Failed to create new fragment file: " + thisPath)
+		log.Fatal(err)
+	}
+	defer thisFile.Close()
+
+	// write header
+	lines := []string{"structure=" + sdfName}
+	for _, setting := range settings {
+		lines = append(lines, setting.key+"="+setting.value)
+	}
+	_, err = thisFile.WriteString(strings.Join(lines, "\n") + "\n")
+	if err != nil {
+		fmt.Println("Failed to write POLTYPE input: " + thisPath)
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	filepath2 "path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePoltypeCondition(t *testing.T) {
+	tests := []struct {
+		text string
+		want poltypeCondition
+		ok bool
+	}{
+		{"heavyatoms>=20", poltypeCondition{"heavyatoms", ">=", "20"}, true},
+		{"charge!=0", poltypeCondition{"charge", "!=", "0"}, true},
+		{"charge<=-1", poltypeCondition{"charge", "<=", "-1"}, true},
+		{"Atoms<10", poltypeCondition{"atoms", "<", "10"}, true},
+		{"contains=P", poltypeCondition{"contains", "=", "P"}, true},
+		{"name!=PC_single_1", poltypeCondition{"name", "!=", "PC_single_1"}, true},
+		{"heavyatoms>=x", poltypeCondition{}, false},
+		{"contains>P", poltypeCondition{}, false},
+		{"mass>3", poltypeCondition{}, false},
+		{"name=", poltypeCondition{}, false},
+		{"=5", poltypeCondition{}, false},
+		{"heavyatoms", poltypeCondition{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parsePoltypeCondition(test.text)
+		if ok != test.ok || (ok && got != test.want) {
+			t.Errorf("%s: got %v %v, want %v %v", test.text, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+// The [fragment] section comes first to show that it overrides the rules regardless of file order
+const testPoltypeConfig = `[defaults]
+numproc=4
+maxmem=20GB
+maxdisk=100GB
+
+[fragment dmp]
+numproc=16
+
+[rule heavyatoms>=5]
+numproc=8
+maxmem=40GB
+
+[rule charge!=0]
+username={name}_{charge}
+
+[fragment ion]
+totalcharge=1
+`
+
+func TestCreatePoltypeINIs(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath2.Join(dir, "poltype.cfg")
+	if err := os.WriteFile(configPath, []byte(testPoltypeConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	libraryDir := filepath2.Join(dir, "library")
+	// dmp has a TXYZ to perceive its charge from, ion only an SDF
+	for _, fragName := range []string{"dmp", "ion"} {
+		if err := os.MkdirAll(filepath2.Join(libraryDir, fragName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath2.Join(libraryDir, fragName, fragName+".sdf"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeTXYZ(getTestDimethylPhosphate(), filepath2.Join(libraryDir, "dmp", "dmp.txyz"), "dmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	createPoltypeINIs(libraryDir, loadPoltypeConfig(configPath))
+
+	tests := []struct {
+		fragName string
+		want []string
+	}{
+		// perceived charge of the phosphate, the defaults, both rules and the [fragment] section over them
+		{"dmp", []string{"structure=dmp.sdf", "totalcharge=-1", "numproc=16", "maxmem=40GB", "maxdisk=100GB",
+			"username=dmp_-1"}},
+		// no charge without a TXYZ and no rules on size or charge, but a [fragment] section can set it
+		{"ion", []string{"structure=ion.sdf", "numproc=4", "maxmem=20GB", "maxdisk=100GB", "totalcharge=1"}},
+	}
+	for _, test := range tests {
+		contents, err := os.ReadFile(filepath2.Join(libraryDir, test.fragName, "poltype.ini"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(contents)); got != strings.Join(test.want, "\n") {
+			t.Errorf("%s: poltype.ini\n%s\nwant\n%s", test.fragName, got, strings.Join(test.want, "\n"))
+		}
+	}
+}
@@ -45,32 +45,63 @@ func generateLibrary(inPath string, outPath string, outDir string, limit int) {
 			if val < limit {
 				break
 			}
-			path := tokens[2]
-			name := filepath2.Base(path)
-			baseName := strings.Split(name, ".")[0]
-			dir := filepath2.Join(outDir, baseName)
-			_ = os.Mkdir(dir, 0755)
-			out := filepath2.Join(dir, name)
-			_, err = copyFile(path, out)
-
-			_, _ = outFile.WriteString(smiles + "\t" + out + "\n")
+			addToLibrary(smiles, val, tokens[2:], outDir, outFile)
 		}
 
 	}
 
 }
 
-func copyFile(src, dst string) (int64, error) {
-	sourceFileStat, err := os.Stat(src)
+// copies a fragment TXYZ, the first of paths, into its own library subdirectory and records it in the catalog.
+// Any further paths are alternative instances of the fragment and go into a representatives subdirectory
+func addToLibrary(smiles string, val int, paths []string, outDir string, outFile *os.File) {
+	name := filepath2.Base(paths[0])
+	baseName := strings.Split(name, ".")[0]
+	dir := filepath2.Join(outDir, baseName)
+	_ = os.Mkdir(dir, 0755)
+	out := filepath2.Join(dir, name)
+	_, err := copyFile(paths[0], out)
 	if err != nil {
-		return 0, err
+		fmt.Println("Failed to copy fragment " + paths[0] + " into library")
+		log.Fatal(err)
 	}
 
-	if !sourceFileStat.Mode().IsRegular() {
+	if len(paths) > 1 {
+		altDir := filepath2.Join(dir, "representatives")
+		_ = os.RemoveAll(altDir)
+		_ = os.Mkdir(altDir, 0755)
+		for _, path := range paths[1:] {
+			_, err = copyFile(path, filepath2.Join(altDir, filepath2.Base(path)))
+			if err != nil {
+				fmt.Println("Failed to copy alternative instance " + path + " into library")
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// catalog line: SMILES, frequency in source database, path to library TXYZ
+	_, _ = outFile.WriteString(smiles + "\t" + strconv.Itoa(val) + "\t" + out + "\n")
+}
+
+// Returns the TXYZs of the alternative instances in <libraryDir>/<frag>/representatives, which obabelConversion
+// does not reach. Their SDFs keep the parent geometry, since alternative geometries are what they are for
+func getRepresentativePaths(libraryDir string) []string {
+	paths, err := filepath2.Glob(filepath2.Join(libraryDir, "*", "representatives", "*.txyz"))
+	if err != nil {
+		fmt.Println("failed to list representatives in " + libraryDir)
+		log.Fatal(err)
+	}
+	return paths
+}
+
+// Copies a file, or a fragment occurrence stored in fragmentDB
+func copyFile(src, dst string) (int64, error) {
+	sourceFileStat, err := os.Stat(src)
+	if err == nil && !sourceFileStat.Mode().IsRegular() {
 		return 0, fmt.Errorf("%s is not a regular file", src)
 	}
 
-	source, err := os.Open(src)
+	source, err := openFragmentFile(src)
 	if err != nil {
 		return 0, err
 	}
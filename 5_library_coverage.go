@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Coverage of one molecule by the ranked fragment lists. A rank is the number of top fragments N needed for every
+// fragment of the molecule to be included; 0 means the molecule has no (non-hydrocarbon) fragments of that kind
+type moleculeCoverage struct {
+	lipid string
+	numSingles int
+	numDoubles int
+	singleRank int
+	doubleRank int
+}
+
+// Computes, for each molecule, whether all its fragments are in the library and how coverage grows with N
+func coverageAnalysis(dir string, singleFragmentsDir string, doubleFragmentsDir string, moleculeListPath string, step int) {
+
+	singleKeys, singleVals, _ := loadRankedFragments(filepath2.Join(dir, "top_single_fragments.txt"))
+	doubleKeys, doubleVals, _ := loadRankedFragments(filepath2.Join(dir, "top_double_fragments.txt"))
+
+	moleculeSingles := getMoleculeFragments(singleFragmentsDir)
+	moleculeDoubles := getMoleculeFragments(doubleFragmentsDir)
+
+	lipids, unfragmented := getCoverageMoleculeSet(moleculeSingles, moleculeListPath)
+	fmt.Println("Analyzing library coverage of " + strconv.Itoa(len(lipids)) + " molecules...")
+	if len(unfragmented) > 0 {
+		// a molecule without fragments would count as covered by N = 0, so these are reported apart from the curves
+		unfragmentedPath := filepath2.Join(dir, "coverage_unfragmented.txt")
+		err := ioutil.WriteFile(unfragmentedPath, []byte(strings.Join(unfragmented, "\n")+"\n"), 0644)
+		if err != nil {
+			fmt.Println("Failed to write coverage file: " + unfragmentedPath)
+			log.Fatal(err)
+		}
+		fmt.Println(strconv.Itoa(len(unfragmented)) + " listed molecules have no fragments and are left out of the " +
+			"coverage analysis, see " + unfragmentedPath)
+	}
+
+	singleRanks := make(map[string]int)
+	for i, key := range singleKeys {
+		singleRanks[key] = i + 1
+	}
+	doubleRanks := make(map[string]int)
+	for i, key := range doubleKeys {
+		doubleRanks[key] = i + 1
+	}
+
+	coverage := make([]moleculeCoverage, len(lipids))
+	for i, lipid := range lipids {
+		coverage[i].lipid = lipid
+		coverage[i].numSingles = len(moleculeSingles[lipid])
+		coverage[i].numDoubles = len(moleculeDoubles[lipid])
+		coverage[i].singleRank = getRequiredRank(moleculeSingles[lipid], singleRanks)
+		coverage[i].doubleRank = getRequiredRank(moleculeDoubles[lipid], doubleRanks)
+	}
+
+	// the library as generateLibrary would build it with the current limits
+	singleN := getNumAboveLimit(singleVals, singleFragLimit)
+	doubleN := getNumAboveLimit(doubleVals, doubleFragLimit)
+
+	writeMoleculeCoverage(filepath2.Join(dir, "coverage_molecules.txt"), coverage, singleN, doubleN)
+	writeCoverageCurve(filepath2.Join(dir, "coverage_single_curve.txt"), coverage, singleVals, step, true)
+	writeCoverageCurve(filepath2.Join(dir, "coverage_double_curve.txt"), coverage, doubleVals, step, false)
+
+	covered := 0
+	for _, thisCoverage := range coverage {
+		if thisCoverage.singleRank <= singleN && thisCoverage.doubleRank <= doubleN {
+			covered++
+		}
+	}
+	fmt.Println("With singleFragLimit = " + strconv.Itoa(singleFragLimit) + " (" + strconv.Itoa(singleN) +
+		" fragments) and doubleFragLimit = " + strconv.Itoa(doubleFragLimit) + " (" + strconv.Itoa(doubleN) +
+		" fragments), " + strconv.Itoa(covered) + " of " + strconv.Itoa(len(coverage)) + " molecules are fully covered.")
+}
+
+// Reads a ranked fragment list as written by writeTopFrags. Returns keys, counts and example paths in file order
+func loadRankedFragments(inPath string) ([]string, []int, []string) {
+	var keys []string
+	var vals []int
+	var paths []string
+
+	file, err := os.Open(inPath)
+	if err != nil {
+		fmt.Println("Failed to open ranked fragment file: " + inPath)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) > 2 {
+			val, err := strconv.Atoi(tokens[1])
+			if err != nil {
+				fmt.Println("Warning: could not parse count " + tokens[1] + " in file: " + inPath)
+				continue
+			}
+			keys = append(keys, tokens[0])
+			vals = append(vals, val)
+			paths = append(paths, tokens[2])
+		}
+	}
+	return keys, vals, paths
+}
+
+// Groups the unique non-hydrocarbon fragment SMILES in a fragment directory by the lipid they were cut from.
+// Hydrocarbon fragments are left out since generateLibrary never takes them into the library
+func getMoleculeFragments(fragmentsDir string) map[string][]string {
+	moleculeFragments := make(map[string][]string)
+
+	fragNameToSMILES := getFragmentSMILES(fragmentsDir)
+	fragNames := make([]string, 0, len(fragNameToSMILES))
+	for fragName := range fragNameToSMILES {
+		fragNames = append(fragNames, fragName)
+	}
+	sort.Strings(fragNames)
+
+	seen := make(map[string]map[string]bool)
+	for _, fragName := range fragNames {
+		lipid := fragmentNameToLipidName(fragName)
+		smiString := fragNameToSMILES[fragName]
+		if _, ok := seen[lipid]; !ok {
+			seen[lipid] = make(map[string]bool)
+			moleculeFragments[lipid] = []string{}
+		}
+		if isSMILESHydrocarbon(smiString) || seen[lipid][smiString] {
+			continue
+		}
+		seen[lipid][smiString] = true
+		moleculeFragments[lipid] = append(moleculeFragments[lipid], smiString)
+	}
+	return moleculeFragments
+}
+
+// Recovers the lipid name from a fragment name as written by fragmentMolecule
+func fragmentNameToLipidName(fragName string) string {
+	for _, tag := range []string{"_single_", "_double_", "_dimer_"} {
+		if index := strings.LastIndex(fragName, tag); index >= 0 {
+			return fragName[:index]
+		}
+	}
+	return fragName
+}
+
+// Returns the sorted list of molecules to analyze: either those listed in moleculeListPath or all fragmented molecules.
+// Listed molecules without fragments are returned separately, also sorted
+func getCoverageMoleculeSet(moleculeFragments map[string][]string, moleculeListPath string) ([]string, []string) {
+	var lipids []string
+	var unfragmented []string
+	if moleculeListPath == "" {
+		for lipid := range moleculeFragments {
+			lipids = append(lipids, lipid)
+		}
+	} else {
+		file, err := os.Open(moleculeListPath)
+		if err != nil {
+			fmt.Println("Failed to open molecule list file: " + moleculeListPath)
+			log.Fatal(err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			tokens := strings.Fields(scanner.Text())
+			if len(tokens) > 0 {
+				lipid := strings.Split(filepath2.Base(tokens[0]), ".")[0]
+				if _, ok := moleculeFragments[lipid]; !ok {
+					fmt.Println("Warning: no fragments found for listed molecule " + lipid)
+					unfragmented = append(unfragmented, lipid)
+					continue
+				}
+				lipids = append(lipids, lipid)
+			}
+		}
+	}
+	sort.Strings(lipids)
+	sort.Strings(unfragmented)
+	return lipids, unfragmented
+}
+
+// Returns the number of top ranked fragments needed to include all given fragments.
+// Fragments missing from the ranking entirely make the molecule impossible to cover (math.MaxInt32)
+func getRequiredRank(fragments []string, ranks map[string]int) int {
+	requiredRank := 0
+	for _, fragment := range fragments {
+		rank, ok := ranks[fragment]
+		if !ok {
+			return math.MaxInt32
+		}
+		if rank > requiredRank {
+			requiredRank = rank
+		}
+	}
+	return requiredRank
+}
+
+// Number of fragments generateLibrary takes from a ranked list for a given frequency limit
+func getNumAboveLimit(vals []int, limit int) int {
+	n := 0
+	for n < len(vals) && vals[n] >= limit {
+		n++
+	}
+	return n
+}
+
+func writeMoleculeCoverage(outPath string, coverage []moleculeCoverage, singleN int, doubleN int) {
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create coverage file: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	_, _ = outFile.WriteString("# lipid\tsingles\tdoubles\tsingle_rank_needed\tdouble_rank_needed\tcovered_at_limits\n")
+	for _, thisCoverage := range coverage {
+		covered := thisCoverage.singleRank <= singleN && thisCoverage.doubleRank <= doubleN
+		_, _ = outFile.WriteString(thisCoverage.lipid + "\t" + strconv.Itoa(thisCoverage.numSingles) + "\t" +
+			strconv.Itoa(thisCoverage.numDoubles) + "\t" + rankToString(thisCoverage.singleRank) + "\t" +
+			rankToString(thisCoverage.doubleRank) + "\t" + strconv.FormatBool(covered) + "\n")
+	}
+}
+
+// Writes the fraction of molecules fully covered by the top N fragments, for N in steps of step
+func writeCoverageCurve(outPath string, coverage []moleculeCoverage, vals []int, step int, isSingle bool) {
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create coverage file: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	ranks := make([]int, len(coverage))
+	for i, thisCoverage := range coverage {
+		if isSingle {
+			ranks[i] = thisCoverage.singleRank
+		} else {
+			ranks[i] = thisCoverage.doubleRank
+		}
+	}
+	sort.Ints(ranks)
+
+	if step < 1 {
+		step = 1
+	}
+	_, _ = outFile.WriteString("# N\tmin_frequency\tmolecules_covered\tfraction_covered\n")
+	covered := 0
+	for n := 0; n <= len(vals); n++ {
+		for covered < len(ranks) && ranks[covered] <= n {
+			covered++
+		}
+		if n%step == 0 || n == len(vals) {
+			minFreq := 0
+			if n > 0 {
+				minFreq = vals[n-1]
+			}
+			fraction := 0.0
+			if len(ranks) > 0 {
+				fraction = float64(covered) / float64(len(ranks))
+			}
+			_, _ = outFile.WriteString(strconv.Itoa(n) + "\t" + strconv.Itoa(minFreq) + "\t" + strconv.Itoa(covered) +
+				"\t" + fmt.Sprintf("%.4f", fraction) + "\n")
+		}
+	}
+}
+
+func rankToString(rank int) string {
+	if rank == math.MaxInt32 {
+		return "never"
+	}
+	return strconv.Itoa(rank)
+}
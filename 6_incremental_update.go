@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Brings an existing run directory up to date with a new LIPID MAPS release. Only molecules that are new or whose
+// structure changed are converted and fragmented; fragment counts in the top_*_fragments files are updated in place
+// and changes in support of library fragments are written to library_support_changes.txt. The manifest is only
+// rewritten once the frequency tables are, so an interrupted update is redone in full by the next run.
+// The unique_*_fragments info files are not updated by this mode, rerun procFreqs if they are needed.
+func incrementalUpdate(filePath string, dir string, moleculesDir string, singleFragmentsDir string, doubleFragmentsDir string, dimersDir string, libraryDir string) {
+
+	manifestPath := filepath2.Join(dir, "molecules_manifest.txt")
+
+	fmt.Println("Comparing database against previous release...")
+	changed, removed, manifest := updateLipidMaps(filePath, moleculesDir, manifestPath)
+	fmt.Println(strconv.Itoa(len(changed)) + " new or changed molecules, " + strconv.Itoa(len(removed)) + " removed molecules.")
+
+	affected := make(map[string]bool)
+	for _, molID := range changed {
+		affected[molID] = true
+	}
+	for _, molID := range removed {
+		affected[molID] = true
+	}
+
+	// take the old fragments of affected molecules out of the counts
+	singleDelta := make(map[string]int)
+	doubleDelta := make(map[string]int)
+	removeMoleculeFragments(singleFragmentsDir, affected, singleDelta)
+	removeMoleculeFragments(doubleFragmentsDir, affected, doubleDelta)
+	removeMoleculeFragments(dimersDir, affected, nil)
+
+	fmt.Println("Converting and fragmenting new or changed molecules...")
+	var smiPaths []string
+	for _, molID := range changed {
+		smiPaths = append(smiPaths, filepath2.Join(moleculesDir, molID+".smi"))
+	}
+	obabelConvertFiles(smiPaths, ".txyz", "add", false)
+
+	var molPaths []string
+	for _, molID := range changed {
+		molPath := filepath2.Join(moleculesDir, molID+".txyz")
+		if molExists, _ := exists(molPath); !molExists {
+			fmt.Println("Warning: no TXYZ file was produced for molecule " + molID)
+			// left out of the manifest so the next update tries it again
+			delete(manifest, molID)
+			continue
+		}
+		molPaths = append(molPaths, molPath)
+	}
+	err := runWorkerPool(pipelineContext, "fragmenting molecules", len(molPaths), func(i int) {
+		fragmentMoleculeShellFunc(molPaths[i], singleFragmentsDir, doubleFragmentsDir, dimersDir)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// convert the new fragments to canonical SMILES the same way as xyz2smi and add them to the counts
+	for _, section := range []struct {
+		fragmentsDir string
+		delta map[string]int
+	}{{singleFragmentsDir, singleDelta}, {doubleFragmentsDir, doubleDelta}} {
+		if fragmentDB.holds(section.fragmentsDir) {
+			canonicalizeStoredFragments(section.fragmentsDir)
+			for fragName, smiles := range fragmentDB.getSMILES(section.fragmentsDir) {
+				if affected[fragmentNameToLipidName(fragName)] {
+					section.delta[smiles]++
+				}
+			}
+			continue
+		}
+		fragPaths := getMoleculeFragmentFiles(section.fragmentsDir, affected, ".txyz")
+		obabelConvertFiles(fragPaths, ".sdf", "remove", false)
+		obabelConvertFiles(replaceExtensions(fragPaths, ".sdf"), ".can", "no", false)
+		addFragmentCounts(replaceExtensions(fragPaths, ".can"), section.delta)
+	}
+
+	fmt.Println("Updating fragment frequency tables...")
+	singleOld, singleNew := updateTopFrags(dir, "single", singleFragmentsDir, singleDelta, affected)
+	doubleOld, doubleNew := updateTopFrags(dir, "double", doubleFragmentsDir, doubleDelta, affected)
+	writeManifest(manifestPath, manifest)
+	if fragmentDB != nil {
+		fragmentDB.setMolecules(manifest)
+	}
+
+	writeLibrarySupportChanges(filepath2.Join(dir, "library_support_changes.txt"), libraryDir, singleOld, singleNew, doubleOld, doubleNew)
+}
+
+// Hashes of a molecule in the manifest. textHash is of the SMILES as given in the database and structureHash of its
+// canonical SMILES, which only has to be recomputed when the text changes
+type manifestEntry struct {
+	structureHash string
+	textHash string
+}
+
+func hashSMILES(smiles string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(smiles)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Hash of a molecule's structure, from the canonical SMILES of a SMI file, so that SMILES written differently for
+// the same structure in a new release do not count as changes
+func getStructureHash(smiPath string) (string, error) {
+	smiles, err := activeConverter.canonicalSMILES(smiPath)
+	if err != nil {
+		return "", err
+	}
+	return hashSMILES(smiles), nil
+}
+
+// Like readLipidMaps, but only writes SMI files for molecules whose LM_ID is new or whose SMILES changed, and
+// deletes files of molecules no longer in the database. Of the molecules with changed SMILES, only those whose
+// structure hash changed are returned as changed, together with the removed IDs and the manifest of this release.
+// The manifest is not written, see incrementalUpdate
+func updateLipidMaps(filePath string, moleculesDir string, manifestPath string) ([]string, []string, map[string]manifestEntry) {
+
+	_ = os.MkdirAll(moleculesDir, 0755)
+
+	oldManifest := loadManifest(manifestPath)
+	newManifest := make(map[string]manifestEntry)
+	var candidates []string
+	inDatabase := make(map[string]bool)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		fmt.Println("Failed to open file: " + filePath)
+		log.Fatal(err)
+	}
+	defer file.Close()
+	// Initialize scanner
+	thisScanner := bufio.NewScanner(file)
+
+	var molID string
+
+	for thisScanner.Scan() {
+		line := thisScanner.Text()
+		if strings.Contains(line, "<LM_ID>") {
+			thisScanner.Scan()
+			molID = thisScanner.Text()
+		} else if strings.Contains(line, "<SMILES>") {
+			thisScanner.Scan()
+			molSMILES := thisScanner.Text()
+			inDatabase[molID] = true
+			textHash := hashSMILES(molSMILES)
+			if oldEntry, ok := oldManifest[molID]; ok && oldEntry.textHash == textHash {
+				newManifest[molID] = oldEntry
+				continue
+			}
+			newManifest[molID] = manifestEntry{textHash: textHash}
+			candidates = append(candidates, molID)
+			outPath := filepath2.Join(moleculesDir, molID+".smi")
+			err = ioutil.WriteFile(outPath, []byte(molSMILES+"\n"), 0644)
+			if err != nil {
+				fmt.Println("Failed to create file: " + outPath)
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// canonicalize the molecules whose SMILES text changed
+	structureHashes := make([]string, len(candidates))
+	err = runWorkerPool(pipelineContext, "hashing changed structures", len(candidates), func(i int) {
+		hash, err := getStructureHash(filepath2.Join(moleculesDir, candidates[i]+".smi"))
+		if err != nil {
+			fmt.Println("Warning: could not canonicalize " + candidates[i] + ", comparing its SMILES text: " + err.Error())
+			hash = newManifest[candidates[i]].textHash
+		}
+		structureHashes[i] = hash
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	var changed []string
+	for i, molID := range candidates {
+		entry := newManifest[molID]
+		entry.structureHash = structureHashes[i]
+		newManifest[molID] = entry
+		if oldEntry, ok := oldManifest[molID]; !ok || oldEntry.structureHash != entry.structureHash {
+			changed = append(changed, molID)
+		}
+	}
+
+	var removed []string
+	for molID := range oldManifest {
+		if !inDatabase[molID] {
+			removed = append(removed, molID)
+			_ = os.Remove(filepath2.Join(moleculesDir, molID+".smi"))
+			_ = os.Remove(filepath2.Join(moleculesDir, molID+".txyz"))
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(removed)
+
+	return changed, removed, newManifest
+}
+
+// Reads "LM_ID structureHash textHash" lines. A missing manifest means every molecule is treated as new
+func loadManifest(manifestPath string) map[string]manifestEntry {
+	manifest := make(map[string]manifestEntry)
+	manifestExists, _ := exists(manifestPath)
+	if !manifestExists {
+		return manifest
+	}
+
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		fmt.Println("Failed to open manifest file: " + manifestPath)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) > 2 {
+			manifest[tokens[0]] = manifestEntry{structureHash: tokens[1], textHash: tokens[2]}
+		}
+	}
+	return manifest
+}
+
+func writeManifest(manifestPath string, manifest map[string]manifestEntry) {
+	var molIDs []string
+	for molID := range manifest {
+		molIDs = append(molIDs, molID)
+	}
+	sort.Strings(molIDs)
+
+	// replace the old manifest in one step so an interruption never leaves a partial one
+	var builder strings.Builder
+	for _, molID := range molIDs {
+		builder.WriteString(molID + "\t" + manifest[molID].structureHash + "\t" + manifest[molID].textHash + "\n")
+	}
+	tmpPath := manifestPath + ".tmp"
+	err := ioutil.WriteFile(tmpPath, []byte(builder.String()), 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, manifestPath)
+	}
+	if err != nil {
+		fmt.Println("Failed to write manifest file: " + manifestPath)
+		log.Fatal(err)
+	}
+}
+
+// Deletes every fragment in a fragment directory, or in fragmentDB if it holds the directory, that belongs to one of
+// the given molecules. If delta is not nil, the SMILES of each deleted fragment is subtracted from it
+func removeMoleculeFragments(fragmentsDir string, molecules map[string]bool, delta map[string]int) {
+	if fragmentDB.holds(fragmentsDir) {
+		for _, smiles := range fragmentDB.removeMolecules(fragmentsDir, molecules) {
+			if delta != nil {
+				delta[smiles]--
+			}
+		}
+		return
+	}
+	dirExists, _ := exists(fragmentsDir)
+	if !dirExists {
+		return
+	}
+	fileInfo, err := ioutil.ReadDir(fragmentsDir)
+	if err != nil {
+		fmt.Println("failed to read directory: " + fragmentsDir)
+		log.Fatal(err)
+	}
+	for i := 0; i < len(fileInfo); i++ {
+		fileName := fileInfo[i].Name()
+		if !molecules[fragmentNameToLipidName(strings.Split(fileName, ".")[0])] {
+			continue
+		}
+		thisPath := filepath2.Join(fragmentsDir, fileName)
+		if delta != nil && filepath2.Ext(fileName) == ".can" {
+			delta[makeSMILESUnique(getSMIString(thisPath))]--
+		}
+		_ = os.Remove(thisPath)
+	}
+}
+
+// Returns the paths of all files with extension ext in a fragment directory that belong to the given molecules
+func getMoleculeFragmentFiles(fragmentsDir string, molecules map[string]bool, ext string) []string {
+	var paths []string
+	dirExists, _ := exists(fragmentsDir)
+	if !dirExists {
+		return paths
+	}
+	fileInfo, err := ioutil.ReadDir(fragmentsDir)
+	if err != nil {
+		fmt.Println("failed to read directory: " + fragmentsDir)
+		log.Fatal(err)
+	}
+	for i := 0; i < len(fileInfo); i++ {
+		fileName := fileInfo[i].Name()
+		if filepath2.Ext(fileName) == ext && molecules[fragmentNameToLipidName(strings.Split(fileName, ".")[0])] {
+			paths = append(paths, filepath2.Join(fragmentsDir, fileName))
+		}
+	}
+	return paths
+}
+
+func replaceExtensions(paths []string, ext string) []string {
+	newPaths := make([]string, len(paths))
+	for i, path := range paths {
+		newPaths[i] = strings.TrimSuffix(path, filepath2.Ext(path)) + ext
+	}
+	return newPaths
+}
+
+func addFragmentCounts(canPaths []string, delta map[string]int) {
+	for _, canPath := range canPaths {
+		if canExists, _ := exists(canPath); canExists {
+			delta[makeSMILESUnique(getSMIString(canPath))]++
+		}
+	}
+}
+
+// Applies count changes to top_<kind>_fragments.txt and its _HC counterpart, re-ranks and rewrites both. Instances
+// cut from the affected molecules are dropped from the listed locations, as their files are gone or were rewritten.
+// Returns the counts before and after the update
+func updateTopFrags(dir string, kind string, fragmentsDir string, delta map[string]int, affected map[string]bool) (map[string]int, map[string]int) {
+	outPath := filepath2.Join(dir, "top_"+kind+"_fragments.txt")
+	outPathHC := filepath2.Join(dir, "top_"+kind+"_fragments_HC.txt")
+
+	oldCounts := make(map[string]int)
+	newCounts := make(map[string]int)
+	keyToLocns := make(map[string][]string)
+	isHC := make(map[string]bool)
+
+	for _, thisPath := range []string{outPath, outPathHC} {
+		if pathExists, _ := exists(thisPath); !pathExists {
+			continue
+		}
+		keys, vals, paths := loadRankedFragments(thisPath)
+		alternatives := loadAlternativeInstances(thisPath)
+		for i, key := range keys {
+			oldCounts[key] = vals[i]
+			newCounts[key] = vals[i]
+			for _, locn := range append([]string{paths[i]}, alternatives[key]...) {
+				if !affected[fragmentNameToLipidName(strings.Split(filepath2.Base(locn), ".")[0])] {
+					keyToLocns[key] = append(keyToLocns[key], locn)
+				}
+			}
+		}
+	}
+
+	var missingLocns []string
+	for key, change := range delta {
+		newCounts[key] += change
+		if newCounts[key] <= 0 {
+			delete(newCounts, key)
+			continue
+		}
+		isHC[key] = isSMILESHydrocarbon(key)
+		// every listed instance of this key may have come from affected molecules
+		if len(keyToLocns[key]) == 0 {
+			missingLocns = append(missingLocns, key)
+		}
+	}
+	for key := range newCounts {
+		isHC[key] = isSMILESHydrocarbon(key)
+	}
+	if len(missingLocns) > 0 {
+		findFragmentLocations(fragmentsDir, missingLocns, keyToLocns)
+	}
+
+	keys := make([]string, 0, len(newCounts))
+	for key := range newCounts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if newCounts[keys[i]] != newCounts[keys[j]] {
+			return newCounts[keys[i]] > newCounts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	vals := make([]int, len(keys))
+	for i, key := range keys {
+		vals[i] = newCounts[key]
+	}
+
+	writeTopFrags(outPath, outPathHC, keys, vals, keyToLocns, isHC)
+	return oldCounts, newCounts
+}
+
+// Finds a TXYZ example of each given fragment key among the fragments of a fragment directory
+func findFragmentLocations(fragmentsDir string, keys []string, keyToLocns map[string][]string) {
+	wanted := make(map[string]bool)
+	for _, key := range keys {
+		wanted[key] = true
+		keyToLocns[key] = nil
+	}
+	fragNameToSMILES := getFragmentSMILES(fragmentsDir)
+	fragNames := make([]string, 0, len(fragNameToSMILES))
+	for fragName := range fragNameToSMILES {
+		fragNames = append(fragNames, fragName)
+	}
+	sort.Strings(fragNames)
+	for _, fragName := range fragNames {
+		key := fragNameToSMILES[fragName]
+		if wanted[key] {
+			keyToLocns[key] = []string{filepath2.Join(fragmentsDir, fragName+".txyz")}
+			delete(wanted, key)
+		}
+	}
+}
+
+// Reports each fragment of the current library whose count changed in this update
+func writeLibrarySupportChanges(outPath string, libraryDir string, singleOld map[string]int, singleNew map[string]int, doubleOld map[string]int, doubleNew map[string]int) {
+	singleLibrary, doubleLibrary := loadFragmentDatabase(libraryDir)
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create library support file: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	_, _ = outFile.WriteString("# kind\tsmiles\told_count\tnew_count\tchange\n")
+	numChanged := 0
+	sections := []struct {
+		kind string
+		library map[string]libraryEntry
+		oldCounts map[string]int
+		newCounts map[string]int
+	}{
+		{"single", singleLibrary, singleOld, singleNew},
+		{"double", doubleLibrary, doubleOld, doubleNew},
+	}
+	for _, section := range sections {
+		var keys []string
+		for key := range section.library {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			change := section.newCounts[key] - section.oldCounts[key]
+			if change == 0 {
+				continue
+			}
+			numChanged++
+			_, _ = outFile.WriteString(section.kind + "\t" + key + "\t" + strconv.Itoa(section.oldCounts[key]) + "\t" +
+				strconv.Itoa(section.newCounts[key]) + "\t" + fmt.Sprintf("%+d", change) + "\n")
+		}
+	}
+	fmt.Println(strconv.Itoa(numChanged) + " library fragments gained or lost support, see " + outPath)
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Embedded fragment database. When it is open, fragment occurrences of the directories it holds are stored in it
+// instead of as a .txyz and a .can file each: writeFragment puts them in, and loadLipid, getCapAtoms, copyFile and
+// getFragmentSMILES read them back under the paths their files would have had, so top fragment lists and .info files
+// keep working. Buckets, named after the base name of each fragment directory (single_fragments, ...):
+//
+//	<dir>/txyz     fragment name -> TXYZ as written by writeFragment
+//	<dir>/smiles   fragment name -> unique canonical SMILES
+//	<dir>/index    SMILES + "\x00" + fragment name -> nothing, the occurrences of each fragment
+//
+// and for the whole run:
+//
+//	molecules      LM_ID -> structure hash from the incremental update manifest
+//	library        "<single|double> SMILES" -> library TXYZ path
+type fragmentStore struct {
+	path string
+	db *bolt.DB
+	// fragment directories whose occurrences are kept in the database
+	dirs map[string]bool
+}
+
+// Database used by the fragment stages, nil to keep fragments as files. main() opens it if useFragmentDatabase
+var fragmentDB *fragmentStore
+
+// Directory kinds of the query commands and the fragment directories they are stored under
+var fragmentStoreKinds = map[string]string{"single": "single_fragments", "double": "double_fragments", "dimer": "dimers"}
+
+// Opens or creates the database at path, holding the occurrences of the given fragment directories
+func openFragmentStore(path string, fragmentDirs ...string) *fragmentStore {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		fmt.Println("Failed to open fragment database: " + path + " (is another run using it?)")
+		log.Fatal(err)
+	}
+	store := &fragmentStore{path: path, db: db, dirs: make(map[string]bool)}
+	for _, fragmentsDir := range fragmentDirs {
+		store.dirs[filepath2.Clean(fragmentsDir)] = true
+	}
+	return store
+}
+
+func (s *fragmentStore) close() {
+	err := s.db.Close()
+	if err != nil {
+		fmt.Println("Failed to close fragment database: " + s.path)
+		log.Fatal(err)
+	}
+}
+
+// Whether the occurrences of a fragment directory are kept in the database
+func (s *fragmentStore) holds(fragmentsDir string) bool {
+	return s != nil && s.dirs[filepath2.Clean(fragmentsDir)]
+}
+
+func getStoreBucket(fragmentsDir string, table string) []byte {
+	return []byte(filepath2.Base(fragmentsDir) + "/" + table)
+}
+
+func getIndexKey(smiles string, fragName string) []byte {
+	return []byte(smiles + "\x00" + fragName)
+}
+
+// Runs fn in a write transaction, batched with those of other workers
+func (s *fragmentStore) update(fn func(tx *bolt.Tx) error) {
+	err := s.db.Batch(fn)
+	if err != nil {
+		fmt.Println("Failed to write to fragment database: " + s.path)
+		log.Fatal(err)
+	}
+}
+
+func (s *fragmentStore) view(fn func(tx *bolt.Tx) error) {
+	err := s.db.View(fn)
+	if err != nil {
+		fmt.Println("Failed to read fragment database: " + s.path)
+		log.Fatal(err)
+	}
+}
+
+func putInBucket(tx *bolt.Tx, bucketName []byte, key []byte, value []byte) error {
+	bucket, err := tx.CreateBucketIfNotExists(bucketName)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, value)
+}
+
+// Stores the TXYZ of a fragment occurrence
+func (s *fragmentStore) putFragment(fragmentsDir string, fragName string, txyz string) {
+	s.update(func(tx *bolt.Tx) error {
+		return putInBucket(tx, getStoreBucket(fragmentsDir, "txyz"), []byte(fragName), []byte(txyz))
+	})
+}
+
+// Stores the unique canonical SMILES of a fragment occurrence
+func (s *fragmentStore) setFragmentSMILES(fragmentsDir string, fragName string, smiles string) {
+	s.update(func(tx *bolt.Tx) error {
+		err := putInBucket(tx, getStoreBucket(fragmentsDir, "smiles"), []byte(fragName), []byte(smiles))
+		if err != nil {
+			return err
+		}
+		return putInBucket(tx, getStoreBucket(fragmentsDir, "index"), getIndexKey(smiles, fragName), []byte{})
+	})
+}
+
+// Returns the stored contents of the .txyz or .can file a fragment occurrence would have been written to
+func (s *fragmentStore) getFile(path string) ([]byte, bool) {
+	if !s.holds(filepath2.Dir(path)) {
+		return nil, false
+	}
+	fragName := strings.Split(filepath2.Base(path), ".")[0]
+	table := "txyz"
+	if filepath2.Ext(path) == ".can" {
+		table = "smiles"
+	} else if filepath2.Ext(path) != ".txyz" {
+		return nil, false
+	}
+
+	var data []byte
+	s.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(getStoreBucket(filepath2.Dir(path), table))
+		if bucket != nil {
+			if value := bucket.Get([]byte(fragName)); value != nil {
+				data = append([]byte{}, value...)
+			}
+		}
+		return nil
+	})
+	if data == nil {
+		return nil, false
+	}
+	if table == "smiles" {
+		data = []byte(string(data) + "\t" + fragName + "\n")
+	}
+	return data, true
+}
+
+// Returns the names of all stored occurrences of a fragment directory, sorted
+func (s *fragmentStore) listFragments(fragmentsDir string) []string {
+	var fragNames []string
+	s.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(getStoreBucket(fragmentsDir, "txyz"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			fragNames = append(fragNames, string(key))
+			return nil
+		})
+	})
+	return fragNames
+}
+
+// Returns fragment name -> unique SMILES of the canonicalized occurrences of a fragment directory
+func (s *fragmentStore) getSMILES(fragmentsDir string) map[string]string {
+	fragSMILES := make(map[string]string)
+	s.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(getStoreBucket(fragmentsDir, "smiles"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			fragSMILES[string(key)] = string(value)
+			return nil
+		})
+	})
+	return fragSMILES
+}
+
+// Deletes every occurrence of a fragment directory
+func (s *fragmentStore) clearFragments(fragmentsDir string) {
+	s.update(func(tx *bolt.Tx) error {
+		for _, table := range []string{"txyz", "smiles", "index"} {
+			err := tx.DeleteBucket(getStoreBucket(fragmentsDir, table))
+			if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Deletes the occurrences of a fragment directory cut from the given molecules. Returns the SMILES of the deleted
+// occurrences that had one
+func (s *fragmentStore) removeMolecules(fragmentsDir string, molecules map[string]bool) []string {
+	var removedSMILES []string
+	s.update(func(tx *bolt.Tx) error {
+		removedSMILES = nil
+		txyzBucket := tx.Bucket(getStoreBucket(fragmentsDir, "txyz"))
+		if txyzBucket == nil {
+			return nil
+		}
+		smilesBucket := tx.Bucket(getStoreBucket(fragmentsDir, "smiles"))
+		indexBucket := tx.Bucket(getStoreBucket(fragmentsDir, "index"))
+		var fragNames []string
+		err := txyzBucket.ForEach(func(key []byte, value []byte) error {
+			if molecules[fragmentNameToLipidName(string(key))] {
+				fragNames = append(fragNames, string(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, fragName := range fragNames {
+			if err := txyzBucket.Delete([]byte(fragName)); err != nil {
+				return err
+			}
+			if smilesBucket == nil {
+				continue
+			}
+			if smiles := smilesBucket.Get([]byte(fragName)); smiles != nil {
+				removedSMILES = append(removedSMILES, string(smiles))
+				if err := indexBucket.Delete(getIndexKey(string(smiles), fragName)); err != nil {
+					return err
+				}
+				if err := smilesBucket.Delete([]byte(fragName)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return removedSMILES
+}
+
+// Records the structure hash of every molecule of a manifest, replacing the molecules stored before
+func (s *fragmentStore) setMolecules(manifest map[string]manifestEntry) {
+	s.update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte("molecules"))
+		if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		for molID, entry := range manifest {
+			if err := putInBucket(tx, []byte("molecules"), []byte(molID), []byte(entry.structureHash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Records which fragments are in the library catalogs of libraryDir, replacing the membership stored before
+func (s *fragmentStore) setLibrary(libraryDir string) {
+	singleLibrary, doubleLibrary := loadFragmentDatabase(libraryDir)
+	s.update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte("library"))
+		if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		for kind, library := range map[string]map[string]libraryEntry{"single": singleLibrary, "double": doubleLibrary} {
+			for smiles, entry := range library {
+				if err := putInBucket(tx, []byte("library"), []byte(kind+" "+smiles), []byte(entry.path)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Opens a file, or the stored copy of a fragment occurrence if its directory is kept in fragmentDB
+func openFragmentFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err == nil {
+		return file, nil
+	}
+	if data, ok := fragmentDB.getFile(path); ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil, err
+}
+
+// Returns fragment name -> unique SMILES of the occurrences in a fragment directory, from the database if it holds
+// the directory and from the .can files otherwise
+func getFragmentSMILES(fragmentsDir string) map[string]string {
+	if fragmentDB.holds(fragmentsDir) {
+		return fragmentDB.getSMILES(fragmentsDir)
+	}
+	fragSMILES := make(map[string]string)
+	dirExists, _ := exists(fragmentsDir)
+	if !dirExists {
+		fmt.Println("Warning: fragment directory not found: " + fragmentsDir)
+		return fragSMILES
+	}
+	fileInfo, err := ioutil.ReadDir(fragmentsDir)
+	if err != nil {
+		fmt.Println("failed to read directory: " + fragmentsDir)
+		log.Fatal(err)
+	}
+	for i := 0; i < len(fileInfo); i++ {
+		fileName := fileInfo[i].Name()
+		if filepath2.Ext(fileName) == ".can" {
+			fragSMILES[strings.Split(fileName, ".")[0]] = makeSMILESUnique(getSMIString(filepath2.Join(fragmentsDir, fileName)))
+		}
+	}
+	return fragSMILES
+}
+
+// The database counterpart of converting a fragment directory to SDF without hydrogens and then to CAN: every stored
+// occurrence without a SMILES yet is written to a local temporary directory, converted there and its unique SMILES
+// stored
+func canonicalizeStoredFragments(fragmentsDir string) {
+	fragSMILES := fragmentDB.getSMILES(fragmentsDir)
+	var fragNames []string
+	for _, fragName := range fragmentDB.listFragments(fragmentsDir) {
+		if _, ok := fragSMILES[fragName]; !ok {
+			fragNames = append(fragNames, fragName)
+		}
+	}
+
+	tmpDir, err := ioutil.TempDir("", "fragments")
+	if err != nil {
+		fmt.Println("Failed to create temporary directory for fragment conversion")
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = runWorkerPool(pipelineContext, activeConverter.name()+" -> stored .can", len(fragNames), func(i int) {
+		txyz, _ := fragmentDB.getFile(filepath2.Join(fragmentsDir, fragNames[i]+".txyz"))
+		basePath := filepath2.Join(tmpDir, fragNames[i])
+		err := ioutil.WriteFile(basePath+".txyz", txyz, 0644)
+		if err != nil {
+			fmt.Println("Failed to write temporary fragment file: " + basePath + ".txyz")
+			log.Fatal(err)
+		}
+		convertFile(basePath+".txyz", basePath+".sdf", "remove", false)
+		convertFile(basePath+".sdf", basePath+".can", "no", false)
+		fragmentDB.setFragmentSMILES(fragmentsDir, fragNames[i], makeSMILESUnique(getSMIString(basePath+".can")))
+		for _, ext := range []string{".txyz", ".sdf", ".can"} {
+			_ = os.Remove(basePath + ext)
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Moves the fragment occurrences of a file based run into the database, with the molecules of its manifest and the
+// library membership of its catalogs. The fragment files are left in place
+func importFragmentDirectories(dir string, fragmentDirs []string, libraryDir string) {
+	for _, fragmentsDir := range fragmentDirs {
+		dirExists, _ := exists(fragmentsDir)
+		if !dirExists {
+			fmt.Println("Warning: fragment directory not found: " + fragmentsDir)
+			continue
+		}
+		fragmentDB.clearFragments(fragmentsDir)
+		fileInfo, err := ioutil.ReadDir(fragmentsDir)
+		if err != nil {
+			fmt.Println("failed to read directory: " + fragmentsDir)
+			log.Fatal(err)
+		}
+		var txyzPaths []string
+		for i := 0; i < len(fileInfo); i++ {
+			if filepath2.Ext(fileInfo[i].Name()) == ".txyz" {
+				txyzPaths = append(txyzPaths, filepath2.Join(fragmentsDir, fileInfo[i].Name()))
+			}
+		}
+		err = runWorkerPool(pipelineContext, "importing "+filepath2.Base(fragmentsDir), len(txyzPaths), func(i int) {
+			fragName := strings.Split(filepath2.Base(txyzPaths[i]), ".")[0]
+			txyz, err := ioutil.ReadFile(txyzPaths[i])
+			if err != nil {
+				fmt.Println("Failed to read fragment file: " + txyzPaths[i])
+				log.Fatal(err)
+			}
+			fragmentDB.putFragment(fragmentsDir, fragName, string(txyz))
+			canPath := strings.TrimSuffix(txyzPaths[i], ".txyz") + ".can"
+			if canExists, _ := exists(canPath); canExists {
+				fragmentDB.setFragmentSMILES(fragmentsDir, fragName, makeSMILESUnique(getSMIString(canPath)))
+			}
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fragmentDB.setMolecules(loadManifest(filepath2.Join(dir, "molecules_manifest.txt")))
+	fragmentDB.setLibrary(libraryDir)
+	fmt.Println("Fragment directories imported into " + fragmentDB.path)
+}
+
+// A fragment of the database with its occurrences
+type storedFragment struct {
+	smiles string
+	fragNames []string
+	libraryPath string
+}
+
+// Returns the sorted IDs of all molecules containing a fragment of the given kind and SMILES
+func queryLipidsWithFragment(store *fragmentStore, kind string, smiles string) []string {
+	var lipids []string
+	prefix := getIndexKey(makeSMILESUnique(smiles), "")
+	seen := make(map[string]bool)
+	store.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(getStoreBucket(fragmentStoreKinds[kind], "index"))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			lipid := fragmentNameToLipidName(string(key[len(prefix):]))
+			if !seen[lipid] {
+				seen[lipid] = true
+				lipids = append(lipids, lipid)
+			}
+		}
+		return nil
+	})
+	sort.Strings(lipids)
+	return lipids
+}
+
+// Returns the fragment kind, name and SMILES ("" if not canonicalized yet) of all fragment occurrences of a molecule,
+// sorted by name
+func queryFragmentsOfLipid(store *fragmentStore, lipid string) [][3]string {
+	var occurrences [][3]string
+	var kinds []string
+	for kind := range fragmentStoreKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	store.view(func(tx *bolt.Tx) error {
+		for _, kind := range kinds {
+			txyzBucket := tx.Bucket(getStoreBucket(fragmentStoreKinds[kind], "txyz"))
+			smilesBucket := tx.Bucket(getStoreBucket(fragmentStoreKinds[kind], "smiles"))
+			if txyzBucket == nil {
+				continue
+			}
+			prefix := []byte(lipid + "_")
+			cursor := txyzBucket.Cursor()
+			for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+				if fragmentNameToLipidName(string(key)) != lipid {
+					continue
+				}
+				smiles := ""
+				if smilesBucket != nil {
+					smiles = string(smilesBucket.Get(key))
+				}
+				occurrences = append(occurrences, [3]string{kind, string(key), smiles})
+			}
+		}
+		return nil
+	})
+	sort.Slice(occurrences, func(i, j int) bool { return occurrences[i][1] < occurrences[j][1] })
+	return occurrences
+}
+
+// Returns fragments of a kind ranked by number of occurrences, in the same order as countFrags
+func queryTopFragments(store *fragmentStore, kind string, includeHydrocarbons bool) []*storedFragment {
+	var fragments []*storedFragment
+	store.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(getStoreBucket(fragmentStoreKinds[kind], "index"))
+		if bucket == nil {
+			return nil
+		}
+		libraryBucket := tx.Bucket([]byte("library"))
+		// index keys are sorted, so the occurrences of each fragment are consecutive
+		var fragment *storedFragment
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			separator := bytes.IndexByte(key, 0)
+			smiles := string(key[:separator])
+			if fragment == nil || fragment.smiles != smiles {
+				fragment = &storedFragment{smiles: smiles}
+				if libraryBucket != nil {
+					fragment.libraryPath = string(libraryBucket.Get([]byte(kind + " " + smiles)))
+				}
+				if includeHydrocarbons || !isSMILESHydrocarbon(smiles) {
+					fragments = append(fragments, fragment)
+				}
+			}
+			fragment.fragNames = append(fragment.fragNames, string(key[separator+1:]))
+			return nil
+		})
+	})
+	sort.SliceStable(fragments, func(i, j int) bool {
+		return len(fragments[i].fragNames) > len(fragments[j].fragNames)
+	})
+	return fragments
+}
+
+// Writes the stored TXYZ of one fragment occurrence back to disk
+func exportOccurrence(store *fragmentStore, fragName string, outPath string) {
+	var txyz []byte
+	store.view(func(tx *bolt.Tx) error {
+		for _, fragmentsDir := range fragmentStoreKinds {
+			if bucket := tx.Bucket(getStoreBucket(fragmentsDir, "txyz")); bucket != nil && bucket.Get([]byte(fragName)) != nil {
+				txyz = append([]byte{}, bucket.Get([]byte(fragName))...)
+			}
+		}
+		return nil
+	})
+	if txyz == nil {
+		log.Fatal("Fragment " + fragName + " was not found in the database")
+	}
+	err := ioutil.WriteFile(outPath, txyz, 0644)
+	if err != nil {
+		fmt.Println("Failed to write fragment file: " + outPath)
+		log.Fatal(err)
+	}
+}
+
+// Runs one query against the database and prints the result. Queries are
+//   contains <single|double> <SMILES>   which lipids contain a fragment
+//   fragments <lipid>                   all fragments of a lipid
+//   top <single|double> <N>             the N most common non-hydrocarbon fragments and library membership
+//   export <fragment name> <path>       write a stored fragment TXYZ to disk
+func runDatabaseQuery(store *fragmentStore, query string) {
+	tokens := strings.Fields(query)
+	if len(tokens) == 0 {
+		log.Fatal("Empty database query")
+	}
+	if (tokens[0] == "contains" || tokens[0] == "top") && len(tokens) == 3 {
+		if _, ok := fragmentStoreKinds[tokens[1]]; !ok {
+			log.Fatal("Unknown fragment kind in query: " + query)
+		}
+	}
+
+	switch {
+	case tokens[0] == "contains" && len(tokens) == 3:
+		lipids := queryLipidsWithFragment(store, tokens[1], tokens[2])
+		fmt.Println(strconv.Itoa(len(lipids)) + " lipids contain " + tokens[1] + " fragment " + tokens[2])
+		for _, lipid := range lipids {
+			fmt.Println(lipid)
+		}
+	case tokens[0] == "fragments" && len(tokens) == 2:
+		for _, occurrence := range queryFragmentsOfLipid(store, tokens[1]) {
+			fmt.Println(occurrence[1] + "\t" + occurrence[0] + "\t" + occurrence[2])
+		}
+	case tokens[0] == "top" && len(tokens) == 3:
+		n, err := strconv.Atoi(tokens[2])
+		if err != nil {
+			log.Fatal("Could not parse number of fragments in query: " + query)
+		}
+		fragments := queryTopFragments(store, tokens[1], false)
+		for i := 0; i < len(fragments) && i < n; i++ {
+			line := fragments[i].smiles + "\t" + strconv.Itoa(len(fragments[i].fragNames))
+			if fragments[i].libraryPath != "" {
+				line += "\tlibrary: " + fragments[i].libraryPath
+			}
+			fmt.Println(line)
+		}
+	case tokens[0] == "export" && len(tokens) == 3:
+		exportOccurrence(store, tokens[1], tokens[2])
+	default:
+		log.Fatal("Unknown database query: " + query)
+	}
+}
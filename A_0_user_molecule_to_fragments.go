@@ -2,158 +2,312 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	filepath2 "path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
 
-func conversionManager(inFilePath string, outDir string) {
+// A single entry of a fragment library catalog (fragment_library/single_fragments.txt etc.)
+type libraryEntry struct {
+	smiles string
+	count int
+	path string
+}
+
+// Result of matching one fragment of a user molecule against the fragment library
+type fragmentMatch struct {
+	Fragment string `json:"fragment"`
+	SMILES string `json:"smiles"`
+	Hydrocarbon bool `json:"hydrocarbon"`
+	Matched bool `json:"matched"`
+	LibraryPath string `json:"library_path,omitempty"`
+	Frequency int `json:"frequency"`
+}
+
+// Full report for one user molecule
+type matchReport struct {
+	Lipid string `json:"lipid"`
+	Library string `json:"library"`
+	SingleFragments []fragmentMatch `json:"single_fragments"`
+	DoubleFragments []fragmentMatch `json:"double_fragments"`
+	MissingSingle []string `json:"missing_single"`
+	MissingDouble []string `json:"missing_double"`
+}
 
-	lipidName, atoms := loadLipid(inFilePath)
+// Fragments a user supplied lipid (TXYZ, SDF or SMILES) and matches its fragments against a built fragment library
+func conversionManager(inFilePath string, libraryDir string, outDir string) {
+
+	_ = os.MkdirAll(outDir, 0755)
+
+	txyzPath := prepareUserMolecule(inFilePath, outDir)
+	lipidName, atoms := loadLipid(txyzPath)
 
 	singleFragmentsDir := filepath2.Join(outDir,"single_fragments")
 	doubleFragmentsDir := filepath2.Join(outDir,"double_fragments")
 	dimerFragmentsDir := filepath2.Join(outDir,"dimers")
 
+	// remove fragments left over from a previous run on this out dir
+	_ = os.RemoveAll(singleFragmentsDir)
+	_ = os.RemoveAll(doubleFragmentsDir)
+	_ = os.RemoveAll(dimerFragmentsDir)
+
 	fragmentMolecule(atoms, lipidName, singleFragmentsDir, doubleFragmentsDir, dimerFragmentsDir)
 
-	obabelConversion(singleFragmentsDir, ".txyz", ".can", "no", false, true)
-	obabelConversion(doubleFragmentsDir, ".txyz", ".can", "no", false, true)
-	// obabelConversion(dimerFragmentsDir, ".txyz", ".can", false, false)
+	// follow the same route to canonical SMILES as the library generation does
+	for _, fragDir := range []string{singleFragmentsDir, doubleFragmentsDir} {
+		if dirExists, _ := exists(fragDir); dirExists {
+			obabelConversion2(fragDir, ".txyz", ".sdf", "remove", false)
+			obabelConversion2(fragDir, ".sdf", ".can", "no", false)
+		}
+	}
 
-	fragDatabaseDir := "placeholder"
+	singleFragDatabase, doubleFragDatabase := loadFragmentDatabase(libraryDir)
 
-	singleFragDatabase, _ := loadFragmentDatabase(fragDatabaseDir)
-	// singleFragDatabase, doubleFragDatabase := loadFragmentDatabase(fragDatabaseDir)
+	var report matchReport
+	report.Lipid = lipidName
+	report.Library = libraryDir
+	report.SingleFragments = matchFragmentsToLibrary(singleFragmentsDir, singleFragDatabase)
+	report.DoubleFragments = matchFragmentsToLibrary(doubleFragmentsDir, doubleFragDatabase)
+	report.MissingSingle = getMissingFragments(report.SingleFragments)
+	report.MissingDouble = getMissingFragments(report.DoubleFragments)
 
-	// Read in all files in dir
-	fileInfo, err := ioutil.ReadDir(singleFragmentsDir)
-	if err != nil {
-		fmt.Println("failed to read directory: " + singleFragmentsDir)
-		log.Fatal(err)
+	writeMatchReportJSON(report, filepath2.Join(outDir, lipidName + ".json"))
+	writeMatchReportText(report, filepath2.Join(outDir, lipidName + ".out"))
+}
+
+// Converts an SDF or SMILES input into TXYZ so it can be fragmented, returns path to the TXYZ
+func prepareUserMolecule(inFilePath string, outDir string) string {
+	ext := strings.ToLower(filepath2.Ext(inFilePath))
+	if ext == ".txyz" {
+		return inFilePath
+	}
+
+	baseName := strings.Split(filepath2.Base(inFilePath), ".")[0]
+	txyzPath := filepath2.Join(outDir, baseName + ".txyz")
+
+	if ext == ".sdf" || ext == ".mol" {
+		// structure files already carry coordinates
+		convertFile(inFilePath, txyzPath, "add", false)
+	} else if ext == ".smi" || ext == ".smiles" || ext == ".can" {
+		convertFile(inFilePath, txyzPath, "add", true)
+	} else {
+		log.Fatal("Unsupported input file type " + ext + " for file: " + inFilePath + " (expected .txyz, .sdf, .mol or .smi)")
+	}
+
+	return txyzPath
+}
+
+// Matches every .can fragment in a directory against a fragment library, sorted by fragment name
+func matchFragmentsToLibrary(fragDir string, database map[string]libraryEntry) []fragmentMatch {
+	matches := []fragmentMatch{}
+
+	dirExists, _ := exists(fragDir)
+	if !dirExists {
+		return matches
 	}
 
-	// create out file
-	thisPath := filepath2.Join(outDir, lipidName + ".out")
-	// fmt.Println(thisPath)
-	thisFile, err := os.Create(thisPath)
+	fileInfo, err := ioutil.ReadDir(fragDir)
 	if err != nil {
-		fmt.Println("Failed to create new fragment file: " + thisPath)
+		fmt.Println("failed to read directory: " + fragDir)
 		log.Fatal(err)
 	}
-	_, _ = thisFile.WriteString("Lipid Fragmenter Output - " + lipidName + "\n")
-
 
 	for i := 0; i < len(fileInfo); i++ {
 		if filepath2.Ext(fileInfo[i].Name()) == ".can" {
 
-			canFilePath := filepath2.Join(singleFragmentsDir, fileInfo[i].Name())
+			canFilePath := filepath2.Join(fragDir, fileInfo[i].Name())
 
-			smiString := getSMIString(canFilePath)
+			smiString := makeSMILESUnique(getSMIString(canFilePath))
 
-			// record which fragment was matched in log file
-			if path, ok := singleFragDatabase[smiString]; ok {
-				_, _ = thisFile.WriteString(smiString + " " + path)
-			} else {
-				_, _ = thisFile.WriteString(smiString + " " + "No matching fragment found")
+			var match fragmentMatch
+			match.Fragment = strings.Split(fileInfo[i].Name(), ".")[0]
+			match.SMILES = smiString
+			match.Hydrocarbon = isSMILESHydrocarbon(smiString)
+			if entry, ok := database[smiString]; ok {
+				match.Matched = true
+				match.LibraryPath = entry.path
+				match.Frequency = entry.count
 			}
+			matches = append(matches, match)
 		}
 	}
+
+	return matches
 }
 
-func getAtomIDsToAtomTypesMap(atoms map[int]*atom, atomCodeDict map[string]int) map[int]int {
-	atomIDtoType := make(map[int]int)
-	wg := sync.WaitGroup{}
-	for atomID := range atoms {
-		wg.Add(1)
-		thisID := atomID
-		go func(wg *sync.WaitGroup) {
-			atomCode := getAtomCode(atoms, thisID)
-			atomType := atomCodeDict[atomCode]
-			atomIDtoType[thisID] = atomType
-			wg.Done()
-		}(&wg)
+// Returns the SMILES strings of all unmatched fragments, without duplicates
+func getMissingFragments(matches []fragmentMatch) []string {
+	missing := []string{}
+	seen := make(map[string]bool)
+	for _, match := range matches {
+		if !match.Matched && !seen[match.SMILES] {
+			seen[match.SMILES] = true
+			missing = append(missing, match.SMILES)
+		}
 	}
-	wg.Wait()
-	return atomIDtoType
-
+	return missing
 }
 
-func getAtomCode(atoms map[int]*atom, atomID int) string {
-
-	atomPathways := make([]string, len(atoms[atomID].bondedAtoms))
-
-	for i, bondedAtomID := range atoms[atomID].bondedAtoms {
-		bondedAtomElement := atoms[bondedAtomID].element
+func writeMatchReportJSON(report matchReport, outPath string) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Println("Failed to encode match report for lipid: " + report.Lipid)
+		log.Fatal(err)
+	}
+	err = ioutil.WriteFile(outPath, append(data, '\n'), 0644)
+	if err != nil {
+		fmt.Println("Failed to write match report file: " + outPath)
+		log.Fatal(err)
+	}
+}
 
-		secondTierBondedElements := make([]string, len(atoms[bondedAtomID].bondedAtoms))
-		for j, secondTierBondedAtomID := range atoms[bondedAtomID].bondedAtoms {
-			secondTierBondedElements[j] = atoms[secondTierBondedAtomID].element
+func writeMatchReportText(report matchReport, outPath string) {
+	thisFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create new match report file: " + outPath)
+		log.Fatal(err)
+	}
+	defer thisFile.Close()
+
+	_, _ = thisFile.WriteString("Lipid Fragmenter Output - " + report.Lipid + "\n")
+	_, _ = thisFile.WriteString("Fragment library: " + report.Library + "\n")
+
+	sections := []struct {
+		title string
+		matches []fragmentMatch
+		missing []string
+	}{
+		{"Single fragments", report.SingleFragments, report.MissingSingle},
+		{"Double fragments", report.DoubleFragments, report.MissingDouble},
+	}
+	for _, section := range sections {
+		matched := 0
+		for _, match := range section.matches {
+			if match.Matched {
+				matched++
+			}
 		}
-		secondTierBondedElements = qsort4(secondTierBondedElements)
+		_, _ = thisFile.WriteString("\n" + section.title + " (" + strconv.Itoa(matched) + " of " +
+			strconv.Itoa(len(section.matches)) + " matched)\n")
+		for _, match := range section.matches {
+			line := match.Fragment + "\t" + match.SMILES + "\t"
+			if match.Matched {
+				line += match.LibraryPath + "\tfrequency=" + strconv.Itoa(match.Frequency)
+			} else {
+				line += "No matching fragment found"
+				if match.Hydrocarbon {
+					line += " (hydrocarbon)"
+				}
+			}
+			_, _ = thisFile.WriteString(line + "\n")
+		}
+		if len(section.missing) > 0 {
+			_, _ = thisFile.WriteString("Missing:\n")
+			for _, smiString := range section.missing {
+				_, _ = thisFile.WriteString("\t" + smiString + "\n")
+			}
+		}
+	}
+}
 
-		atomPathways[i] = bondedAtomElement + "(" + strings.Join(secondTierBondedElements, "") + ")"
+// Result of looking up one atom in the atom code dictionary
+type atomTypeMatch struct {
+	atomType int
+	// radius of the code that matched, -1 if none did
+	radius int
+	matched bool
+}
 
+// Looks up the type of every atom. The sorted atom IDs are split into one contiguous chunk per worker and each
+// goroutine writes only its own part of a results slice, so there is no shared map write and the output does not
+// depend on scheduling. Plain goroutines rather than runWorkerPool, since processBilayers already runs this on
+// the pool
+func getAtomIDsToAtomTypesMap(atoms map[int]*atom, atomCodeDict map[string]int, settings atomCodeSettings) map[int]atomTypeMatch {
+	coder := newAtomCoder(atoms, settings)
+	atomIDs := make([]int, 0, len(atoms))
+	for atomID := range atoms {
+		atomIDs = append(atomIDs, atomID)
 	}
-	atomPathways = qsort4(atomPathways)
+	sort.Ints(atomIDs)
 
-	atomIdentifier := atoms[atomID].element + "[" + strings.Join(atomPathways, "") + "]"
+	matches := make([]atomTypeMatch, len(atomIDs))
+	numChunks := getNumWorkers()
+	chunkSize := (len(atomIDs) + numChunks - 1) / numChunks
+	wg := sync.WaitGroup{}
+	for start := 0; start < len(atomIDs); start += chunkSize {
+		end := min(start+chunkSize, len(atomIDs))
+		wg.Add(1)
+		go func(start int, end int) {
+			defer wg.Done()
+			for n := start; n < end; n++ {
+				atomType, radius, matched := coder.lookupType(atomIDs[n], atomCodeDict)
+				matches[n] = atomTypeMatch{atomType, radius, matched}
+			}
+		}(start, end)
+	}
+	wg.Wait()
 
-	return atomIdentifier
+	atomIDtoType := make(map[int]atomTypeMatch, len(atomIDs))
+	for n, atomID := range atomIDs {
+		atomIDtoType[atomID] = matches[n]
+	}
+	return atomIDtoType
 }
 
-func loadFragmentDatabase(dir string) (map[string]string, map[string]string) {
+// Loads the single and double fragment catalogs written by generateLibrary, keyed by SMILES
+func loadFragmentDatabase(libraryDir string) (map[string]libraryEntry, map[string]libraryEntry) {
 
-	singleFragmentsDir := filepath2.Join(dir,"single_fragments")
-	singleFragsMap := processDatabaseFolder(singleFragmentsDir)
-	doubleFragmentsDir := filepath2.Join(dir,"double_fragments")
-	doubleFragsMap := processDatabaseFolder(doubleFragmentsDir)
+	singleFragsMap := processDatabaseCatalog(filepath2.Join(libraryDir,"single_fragments.txt"))
+	doubleFragsMap := processDatabaseCatalog(filepath2.Join(libraryDir,"double_fragments.txt"))
 
 	return singleFragsMap, doubleFragsMap
 }
 
-func processDatabaseFolder(dir string) map[string]string {
-	fragDirFileInfo, err := ioutil.ReadDir(dir)
-	if err != nil {
-		fmt.Println("failed to read directory: " + dir)
-		log.Fatal(err)
-	}
-
-	smiles2filePath := make(map[string]string)
-
+// Reads one library catalog. Lines are "SMILES count path"; older catalogs without a count are accepted too
+func processDatabaseCatalog(catalogPath string) map[string]libraryEntry {
 
+	smiles2entry := make(map[string]libraryEntry)
 
-	fmt.Println("Identifying all non-alkane fragments...")
-
-	for i := 0; i < len(fragDirFileInfo); i++ {
-		fileName := fragDirFileInfo[i].Name()
-		if filepath2.Ext(fileName) == ".can" {
-
-			smiFilePath := filepath2.Join(dir, fileName)
+	catalogExists, _ := exists(catalogPath)
+	if !catalogExists {
+		fmt.Println("Warning: fragment library catalog not found: " + catalogPath)
+		return smiles2entry
+	}
 
-			file, err := os.Open(smiFilePath)
+	file, err := os.Open(catalogPath)
+	if err != nil {
+		fmt.Println("Failed to open catalog file: " + catalogPath)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	// Initialize scanner
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		var entry libraryEntry
+		if len(fields) > 2 {
+			entry.smiles = fields[0]
+			entry.count, err = strconv.Atoi(fields[1])
 			if err != nil {
-				fmt.Println("Failed to open molecule file: " + smiFilePath)
-				log.Fatal(err)
-			}
-			// Initialize scanner
-			scanner := bufio.NewScanner(file)
-			// ignore first line
-			scanner.Scan()
-			line := scanner.Text()
-			fields := strings.Fields(line)
-			if len(fields) > 1 {
-				smiString := fields[0]
-				filePath := fields[1]
-				smiles2filePath[smiString] = filePath
+				fmt.Println("Warning: could not parse frequency " + fields[1] + " in catalog: " + catalogPath)
 			}
-
+			entry.path = fields[2]
+		} else if len(fields) == 2 {
+			entry.smiles = fields[0]
+			entry.path = fields[1]
+		} else {
+			continue
 		}
+		smiles2entry[entry.smiles] = entry
 	}
 
-	return smiles2filePath
-}
\ No newline at end of file
+	return smiles2entry
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	filepath2 "path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// Builds a system of many copies of choline, dimethyl phosphate and neopentane with atom IDs running on from one
+// molecule to the next, as in a bilayer TXYZ. Atom types are the symmetry classes, offset per molecule kind
+func getTestMultiLipidSystem(copies int) (map[int]*atom, []map[int]*atom) {
+	builders := []func() map[int]*atom{getTestCholine, getTestDimethylPhosphate, getTestNeopentane}
+	var templates []map[int]*atom
+	for k, build := range builders {
+		template := build()
+		for atomID, class := range getSymmetryClasses(template, atomMatchOptions{}) {
+			template[atomID].atomType = 100*(k+1) + class
+		}
+		templates = append(templates, template)
+	}
+
+	system := make(map[int]*atom)
+	offset := 0
+	for n := 0; n < copies; n++ {
+		for k, build := range builders {
+			molecule := build()
+			for atomID, thisAtom := range molecule {
+				thisAtom.atomType = templates[k][atomID].atomType
+				thisAtom.parent = atomID + offset
+				for b := range thisAtom.bondedAtoms {
+					thisAtom.bondedAtoms[b] += offset
+				}
+				system[atomID+offset] = thisAtom
+			}
+			offset += len(molecule)
+		}
+	}
+	return system, templates
+}
+
+func TestAtomTypingIsChunkedAndDeterministic(t *testing.T) {
+	system, templates := getTestMultiLipidSystem(40)
+
+	// dictionary from one copy of every molecule
+	dir := t.TempDir()
+	for k, template := range templates {
+		path := filepath2.Join(dir, "mol"+string(rune('A'+k))+".txyz")
+		if err := writeTXYZ(template, path, "template"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generateAtomCodeDictFile(dir, dir, "dict.txt", legacyAtomCodeSettings, conflictResolution{policy: "deeper"})
+	dictionary, settings := getAtomCodeDictFromFile(filepath2.Join(dir, "dict.txt"))
+
+	// serial reference
+	coder := newAtomCoder(system, settings)
+	serial := make(map[int]atomTypeMatch)
+	for atomID := range system {
+		atomType, radius, matched := coder.lookupType(atomID, dictionary)
+		serial[atomID] = atomTypeMatch{atomType, radius, matched}
+	}
+
+	// enough workers for several chunks even on a single core machine
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(7))
+	first := getAtomIDsToAtomTypesMap(system, dictionary, settings)
+	if !reflect.DeepEqual(first, serial) {
+		t.Fatalf("chunked typing differs from the serial lookup")
+	}
+	for run := 0; run < 5; run++ {
+		if again := getAtomIDsToAtomTypesMap(system, dictionary, settings); !reflect.DeepEqual(again, first) {
+			t.Fatalf("typing changed between runs")
+		}
+	}
+	for atomID, match := range first {
+		if !match.matched || match.atomType != system[atomID].atomType {
+			t.Errorf("atom %d typed %v, want type %d", atomID, match, system[atomID].atomType)
+		}
+	}
+}
@@ -6,42 +6,154 @@ import (
 	"log"
 	"os"
 	filepath2 "path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 
-func generateAtomCodeDictFile(dir string, outFile string, outName string) {
+// Builds the atom code dictionary of the TXYZ template molecules in dir: one line per code with its atom type and
+// source molecules, after a header with the code settings, followed by unambiguous codes of smaller radii down to
+// the fallback radius. Codes whose atoms have different types are settled
+// as set by resolution and reported in <outName>_conflicts.txt; the run stops if any are left unresolved
+func generateAtomCodeDictFile(dir string, outFile string, outName string, settings atomCodeSettings, resolution conflictResolution) {
 	fileInfo, err := ioutil.ReadDir(dir)
 	if err != nil {
 		fmt.Println("failed to read directory: " + dir)
 		log.Fatal(err)
 	}
-	_ = os.MkdirAll(dir, 0755)
+
+	groups := make(map[string][]atomCodeRecord)
+	for i := 0; i < len(fileInfo); i++ {
+		if filepath2.Ext(fileInfo[i].Name()) == ".txyz" {
+			txyzFilePath := filepath2.Join(dir, fileInfo[i].Name())
+			molName, atoms := loadLipid(txyzFilePath)
+			classes := getSymmetryClasses(atoms, atomMatchOptions{})
+			symmetrizeAtomTypes(molName, atoms, classes)
+			checkSymmetryClasses(molName, atoms, classes, settings)
+			coder := newAtomCoder(atoms, settings)
+			for atomID, thisAtom := range atoms {
+				code := coder.code(atomID)
+				groups[code] = append(groups[code], atomCodeRecord{molName, atomID, thisAtom.atomType, coder})
+			}
+		}
+	}
+
+	dictionary := make(map[string]int)
+	sources := make(map[string][]string)
+	var conflicts []atomCodeConflict
+	resolveAtomCodes(groups, settings.radius, resolution, loadAtomCodeOverrides(resolution.overridePath), dictionary, sources, &conflicts)
+	addFallbackCodes(groups, settings, dictionary, sources)
+
+	_ = os.MkdirAll(outFile, 0755)
+	conflictPath := filepath2.Join(outFile, strings.TrimSuffix(outName, filepath2.Ext(outName))+"_conflicts.txt")
+	unresolved := writeAtomCodeConflicts(conflicts, conflictPath)
+	if len(conflicts) > 0 {
+		fmt.Println(strconv.Itoa(len(conflicts)) + " atom code conflicts found, " + strconv.Itoa(unresolved) +
+			" unresolved. See " + conflictPath)
+	}
+	if unresolved > 0 {
+		log.Fatal("Atom code dictionary not written: settle the remaining conflicts with another policy or an override file")
+	}
+
 	thisFile, err := os.Create(filepath2.Join(outFile, outName))
 	if err != nil {
 		fmt.Println("Failed to create new atom code file: " + outFile)
 		log.Fatal(err)
 	}
+	defer thisFile.Close()
+	_, _ = thisFile.WriteString(getAtomCodeHeader(settings) + "\n")
 
+	var codes []string
+	for code := range dictionary {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		_, _ = thisFile.WriteString(code + "\t" + strconv.Itoa(dictionary[code]) + "\t" + strings.Join(sources[code], ",") + "\n")
+	}
+}
 
-	for i := 0; i < len(fileInfo); i++ {
-		if filepath2.Ext(fileInfo[i].Name()) == ".txyz" {
-			txyzFilePath := filepath2.Join(dir, fileInfo[i].Name())
-			molName, atoms := loadLipid(txyzFilePath)
-			atomCodeToTypeMap := getAtomCodeToAtomTypeMap(atoms)
-			for k, v := range atomCodeToTypeMap {
-				_, _ = thisFile.WriteString(k + "\t" + strconv.Itoa(v) + "\t" + molName + "\n")
+// Largest radius tried when looking for the atom code radius that tells two atoms apart
+const maxAtomCodeRadius int = 8
+
+// Gives all atoms of a symmetry class the type most of them carry (the lowest on a tie), warning about every class
+// whose types disagree. Equivalent atoms share their code at every radius, so no policy could tell their types
+// apart, and atoms of a retyped system are typed the same way as their equivalents
+func symmetrizeAtomTypes(molName string, atoms map[int]*atom, classes map[int]int) {
+	classTypes := make(map[int]map[int]int)
+	for atomID, class := range classes {
+		if classTypes[class] == nil {
+			classTypes[class] = make(map[int]int)
+		}
+		classTypes[class][atoms[atomID].atomType]++
+	}
+
+	var atomIDs []int
+	for atomID := range atoms {
+		atomIDs = append(atomIDs, atomID)
+	}
+	sort.Ints(atomIDs)
+	for _, atomID := range atomIDs {
+		typeCounts := classTypes[classes[atomID]]
+		if len(typeCounts) < 2 {
+			continue
+		}
+		classType, bestCount := 0, 0
+		for atomType, count := range typeCounts {
+			if count > bestCount || (count == bestCount && atomType < classType) {
+				classType, bestCount = atomType, count
 			}
 		}
+		if atomID == classes[atomID] {
+			fmt.Println("Warning: " + molName + ": symmetry equivalent atoms of atom " + strconv.Itoa(atomID) +
+				" have different types, all are given type " + strconv.Itoa(classType))
+		}
+		atoms[atomID].atomType = classType
 	}
 }
 
+// Warns about atoms that share an atom code although they are not topologically symmetry equivalent and carry
+// different atom types, e.g. the sn-1 and sn-2 ester carbonyls of a glycerolipid at radius 2. Only one of their
+// types can make it into the dictionary, so the warning names the radius that would tell them apart
+func checkSymmetryClasses(molName string, atoms map[int]*atom, classes map[int]int, settings atomCodeSettings) {
+	coder := newAtomCoder(atoms, settings)
 
-func getAtomCodeToAtomTypeMap(atoms map[int]*atom) map[string]int {
-	atomCodeToTypeMap := make(map[string]int)
+	var atomIDs []int
 	for atomID := range atoms {
-		atomCodeToTypeMap[getAtomCode(atoms, atomID)] = atoms[atomID].atomType
+		atomIDs = append(atomIDs, atomID)
+	}
+	sort.Ints(atomIDs)
+
+	codeToAtoms := make(map[string][]int)
+	reported := make(map[[2]int]bool)
+	for _, atomID := range atomIDs {
+		code := coder.code(atomID)
+		for _, otherID := range codeToAtoms[code] {
+			classPair := [2]int{classes[otherID], classes[atomID]}
+			if classPair[0] == classPair[1] || reported[classPair] || atoms[otherID].atomType == atoms[atomID].atomType {
+				continue
+			}
+			reported[classPair] = true
+			message := "Warning: " + molName + ": atoms " + strconv.Itoa(otherID) + " and " + strconv.Itoa(atomID) +
+				" (types " + strconv.Itoa(atoms[otherID].atomType) + " and " + strconv.Itoa(atoms[atomID].atomType) +
+				") share an atom code at radius " + strconv.Itoa(settings.radius) + " but are not symmetry equivalent"
+			if radius := getDistinguishingRadius(coder, otherID, atomID); radius > 0 {
+				message += "; radius " + strconv.Itoa(radius) + " tells them apart"
+			}
+			fmt.Println(message)
+		}
+		codeToAtoms[code] = append(codeToAtoms[code], atomID)
 	}
-	return atomCodeToTypeMap
 }
 
+// Returns the smallest radius above the coder's at which the atom codes of two atoms differ, or -1 up to
+// maxAtomCodeRadius
+func getDistinguishingRadius(coder *atomCoder, atom1 int, atom2 int) int {
+	for radius := coder.settings.radius + 1; radius <= maxAtomCodeRadius; radius++ {
+		if coder.codeAtRadius(atom1, radius) != coder.codeAtRadius(atom2, radius) {
+			return radius
+		}
+	}
+	return -1
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	filepath2 "path/filepath"
+	"testing"
+)
+
+func TestSymmetrizeAtomTypes(t *testing.T) {
+	atoms := getTestDimethylPhosphate()
+	classes := getSymmetryClasses(atoms, atomMatchOptions{})
+	for atomID, class := range classes {
+		atoms[atomID].atomType = class
+	}
+	// the two terminal oxygens and one methyl hydrogen typed apart from their equivalents
+	atoms[3].atomType = 2
+	atoms[2].atomType = 3
+	atoms[8].atomType = 50
+
+	symmetrizeAtomTypes("dimethyl phosphate", atoms, classes)
+	if atoms[2].atomType != 2 || atoms[3].atomType != 2 {
+		t.Errorf("terminal oxygens typed %d and %d, want the lower type 2 on a tie", atoms[2].atomType, atoms[3].atomType)
+	}
+	for atomID, thisAtom := range atoms {
+		if thisAtom.element == "H" && thisAtom.atomType != classes[8] {
+			t.Errorf("hydrogen %d typed %d, want the majority type %d", atomID, thisAtom.atomType, classes[8])
+		}
+	}
+}
+
+func TestDictionaryOfInconsistentlyTypedTemplate(t *testing.T) {
+	atoms := getTestDimethylPhosphate()
+	for atomID, class := range getSymmetryClasses(atoms, atomMatchOptions{}) {
+		atoms[atomID].atomType = class
+	}
+	atoms[3].atomType = 99
+
+	// equivalent atoms never get different codes, so without symmetrized types no policy could settle this
+	dir := t.TempDir()
+	if err := writeTXYZ(atoms, filepath2.Join(dir, "dmp.txyz"), "dmp"); err != nil {
+		t.Fatal(err)
+	}
+	generateAtomCodeDictFile(dir, dir, "dict.txt", legacyAtomCodeSettings, conflictResolution{policy: "none"})
+	dictionary, settings := getAtomCodeDictFromFile(filepath2.Join(dir, "dict.txt"))
+	matches := getAtomIDsToAtomTypesMap(atoms, dictionary, settings)
+	if matches[2].atomType != matches[3].atomType || !matches[2].matched {
+		t.Errorf("terminal oxygens typed %v and %v", matches[2], matches[3])
+	}
+}
@@ -7,35 +7,51 @@ import (
 	"log"
 	"os"
 	filepath2 "path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 )
 
-// Will convert assign correct atom types to all bilayers in a dir
-func processBilayers(bilayerDir string, atomCodeFile string, outDir string) {
+// Will convert assign correct atom types to all bilayers in a dir. Molecules are identified against the typed
+// TXYZ templates in templateDir, "" to skip identification. method is "codes" to type every atom from its atom
+// code, or "templates" to copy the types of whole template molecules, falling back on atom codes for molecules
+// without a template unless atomCodeFile is ""
+func processBilayers(bilayerDir string, method string, atomCodeFile string, templateDir string, outDir string, strict bool) {
 	// Read in all files in dir
 	fileInfo, err := ioutil.ReadDir(bilayerDir)
 	if err != nil {
 		fmt.Println("failed to read directory: " + bilayerDir)
 		log.Fatal(err)
 	}
-	wg := sync.WaitGroup{}
+	var bilayerFiles []string
 	for i := 0; i < len(fileInfo); i++ {
 		if filepath2.Ext(fileInfo[i].Name()) == ".txyz" {
-			wg.Add(1)
-			go func(wg *sync.WaitGroup) {
-				bilayerFile := filepath2.Join(bilayerDir, fileInfo[i].Name())
-				processBilayer(bilayerFile, atomCodeFile, outDir)
-				wg.Done()
-			}(&wg)
+			bilayerFiles = append(bilayerFiles, filepath2.Join(bilayerDir, fileInfo[i].Name()))
 		}
 	}
-	wg.Wait()
+	if method != "codes" && method != "templates" {
+		log.Fatal("Unknown bilayer retyping method: " + method + " (expected codes or templates)")
+	}
+	if method == "templates" && templateDir == "" {
+		log.Fatal("Retyping bilayers from templates needs a template directory")
+	}
+	var templates []*moleculeTemplate
+	if templateDir != "" {
+		templates = loadMoleculeTemplates(templateDir)
+	}
+	err = runWorkerPool(pipelineContext, "processing bilayers", len(bilayerFiles), func(i int) {
+		processBilayer(bilayerFiles[i], method, atomCodeFile, templates, outDir, strict)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-// Will convert assign correct atom types to one bilayer
-func processBilayer(bilayerFile string, atomCodeFile string, outDir string) {
+// Will convert assign correct atom types to one bilayer. Atoms without a matching atom code are listed in
+// <bilayer>_unmatched.txt and molecules without a template in <bilayer>_unmatched_molecules.txt; they keep their
+// input type, and in strict mode the bilayer is not written at all. The species and atoms of every molecule are
+// written to <bilayer>_molecules.txt
+func processBilayer(bilayerFile string, method string, atomCodeFile string, templates []*moleculeTemplate, outDir string, strict bool) {
 
 	fmt.Println("Loading next bilayer into memory...")
 	// Load bilayer into memory
@@ -43,29 +59,184 @@ func processBilayer(bilayerFile string, atomCodeFile string, outDir string) {
 	fmt.Println("Finished loading bilayer " + bilayerName + " into memory.")
 	fmt.Println()
 
+	fmt.Println("Identifying molecules...")
+	molecules := getSeparateMolecules(bilayer)
+	classifyMolecules(molecules, templates)
+	_ = os.MkdirAll(outDir, 0755)
+	segmentationPath := filepath2.Join(outDir, bilayerName+"_molecules.txt")
+	writeMoleculeSegmentation(molecules, segmentationPath)
+	if numUnknown := countSpecies(molecules)[unknownSpecies]; numUnknown > 0 {
+		fmt.Println("Warning: " + strconv.Itoa(numUnknown) + " molecules of " + bilayerName + " match no template. See " + segmentationPath)
+	}
+	fmt.Println("Finished identifying " + strconv.Itoa(len(molecules)) + " molecules.")
+	fmt.Println()
+
+	atomIDsToTypesMap := make(map[int]int)
+	// atoms left to type from their atom codes
+	codeTyped := bilayer
+	if method == "templates" {
+		fmt.Println("Copying atom types from templates...")
+		unmatchedMolecules := assignTemplateTypes(molecules, atomIDsToTypesMap)
+		fmt.Println("Finished copying atom types.")
+		fmt.Println()
+
+		codeTyped = make(map[int]*atom)
+		if len(unmatchedMolecules) > 0 {
+			reportPath := filepath2.Join(outDir, bilayerName+"_unmatched_molecules.txt")
+			writeUnmatchedMolecules(unmatchedMolecules, reportPath)
+			fmt.Println("Warning: " + strconv.Itoa(len(unmatchedMolecules)) + " molecules of " + bilayerName +
+				" have no template. See " + reportPath)
+			for _, molecule := range unmatchedMolecules {
+				for atomID, thisAtom := range molecule.atoms {
+					if atomCodeFile != "" {
+						codeTyped[atomID] = thisAtom
+					} else {
+						atomIDsToTypesMap[atomID] = thisAtom.atomType
+					}
+				}
+			}
+			if atomCodeFile == "" {
+				if strict {
+					log.Fatal("Not writing partially typed bilayer " + bilayerName + " in strict mode")
+				}
+				fmt.Println("Molecules without a template keep their input atom types.")
+			} else {
+				fmt.Println("Typing molecules without a template from their atom codes.")
+			}
+		}
+	}
+	if len(codeTyped) > 0 {
+		assignCodeTypes(bilayerName, codeTyped, molecules, atomCodeFile, outDir, strict, atomIDsToTypesMap)
+	}
+
+	fmt.Println("Writing output to: " + outDir + " ...")
+	rewriteBilayer(atomIDsToTypesMap, bilayerFile, outDir, bilayerName)
+	fmt.Println("Finished writing output.")
+	fmt.Println()
+
+}
+
+// Types atoms from their atom codes, adding them to atomIDsToTypesMap. atoms must hold whole molecules of the
+// full-system segmentation molecules, whose numbering is used in the unmatched atom report
+func assignCodeTypes(bilayerName string, atoms map[int]*atom, molecules []*systemMolecule, atomCodeFile string, outDir string, strict bool, atomIDsToTypesMap map[int]int) {
 	fmt.Println("Loading Atom Type Assignment Database...")
 	// Load atom code to atom type database
-	atomCodeDict := getAtomCodeDictFromFile(atomCodeFile)
+	atomCodeDict, atomCodes := getAtomCodeDictFromFile(atomCodeFile)
 	fmt.Println("Finished loading Atom Type Assignment Database.")
 	fmt.Println()
 
 	fmt.Println("Assigning atom types...")
 	// Assign correct biotypes to all molecules using atom code dict
-	atomIDsToTypesMap := getAtomIDsToAtomTypesMap(bilayer, atomCodeDict)
+	atomIDsToMatches := getAtomIDsToAtomTypesMap(atoms, atomCodeDict, atomCodes)
+	var unmatched []int
+	numFallbacks := 0
+	for atomID, match := range atomIDsToMatches {
+		if !match.matched {
+			unmatched = append(unmatched, atomID)
+			atomIDsToTypesMap[atomID] = atoms[atomID].atomType
+			continue
+		}
+		if match.radius < atomCodes.radius {
+			numFallbacks++
+		}
+		atomIDsToTypesMap[atomID] = match.atomType
+	}
+	sort.Ints(unmatched)
 	fmt.Println("Finished assigning atom types.")
+	if numFallbacks > 0 {
+		fmt.Println(strconv.Itoa(numFallbacks) + " atoms of " + bilayerName + " were typed from fallback codes of smaller radius.")
+	}
 	fmt.Println()
 
-	fmt.Println("Writing output to: " + outDir + " ...")
-	rewriteBilayer(atomIDsToTypesMap, bilayerFile, outDir, bilayerName)
-	fmt.Println("Finished writing output.")
-	fmt.Println()
+	if len(unmatched) > 0 {
+		reportPath := filepath2.Join(outDir, bilayerName+"_unmatched.txt")
+		writeUnmatchedAtoms(atoms, molecules, unmatched, atomCodes, reportPath)
+		fmt.Println("Warning: " + strconv.Itoa(len(unmatched)) + " atoms of " + bilayerName +
+			" have no atom code in the dictionary. See " + reportPath)
+		if strict {
+			log.Fatal("Not writing partially typed bilayer " + bilayerName + " in strict mode")
+		}
+		fmt.Println("Unmatched atoms keep their input atom type.")
+	}
+}
+
+// Lists unmatched atoms with the molecule they belong to, their position in it, their bonded atoms and their code.
+// Molecules are numbered as in <bilayer>_molecules.txt
+func writeUnmatchedAtoms(atoms map[int]*atom, molecules []*systemMolecule, unmatched []int, settings atomCodeSettings, outPath string) {
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create unmatched atom report: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	moleculeIndices := make(map[int]int)
+	atomIndices := make(map[int]int)
+	for _, molecule := range molecules {
+		for n, atomID := range molecule.atomIDs {
+			moleculeIndices[atomID] = molecule.index
+			atomIndices[atomID] = n + 1
+		}
+	}
+	coder := newAtomCoder(atoms, settings)
+	_, _ = outFile.WriteString("# atom\telement\tinput_type\tmolecule\tatom_in_molecule\tbonded_atoms\tcode\n")
+	for _, atomID := range unmatched {
+		var bonded []string
+		for _, bondedAtom := range atoms[atomID].bondedAtoms {
+			bonded = append(bonded, atoms[bondedAtom].element+strconv.Itoa(bondedAtom))
+		}
+		_, _ = outFile.WriteString(strconv.Itoa(atomID) + "\t" + atoms[atomID].element + "\t" +
+			strconv.Itoa(atoms[atomID].atomType) + "\t" + strconv.Itoa(moleculeIndices[atomID]) + "\t" +
+			strconv.Itoa(atomIndices[atomID]) + "\t" + strings.Join(bonded, ",") + "\t" + coder.code(atomID) + "\n")
+	}
+}
 
+// Numbers the molecules (connected components) of a system from 1 in order of their lowest atom ID, and the atoms
+// of each molecule from 1 in atom ID order. Returns both numbers for every atom
+func getMoleculeIndices(atoms map[int]*atom) (map[int]int, map[int]int) {
+	var atomIDs []int
+	for atomID := range atoms {
+		atomIDs = append(atomIDs, atomID)
+	}
+	sort.Ints(atomIDs)
+
+	moleculeIndices := make(map[int]int)
+	atomIndices := make(map[int]int)
+	numMolecules := 0
+	for _, start := range atomIDs {
+		if moleculeIndices[start] != 0 {
+			continue
+		}
+		numMolecules++
+		moleculeIndices[start] = numMolecules
+		members := []int{start}
+		queue := []int{start}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			for _, bondedAtom := range atoms[current].bondedAtoms {
+				if _, ok := atoms[bondedAtom]; ok && moleculeIndices[bondedAtom] == 0 {
+					moleculeIndices[bondedAtom] = numMolecules
+					members = append(members, bondedAtom)
+					queue = append(queue, bondedAtom)
+				}
+			}
+		}
+		sort.Ints(members)
+		for n, member := range members {
+			atomIndices[member] = n + 1
+		}
+	}
+	return moleculeIndices, atomIndices
 }
 
-// Loads dictionary of atom codes from disk
-func getAtomCodeDictFromFile(file string) map[string]int {
+// Loads dictionary of atom codes from disk, with the settings its codes were built with
+func getAtomCodeDictFromFile(file string) (map[string]int, atomCodeSettings) {
 	// Create structure to store atoms
 	atomCodeDict := make(map[string]int)
+	// dictionaries without a header hold the original two-shell codes
+	settings := legacyAtomCodeSettings
+	conflicts := 0
 
 	// open file
 	thisFile, err := os.Open(file)
@@ -74,111 +245,164 @@ func getAtomCodeDictFromFile(file string) map[string]int {
 		log.Fatal(err)
 	}
 
-	// Initialize scanner
+	defer thisFile.Close()
+
+	// Initialize scanner, allowing for long codes and source lists
 	scanner := bufio.NewScanner(thisFile)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
 
 	// iterate over all other lines
 	for scanner.Scan() {
 		// get next line
 		line := scanner.Text()
+		if headerSettings, isHeader := parseAtomCodeHeader(line); isHeader {
+			settings = headerSettings
+			continue
+		}
 		// split by whitespace
 		tokens := strings.Fields(line)
 
 		if len(tokens) > 2 {
 			k := tokens[0]
-			v := tokens[1]
-			atomCodeDict[k], err = strconv.Atoi(v)
+			v, err := strconv.Atoi(tokens[1])
 			if err != nil {
 				fmt.Println("Warning: could not parse token " + tokens[1] + " as integer in file: " + file + " in line \"" + line + "\" at token position 2")
+				continue
 			}
+			// dictionaries written before conflict resolution may list a code more than once
+			if previous, ok := atomCodeDict[k]; ok && previous != v {
+				fmt.Println("Atom code conflict in " + file + ": " + k + " has types " + strconv.Itoa(previous) + " and " + strconv.Itoa(v))
+				conflicts++
+				continue
+			}
+			atomCodeDict[k] = v
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Failed to read atom code dictionary: " + file)
+		log.Fatal(err)
+	}
+	if conflicts > 0 {
+		log.Fatal(strconv.Itoa(conflicts) + " conflicting atom codes in " + file + ", regenerate it with a conflict resolution policy")
+	}
 
-	return atomCodeDict
+	return atomCodeDict, settings
 }
 
-// Rewrites file contents of bilayer with correct atom types
+// Rewrites file contents of bilayer with correct atom types to <bilayer>_amoeba.txyz in outDir
 func rewriteBilayer(atomIDsToTypesMap map[int]int, bilayerFile string, outDir string, bilayerName string) {
 	_ = os.MkdirAll(outDir, 0755)
-	outPath := filepath2.Join(outDir, bilayerName + "_amoeba.txyz")
-	// fmt.Println(thisPath)
+	rewriteTXYZTypes(atomIDsToTypesMap, bilayerFile, filepath2.Join(outDir, bilayerName + "_amoeba.txyz"))
+}
+
+// Copies a TXYZ file with new atom types. Only the atom type column of atom lines changes; the title line, the
+// periodic box line and any other lines are copied unchanged, and the new type is right aligned in the width of
+// the old one and the spaces before it, so fixed-width files keep their columns. Atoms missing from
+// atomIDsToTypesMap keep their type
+func rewriteTXYZTypes(atomIDsToTypesMap map[int]int, inPath string, outPath string) {
 	outFile, err := os.Create(outPath)
 	if err != nil {
 		fmt.Println("Failed to create new fragment file: " + outPath)
 		log.Fatal(err)
 	}
-	// write header
-	_, err = outFile.WriteString(strconv.Itoa(len(atomIDsToTypesMap)) + "\t System: " + bilayerName + "\n")
-	if err != nil {
-		fmt.Println("Failed to write header line to key: " + outPath)
-		log.Fatal(err)
-	}
+	defer outFile.Close()
+	writer := bufio.NewWriter(outFile)
 
 	// open file
-	inFile, err := os.Open(bilayerFile)
+	inFile, err := os.Open(inPath)
 	if err != nil {
-		fmt.Println("Failed to open molecule file: " + bilayerFile)
+		fmt.Println("Failed to open molecule file: " + inPath)
 		log.Fatal(err)
 	}
+	defer inFile.Close()
 
-	// Initialize scanner
+	// Initialize scanner, allowing for long title lines
 	scanner := bufio.NewScanner(inFile)
-	// ignore first line
-	scanner.Scan()
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 	// create line counter
-	i := 1
-	// iterate over all other lines
+	i := 0
 	for scanner.Scan() {
-		// get next line
 		line := scanner.Text()
-		// split by whitespace
+		i++
 		tokens := strings.Fields(line)
-		// check line length before proceeding
-		if len(tokens) >= 6 {
-			// get atomID
+		// title line and box line are kept as they are
+		if i > 1 && len(tokens) >= 6 && !isTXYZBoxLine(tokens) {
 			atomID, err := strconv.Atoi(tokens[0])
 			if err != nil {
-				fmt.Println("Failed to read atom number on line " + strconv.Itoa(i) + "in file: " + bilayerFile)
+				fmt.Println("Failed to read atom number on line " + strconv.Itoa(i) + " in file: " + inPath)
 				log.Fatal(err)
 			}
-			// get Atom Type from atomID
-			newAtomType := atomIDsToTypesMap[atomID]
-			// reassign Atom Type in line
-			tokens[5] = strconv.Itoa(newAtomType)
-		}
-		// rewrite line
-		replacementLine := ""
-		for _, token := range tokens {
-			replacementLine += token + "\t"
-		}
-		// write line to out file
-		_, _ = outFile.WriteString(replacementLine + "\n")
-		i++
+			if newAtomType, ok := atomIDsToTypesMap[atomID]; ok {
+				line = replaceField(line, 5, strconv.Itoa(newAtomType))
+			}
+		}
+		_, err = writer.WriteString(line + "\n")
+		if err != nil {
+			fmt.Println("Failed to write line " + strconv.Itoa(i) + " to: " + outPath)
+			log.Fatal(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Failed to read molecule file: " + inPath)
+		log.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		fmt.Println("Failed to write: " + outPath)
+		log.Fatal(err)
 	}
-
 }
 
-/*func getSeparateMolecules(atoms map[int]*atom) []map[int]*atom {
-	roots := getRoots(atoms)
-	moleculeSlice := make([]map[int]*atom, len(roots))
-
-	// Parallelized iterate through all roots and create copy of molecule containing only atoms with that root
-	wg := sync.WaitGroup{}
-	for i := 0; i < len(roots); i++ {
-		wg.Add(1)
-		go func(wg *sync.WaitGroup) {
-			// create a copyFile of the molecule
-			moleculeCopy := copyMolecule(atoms)
-			// delete all atoms not of that root
-			deleteAtomsNotOfGroup(moleculeCopy, []int {roots[i]})
-			// copy resulting molecule to the slice
-			moleculeSlice[i] = moleculeCopy
-
-			wg.Done()
-		}(&wg)
+// Replaces the whitespace separated field at index (from 0) of a line, leaving the rest of the line untouched. The
+// value is right aligned in the space the old field and the whitespace before it took up, and only widens the line
+// if it does not fit with one space in front
+func replaceField(line string, index int, value string) string {
+	fieldStart, fieldEnd := -1, 0
+	field := -1
+	for pos := 0; pos < len(line); {
+		for pos < len(line) && (line[pos] == ' ' || line[pos] == '\t') {
+			pos++
+		}
+		if pos == len(line) {
+			break
+		}
+		field++
+		start := pos
+		for pos < len(line) && line[pos] != ' ' && line[pos] != '\t' {
+			pos++
+		}
+		if field == index {
+			fieldStart, fieldEnd = start, pos
+			break
+		}
+	}
+	if fieldStart < 0 {
+		return line
 	}
-	wg.Wait()
-	return moleculeSlice
-}*/
 
+	// spaces before the field, tabs are kept as they are since their width is unknown
+	spaceStart := fieldStart
+	for spaceStart > 0 && line[spaceStart-1] == ' ' {
+		spaceStart--
+	}
+	if spaceStart == fieldStart {
+		return line[:fieldStart] + value + line[fieldEnd:]
+	}
+	width := fieldEnd - spaceStart
+	if len(value) >= width {
+		return line[:spaceStart] + " " + value + line[fieldEnd:]
+	}
+	return line[:spaceStart] + strings.Repeat(" ", width-len(value)) + value + line[fieldEnd:]
+}
 
+// Tinker writes the periodic box as a second line of six numbers: a, b, c, alpha, beta and gamma
+func isTXYZBoxLine(tokens []string) bool {
+	if len(tokens) != 6 {
+		return false
+	}
+	for _, token := range tokens {
+		if _, err := strconv.ParseFloat(token, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
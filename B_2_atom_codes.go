@@ -0,0 +1,306 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What goes into an atom code. The settings used to build an atom code dictionary are written to its header so
+// bilayers are always retyped with the codes the dictionary was built with
+type atomCodeSettings struct {
+	// bonds out from the atom that the code describes
+	radius int
+	// mark formally unsaturated bonds (both ends short of their usual valence) with "="
+	bondOrders bool
+	// mark atoms in rings of up to maxRingSize atoms with "r"
+	rings bool
+	// mark N with four bonds "+" and the terminal oxygens of phosphate and carboxylate groups "-"
+	charges bool
+	// mark atoms of 5 and 6 membered rings made of unsaturated atoms with "a"
+	aromaticity bool
+	// replace the readable code with a compact hash of it
+	hashed bool
+	// smallest radius down to which the dictionary also holds codes to fall back on for atoms whose code at radius
+	// is unknown, 0 for no fallback codes
+	fallbackRadius int
+}
+
+// Settings of dictionaries written before the header was introduced: two shells of plain element symbols
+var legacyAtomCodeSettings = atomCodeSettings{radius: 2}
+
+// Largest ring looked for when marking ring atoms
+const maxRingSize int = 8
+
+const atomCodeHeaderPrefix = "# atom codes:"
+
+// Readable codes longer than this (bytes) are hashed as if hashed were set. Codes grow exponentially with the
+// radius, and the deeper radii of conflict resolution would otherwise give dictionary lines of many megabytes
+const maxAtomCodeLength int = 4096
+
+// Builds atom codes for one molecule. Per-atom labels are worked out once so codes of many atoms are cheap, and
+// code can be called from several goroutines at once
+type atomCoder struct {
+	atoms map[int]*atom
+	settings atomCodeSettings
+	labels map[int]string
+	unsaturated map[int]bool
+}
+
+func newAtomCoder(atoms map[int]*atom, settings atomCodeSettings) *atomCoder {
+	coder := &atomCoder{atoms: atoms, settings: settings, labels: make(map[int]string), unsaturated: make(map[int]bool)}
+
+	for atomID, thisAtom := range atoms {
+		coder.unsaturated[atomID] = len(thisAtom.bondedAtoms) < getUsualValence(thisAtom.element)
+	}
+	var ringAtoms map[int]bool
+	var aromaticAtoms map[int]bool
+	if settings.rings || settings.aromaticity {
+		ringAtoms, aromaticAtoms = getRingAtoms(atoms, coder.unsaturated)
+	}
+	var charges map[int]string
+	if settings.charges {
+		charges = getChargeLabels(atoms, coder.unsaturated)
+	}
+
+	for atomID, thisAtom := range atoms {
+		label := thisAtom.element
+		if settings.charges {
+			label += charges[atomID]
+		}
+		if settings.rings && ringAtoms[atomID] {
+			label += "r"
+		}
+		if settings.aromaticity && aromaticAtoms[atomID] {
+			label += "a"
+		}
+		coder.labels[atomID] = label
+	}
+	return coder
+}
+
+// Describes the environment of an atom out to the radius: its label followed by the sorted codes of its bonded
+// atoms, each of them again followed by the codes of their own bonded atoms, and so on. Paths may lead back to
+// the atom they came from. With the legacy settings this is the original two-shell code, e.g.
+// C[C(CHHH)H(C)H(C)O(CC)]
+func (coder *atomCoder) code(atomID int) string {
+	return coder.codeAtRadius(atomID, coder.settings.radius)
+}
+
+func (coder *atomCoder) codeAtRadius(atomID int, radius int) string {
+	code := coder.labels[atomID]
+	if radius >= 1 {
+		code += "[" + strings.Join(coder.getBranches(atomID, radius), "") + "]"
+	}
+	if coder.settings.hashed || len(code) > maxAtomCodeLength {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(code))
+		return strconv.FormatUint(hash.Sum64(), 36)
+	}
+	return code
+}
+
+// sorted codes of the branches of atomID reaching depth bonds out
+func (coder *atomCoder) getBranches(atomID int, depth int) []string {
+	branches := make([]string, len(coder.atoms[atomID].bondedAtoms))
+	for i, bondedAtomID := range coder.atoms[atomID].bondedAtoms {
+		branch := coder.labels[bondedAtomID]
+		if coder.settings.bondOrders && coder.unsaturated[atomID] && coder.unsaturated[bondedAtomID] {
+			branch = "=" + branch
+		}
+		if depth > 1 {
+			branch += "(" + strings.Join(coder.getBranches(bondedAtomID, depth-1), "") + ")"
+		}
+		branches[i] = branch
+	}
+	sort.Strings(branches)
+	return branches
+}
+
+// Looks up the type of an atom in a dictionary, following codes marked deeperAtomCodeType out to larger radii.
+// Atoms whose code is unknown fall back on the codes of smaller radii down to the fallback radius. Returns the
+// type, the radius it was found at and false if no code of the atom is in the dictionary
+func (coder *atomCoder) lookupType(atomID int, dictionary map[string]int) (int, int, bool) {
+	radius := coder.settings.radius
+	atomType, ok := dictionary[coder.codeAtRadius(atomID, radius)]
+	for ok && atomType == deeperAtomCodeType && radius < maxAtomCodeRadius {
+		radius++
+		atomType, ok = dictionary[coder.codeAtRadius(atomID, radius)]
+	}
+	if ok && atomType != deeperAtomCodeType {
+		return atomType, radius, true
+	}
+
+	if coder.settings.fallbackRadius > 0 {
+		for radius = coder.settings.radius - 1; radius >= coder.settings.fallbackRadius; radius-- {
+			atomType, ok = dictionary[coder.codeAtRadius(atomID, radius)]
+			if ok && atomType != deeperAtomCodeType {
+				return atomType, radius, true
+			}
+		}
+	}
+	return 0, -1, false
+}
+
+// Number of bonds an element usually makes when uncharged and saturated
+func getUsualValence(element string) int {
+	switch element {
+	case "H", "F", "Cl", "CL", "Br", "BR", "I", "Na", "NA":
+		return 1
+	case "O", "S":
+		return 2
+	case "N":
+		return 3
+	case "C":
+		return 4
+	case "P":
+		return 5
+	}
+	return 0
+}
+
+// Finds the atoms in rings of up to maxRingSize atoms, and among them those of 5 and 6 membered rings whose atoms
+// are all unsaturated (one ring atom with a lone pair, N, O or S, is allowed in 5 membered rings)
+func getRingAtoms(atoms map[int]*atom, unsaturated map[int]bool) (map[int]bool, map[int]bool) {
+	ringAtoms := make(map[int]bool)
+	aromaticAtoms := make(map[int]bool)
+	for atomID, thisAtom := range atoms {
+		for _, bondedAtom := range thisAtom.bondedAtoms {
+			if atomID > bondedAtom {
+				continue
+			}
+			ring := getSmallestRing(atoms, atomID, bondedAtom, maxRingSize)
+			if ring == nil {
+				continue
+			}
+			lonePairs := 0
+			allUnsaturated := true
+			for _, ringAtom := range ring {
+				ringAtoms[ringAtom] = true
+				if !unsaturated[ringAtom] {
+					element := atoms[ringAtom].element
+					if element == "N" || element == "O" || element == "S" {
+						lonePairs++
+					} else {
+						allUnsaturated = false
+					}
+				}
+			}
+			if allUnsaturated && ((len(ring) == 6 && lonePairs == 0) || (len(ring) == 5 && lonePairs <= 1)) {
+				for _, ringAtom := range ring {
+					aromaticAtoms[ringAtom] = true
+				}
+			}
+		}
+	}
+	return ringAtoms, aromaticAtoms
+}
+
+// Returns the atoms of the smallest ring through the bond atom1-atom2 with at most maxSize atoms, or nil
+func getSmallestRing(atoms map[int]*atom, atom1 int, atom2 int, maxSize int) []int {
+	previous := map[int]int{atom2: atom2}
+	depth := map[int]int{atom2: 1}
+	queue := []int{atom2}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if depth[current] >= maxSize {
+			continue
+		}
+		for _, bondedAtom := range atoms[current].bondedAtoms {
+			if current == atom2 && bondedAtom == atom1 {
+				continue
+			}
+			if bondedAtom == atom1 {
+				ring := []int{atom1}
+				for step := current; step != atom2; step = previous[step] {
+					ring = append(ring, step)
+				}
+				return append(ring, atom2)
+			}
+			if _, seen := previous[bondedAtom]; !seen {
+				if _, ok := atoms[bondedAtom]; !ok {
+					continue
+				}
+				previous[bondedAtom] = current
+				depth[bondedAtom] = depth[current] + 1
+				queue = append(queue, bondedAtom)
+			}
+		}
+	}
+	return nil
+}
+
+// Charge marks that do not depend on which of several equivalent atoms carries the charge: "+" on N with four
+// bonds, "-" on every terminal oxygen of a P or C with more terminal oxygens than it can double bond to
+func getChargeLabels(atoms map[int]*atom, unsaturated map[int]bool) map[int]string {
+	labels := make(map[int]string)
+	for atomID, thisAtom := range atoms {
+		if thisAtom.element == "N" && len(thisAtom.bondedAtoms) == 4 {
+			labels[atomID] = "+"
+		}
+		if thisAtom.element != "P" && thisAtom.element != "C" {
+			continue
+		}
+		var terminalOxygens []int
+		for _, bondedAtom := range thisAtom.bondedAtoms {
+			if atoms[bondedAtom].element == "O" && len(atoms[bondedAtom].bondedAtoms) == 1 {
+				terminalOxygens = append(terminalOxygens, bondedAtom)
+			}
+		}
+		doubleBonds := getUsualValence(thisAtom.element) - len(thisAtom.bondedAtoms)
+		if len(terminalOxygens) > doubleBonds {
+			for _, oxygen := range terminalOxygens {
+				labels[oxygen] = "-"
+			}
+		}
+	}
+	return labels
+}
+
+// Header line recording the settings an atom code dictionary was built with
+func getAtomCodeHeader(settings atomCodeSettings) string {
+	return atomCodeHeaderPrefix + " radius=" + strconv.Itoa(settings.radius) +
+		" bondorders=" + strconv.FormatBool(settings.bondOrders) + " rings=" + strconv.FormatBool(settings.rings) +
+		" charges=" + strconv.FormatBool(settings.charges) + " aromaticity=" + strconv.FormatBool(settings.aromaticity) +
+		" hashed=" + strconv.FormatBool(settings.hashed) + " fallback=" + strconv.Itoa(settings.fallbackRadius)
+}
+
+// Reads the settings from a dictionary header line. Returns false if the line is not such a header
+func parseAtomCodeHeader(line string) (atomCodeSettings, bool) {
+	settings := legacyAtomCodeSettings
+	if !strings.HasPrefix(line, atomCodeHeaderPrefix) {
+		return settings, false
+	}
+	for _, token := range strings.Fields(strings.TrimPrefix(line, atomCodeHeaderPrefix)) {
+		keyValue := strings.SplitN(token, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		flag := keyValue[1] == "true"
+		switch keyValue[0] {
+		case "radius":
+			radius, err := strconv.Atoi(keyValue[1])
+			if err == nil {
+				settings.radius = radius
+			}
+		case "fallback":
+			fallbackRadius, err := strconv.Atoi(keyValue[1])
+			if err == nil {
+				settings.fallbackRadius = fallbackRadius
+			}
+		case "bondorders":
+			settings.bondOrders = flag
+		case "rings":
+			settings.rings = flag
+		case "charges":
+			settings.charges = flag
+		case "aromaticity":
+			settings.aromaticity = flag
+		case "hashed":
+			settings.hashed = flag
+		}
+	}
+	return settings, true
+}
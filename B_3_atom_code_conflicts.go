@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Type given in the dictionary to codes whose atoms disagree and are told apart by the codes one radius deeper
+const deeperAtomCodeType int = -1
+
+// How conflicting atom codes (the same code with different atom types) are settled when building a dictionary.
+// Codes in the override file are settled first, whatever the policy
+type conflictResolution struct {
+	// "none" to only report conflicts, "majority" for the type of most atoms, "deeper" to split the code by
+	// looking further out, up to maxAtomCodeRadius
+	policy string
+	// optional file of "code type" lines, "" for none
+	overridePath string
+}
+
+// One atom of a template molecule as seen by dictionary generation
+type atomCodeRecord struct {
+	molecule string
+	atomID int
+	atomType int
+	coder *atomCoder
+}
+
+// A code whose atoms do not all have the same type, and how it was settled
+type atomCodeConflict struct {
+	code string
+	radius int
+	// number of atoms and source molecules for every competing type
+	typeCounts map[int]int
+	typeMolecules map[int][]string
+	resolution string
+	resolved bool
+}
+
+// Settles the types of a group of codes at radius, adding the chosen type of each code to dictionary and any
+// conflicts found on the way to conflicts. Conflicting codes resolved by the deeper policy get deeperAtomCodeType
+// and their atoms are grouped again one radius out
+func resolveAtomCodes(groups map[string][]atomCodeRecord, radius int, resolution conflictResolution,
+	overrides map[string]int, dictionary map[string]int, sources map[string][]string, conflicts *[]atomCodeConflict) {
+
+	var codes []string
+	for code := range groups {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		records := groups[code]
+		typeCounts := make(map[int]int)
+		typeMolecules := make(map[int][]string)
+		for _, record := range records {
+			typeCounts[record.atomType]++
+			if !containsString(typeMolecules[record.atomType], record.molecule) {
+				typeMolecules[record.atomType] = append(typeMolecules[record.atomType], record.molecule)
+			}
+			if !containsString(sources[code], record.molecule) {
+				sources[code] = append(sources[code], record.molecule)
+			}
+		}
+
+		if overrideType, ok := overrides[code]; ok {
+			dictionary[code] = overrideType
+			if len(typeCounts) > 1 {
+				*conflicts = append(*conflicts, atomCodeConflict{code, radius, typeCounts, typeMolecules,
+					"override " + strconv.Itoa(overrideType), true})
+			}
+			continue
+		}
+		if len(typeCounts) == 1 {
+			dictionary[code] = records[0].atomType
+			continue
+		}
+
+		conflict := atomCodeConflict{code: code, radius: radius, typeCounts: typeCounts, typeMolecules: typeMolecules}
+		switch resolution.policy {
+		case "majority":
+			majorityType, unique := getMajorityType(typeCounts)
+			if unique {
+				dictionary[code] = majorityType
+				conflict.resolution = "majority " + strconv.Itoa(majorityType)
+				conflict.resolved = true
+			} else {
+				conflict.resolution = "tied majority"
+			}
+		case "deeper":
+			if radius < maxAtomCodeRadius {
+				dictionary[code] = deeperAtomCodeType
+				conflict.resolution = "deeper radius " + strconv.Itoa(radius+1)
+				conflict.resolved = true
+			} else {
+				conflict.resolution = "no radius up to " + strconv.Itoa(maxAtomCodeRadius) + " tells the types apart"
+			}
+		case "none":
+			conflict.resolution = "unresolved"
+		default:
+			log.Fatal("Unknown atom code conflict policy: " + resolution.policy + " (expected none, majority or deeper)")
+		}
+		*conflicts = append(*conflicts, conflict)
+
+		if dictionary[code] == deeperAtomCodeType {
+			deeperGroups := make(map[string][]atomCodeRecord)
+			for _, record := range records {
+				deeperCode := record.coder.codeAtRadius(record.atomID, radius+1)
+				deeperGroups[deeperCode] = append(deeperGroups[deeperCode], record)
+			}
+			resolveAtomCodes(deeperGroups, radius+1, resolution, overrides, dictionary, sources, conflicts)
+		}
+	}
+}
+
+// Adds the codes of radii below the dictionary radius, down to the fallback radius, for which every template atom
+// agrees on the type. Atoms whose code is unknown at the dictionary radius are looked up with these instead
+func addFallbackCodes(groups map[string][]atomCodeRecord, settings atomCodeSettings, dictionary map[string]int, sources map[string][]string) {
+	if settings.fallbackRadius <= 0 {
+		return
+	}
+	for radius := settings.radius - 1; radius >= settings.fallbackRadius; radius-- {
+		types := make(map[string]int)
+		ambiguous := make(map[string]bool)
+		for _, records := range groups {
+			for _, record := range records {
+				code := record.coder.codeAtRadius(record.atomID, radius)
+				if atomType, ok := types[code]; ok && atomType != record.atomType {
+					ambiguous[code] = true
+				}
+				types[code] = record.atomType
+				if !containsString(sources[code], record.molecule) {
+					sources[code] = append(sources[code], record.molecule)
+				}
+			}
+		}
+		for code, atomType := range types {
+			if ambiguous[code] {
+				delete(sources, code)
+				continue
+			}
+			dictionary[code] = atomType
+		}
+	}
+}
+
+// Returns the type with the most atoms, and false if several types share the highest count
+func getMajorityType(typeCounts map[int]int) (int, bool) {
+	bestType := 0
+	bestCount := -1
+	unique := false
+	for atomType, count := range typeCounts {
+		if count > bestCount {
+			bestType = atomType
+			bestCount = count
+			unique = true
+		} else if count == bestCount {
+			unique = false
+		}
+	}
+	return bestType, unique
+}
+
+// Loads "code type" lines settling particular codes by hand
+func loadAtomCodeOverrides(overridePath string) map[string]int {
+	overrides := make(map[string]int)
+	if overridePath == "" {
+		return overrides
+	}
+	file, err := os.Open(overridePath)
+	if err != nil {
+		fmt.Println("Failed to open atom code override file: " + overridePath)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) < 2 {
+			fmt.Println("Warning: skipping atom code override line without a type: " + line)
+			continue
+		}
+		atomType, err := strconv.Atoi(tokens[1])
+		if err != nil {
+			fmt.Println("Warning: could not parse atom type " + tokens[1] + " in override file: " + overridePath)
+			continue
+		}
+		overrides[tokens[0]] = atomType
+	}
+	return overrides
+}
+
+// Writes every conflict with its competing types, their atom counts and source molecules, and its resolution.
+// Returns the number of conflicts left unresolved
+func writeAtomCodeConflicts(conflicts []atomCodeConflict, outPath string) int {
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create atom code conflict report: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	unresolved := 0
+	_, _ = outFile.WriteString("# code\tradius\ttype:atoms:molecules ...\tresolution\n")
+	for _, conflict := range conflicts {
+		var types []int
+		for atomType := range conflict.typeCounts {
+			types = append(types, atomType)
+		}
+		sort.Ints(types)
+		var competing []string
+		for _, atomType := range types {
+			competing = append(competing, strconv.Itoa(atomType)+":"+strconv.Itoa(conflict.typeCounts[atomType])+":"+
+				strings.Join(conflict.typeMolecules[atomType], ","))
+		}
+		line := conflict.code + "\t" + strconv.Itoa(conflict.radius) + "\t" + strings.Join(competing, " ") + "\t" + conflict.resolution
+		_, _ = outFile.WriteString(line + "\n")
+		if !conflict.resolved {
+			unresolved++
+			fmt.Println("Unresolved atom code conflict: " + line)
+		}
+	}
+	return unresolved
+}
+
+func containsString(s []string, value string) bool {
+	for _, element := range s {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Species of molecules that match no template
+const unknownSpecies = "unknown"
+
+// A typed molecule that molecules of a system are recognised as, e.g. one lipid species from pren/molecules
+type moleculeTemplate struct {
+	name string
+	atoms map[int]*atom
+	// formula and refined labels, equal for isomorphic molecules
+	graphKey string
+}
+
+// One molecule (connected component) of a system
+type systemMolecule struct {
+	// numbered from 1 in order of the lowest atom ID
+	index int
+	atomIDs []int
+	// the atoms of the system belonging to this molecule, shared with the system
+	atoms map[int]*atom
+	// template name, "water", "ion_<element>" or unknownSpecies
+	species string
+	template *moleculeTemplate
+	// template atom ID -> system atom ID, nil unless a template was matched
+	mapping map[int]int
+}
+
+// Splits a system into its molecules, ordered by their lowest atom ID
+func getSeparateMolecules(atoms map[int]*atom) []*systemMolecule {
+	moleculeIndices, _ := getMoleculeIndices(atoms)
+	numMolecules := 0
+	for _, index := range moleculeIndices {
+		numMolecules = max(numMolecules, index)
+	}
+	molecules := make([]*systemMolecule, numMolecules)
+	for i := range molecules {
+		molecules[i] = &systemMolecule{index: i + 1, atoms: make(map[int]*atom), species: unknownSpecies}
+	}
+	for atomID, thisAtom := range atoms {
+		molecule := molecules[moleculeIndices[atomID]-1]
+		molecule.atomIDs = append(molecule.atomIDs, atomID)
+		molecule.atoms[atomID] = thisAtom
+	}
+	for _, molecule := range molecules {
+		sort.Ints(molecule.atomIDs)
+	}
+	return molecules
+}
+
+// Loads every TXYZ in a directory as a template, named after its file
+func loadMoleculeTemplates(dir string) []*moleculeTemplate {
+	fileInfo, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fmt.Println("failed to read directory: " + dir)
+		log.Fatal(err)
+	}
+	var templates []*moleculeTemplate
+	for i := 0; i < len(fileInfo); i++ {
+		if filepath2.Ext(fileInfo[i].Name()) == ".txyz" {
+			name, atoms := loadLipid(filepath2.Join(dir, fileInfo[i].Name()))
+			templates = append(templates, &moleculeTemplate{name, atoms, getGraphKey(atoms)})
+		}
+	}
+	return templates
+}
+
+// Identifies the species of every molecule. A molecule is an instance of a template if their graph keys agree and
+// an isomorphism between them is found; the mapping is kept for retyping. Water and single atom ions are
+// recognised without templates
+func classifyMolecules(molecules []*systemMolecule, templates []*moleculeTemplate) {
+	templatesByKey := make(map[string][]*moleculeTemplate)
+	for _, template := range templates {
+		templatesByKey[template.graphKey] = append(templatesByKey[template.graphKey], template)
+	}
+
+	for _, molecule := range molecules {
+		for _, template := range templatesByKey[getGraphKey(molecule.atoms)] {
+			mapping, ok := getAtomMapping(template.atoms, molecule.atoms)
+			if ok {
+				molecule.species = template.name
+				molecule.template = template
+				molecule.mapping = mapping
+				break
+			}
+		}
+		if molecule.template == nil {
+			molecule.species = getBuiltinSpecies(molecule.atoms)
+		}
+	}
+}
+
+// Species of molecules recognised without a template: water and single atom ions
+func getBuiltinSpecies(atoms map[int]*atom) string {
+	if len(atoms) == 1 {
+		for _, thisAtom := range atoms {
+			return "ion_" + thisAtom.element
+		}
+	}
+	if len(atoms) == 3 {
+		for _, thisAtom := range atoms {
+			if thisAtom.element == "O" && len(thisAtom.bondedAtoms) == 2 &&
+				atoms[thisAtom.bondedAtoms[0]].element == "H" && atoms[thisAtom.bondedAtoms[1]].element == "H" {
+				return "water"
+			}
+		}
+	}
+	return unknownSpecies
+}
+
+// Formula and sorted refined atom labels of a molecule, hashed. Isomorphic molecules share a key
+func getGraphKey(atoms map[int]*atom) string {
+	elementCounts := make(map[string]int)
+	for _, thisAtom := range atoms {
+		elementCounts[thisAtom.element]++
+	}
+	var formula []string
+	for element, count := range elementCounts {
+		formula = append(formula, element+strconv.Itoa(count))
+	}
+	sort.Strings(formula)
+
+	var labels []string
+	for _, label := range getRefinedLabels(atoms, matchRefinementRounds, false) {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(strings.Join(labels, ",")))
+	return strings.Join(formula, "") + "_" + strconv.FormatUint(hash.Sum64(), 36)
+}
+
+// Returns the number of molecules of every species
+func countSpecies(molecules []*systemMolecule) map[string]int {
+	counts := make(map[string]int)
+	for _, molecule := range molecules {
+		counts[molecule.species]++
+	}
+	return counts
+}
+
+// Writes the molecule (residue) index and species of every molecule with its atoms as ID ranges, followed by a
+// count of every species
+func writeMoleculeSegmentation(molecules []*systemMolecule, outPath string) {
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create molecule segmentation file: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	_, _ = outFile.WriteString("# molecule\tspecies\tnum_atoms\tatoms\n")
+	for _, molecule := range molecules {
+		_, _ = outFile.WriteString(strconv.Itoa(molecule.index) + "\t" + molecule.species + "\t" +
+			strconv.Itoa(len(molecule.atomIDs)) + "\t" + formatAtomRanges(molecule.atomIDs) + "\n")
+	}
+
+	counts := countSpecies(molecules)
+	var species []string
+	for name := range counts {
+		species = append(species, name)
+	}
+	sort.Strings(species)
+	for _, name := range species {
+		_, _ = outFile.WriteString("# " + name + "\t" + strconv.Itoa(counts[name]) + "\n")
+	}
+}
+
+// Writes sorted atom IDs as comma separated ranges, e.g. 1-134,140
+func formatAtomRanges(atomIDs []int) string {
+	var ranges []string
+	for start := 0; start < len(atomIDs); {
+		end := start
+		for end+1 < len(atomIDs) && atomIDs[end+1] == atomIDs[end]+1 {
+			end++
+		}
+		if end == start {
+			ranges = append(ranges, strconv.Itoa(atomIDs[start]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(atomIDs[start])+"-"+strconv.Itoa(atomIDs[end]))
+		}
+		start = end + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// Copies the atom types of their templates onto the atoms of every molecule matched to one, adding them to
+// atomIDsToTypesMap. Returns the molecules without a template
+func assignTemplateTypes(molecules []*systemMolecule, atomIDsToTypesMap map[int]int) []*systemMolecule {
+	var unmatched []*systemMolecule
+	for _, molecule := range molecules {
+		if molecule.template == nil {
+			unmatched = append(unmatched, molecule)
+			continue
+		}
+		for templateID, atomID := range molecule.mapping {
+			atomIDsToTypesMap[atomID] = molecule.template.atoms[templateID].atomType
+		}
+	}
+	return unmatched
+}
+
+// Lists molecules without a template with their graph key, so that molecules of the same missing species can be
+// told apart from one-off fragments
+func writeUnmatchedMolecules(molecules []*systemMolecule, outPath string) {
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create unmatched molecule report: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	_, _ = outFile.WriteString("# molecule\tspecies\tnum_atoms\tgraph_key\tatoms\n")
+	for _, molecule := range molecules {
+		_, _ = outFile.WriteString(strconv.Itoa(molecule.index) + "\t" + molecule.species + "\t" +
+			strconv.Itoa(len(molecule.atomIDs)) + "\t" + getGraphKey(molecule.atoms) + "\t" +
+			formatAtomRanges(molecule.atomIDs) + "\n")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	filepath2 "path/filepath"
+	"strconv"
+	"strings"
+)
+
+// An atom record of a Tinker parameter file: atom type, class, symbol, "description", atomic number, mass, valence
+type atomTypeRecord struct {
+	atomType int
+	atomClass int
+	symbol string
+	description string
+	atomicNumber int
+	mass float64
+	valence int
+}
+
+// A biotype record: biotype number, atom name, "residue", atom type
+type biotypeRecord struct {
+	biotype int
+	atomName string
+	residue string
+	atomType int
+}
+
+// The records of one Tinker .prm (or .key) file
+type tinkerParameters struct {
+	path string
+	// name of the force field, from the forcefield keyword
+	forceField string
+	atomTypes map[int]atomTypeRecord
+	biotypes []biotypeRecord
+	// keys of the parameters present for every term kind ("vdw", "bond", ...), see getTermKey
+	terms map[string]map[string]bool
+}
+
+// Term kinds of a parameter file by keyword, and how many atom classes or types identify one parameter. vdw,
+// bond, angle and torsion parameters are given for atom classes, multipole and polarize parameters for atom types
+var parameterTermKeywords = map[string]string{"vdw": "vdw", "bond": "bond", "angle": "angle", "anglep": "angle",
+	"angle3": "angle", "angle4": "angle", "angle5": "angle", "torsion": "torsion", "multipole": "multipole",
+	"polarize": "polarize"}
+var parameterTermSizes = map[string]int{"vdw": 1, "bond": 2, "angle": 3, "torsion": 4, "multipole": 1, "polarize": 1}
+
+// Reads the atom, biotype and parameter records of a Tinker parameter file. Keywords are case insensitive and lines
+// with other keywords, such as the continuation lines of multipoles, are skipped
+func loadTinkerParameters(path string) *tinkerParameters {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Failed to open parameter file: " + path)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	parameters := &tinkerParameters{path: path, atomTypes: make(map[int]atomTypeRecord),
+		terms: make(map[string]map[string]bool)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		tokens := splitParameterLine(scanner.Text())
+		if len(tokens) == 0 {
+			continue
+		}
+		var ok bool
+		switch strings.ToLower(tokens[0]) {
+		case "forcefield":
+			parameters.forceField = strings.Join(tokens[1:], " ")
+			ok = true
+		case "atom":
+			var record atomTypeRecord
+			record, ok = parseAtomTypeRecord(tokens)
+			if ok {
+				parameters.atomTypes[record.atomType] = record
+			}
+		case "biotype":
+			var record biotypeRecord
+			record, ok = parseBiotypeRecord(tokens)
+			if ok {
+				parameters.biotypes = append(parameters.biotypes, record)
+			}
+		default:
+			kind, isTerm := parameterTermKeywords[strings.ToLower(tokens[0])]
+			if !isTerm {
+				continue
+			}
+			var ids []int
+			ids, ok = parseTermIDs(tokens, parameterTermSizes[kind])
+			if ok {
+				if parameters.terms[kind] == nil {
+					parameters.terms[kind] = make(map[string]bool)
+				}
+				parameters.terms[kind][getTermKey(kind, ids)] = true
+			}
+		}
+		if !ok {
+			fmt.Println("Warning: could not parse line " + strconv.Itoa(lineNum) + " of parameter file " + path + ": " + scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Failed to read parameter file: " + path)
+		log.Fatal(err)
+	}
+	return parameters
+}
+
+// Name of a parameter set for file names and messages: the forcefield keyword, or the file name
+func (parameters *tinkerParameters) name() string {
+	if parameters.forceField != "" {
+		return strings.ReplaceAll(parameters.forceField, " ", "_")
+	}
+	return strings.TrimSuffix(filepath2.Base(parameters.path), filepath2.Ext(parameters.path))
+}
+
+// Parses "atom type class symbol "description" atomicNumber mass valence". Older files leave out the class, which
+// is then the type
+func parseAtomTypeRecord(tokens []string) (atomTypeRecord, bool) {
+	var record atomTypeRecord
+	if len(tokens) < 7 {
+		return record, false
+	}
+	var err error
+	if record.atomType, err = strconv.Atoi(tokens[1]); err != nil {
+		return record, false
+	}
+	rest := tokens[2:]
+	if atomClass, err := strconv.Atoi(rest[0]); err == nil && len(tokens) >= 8 {
+		record.atomClass = atomClass
+		rest = rest[1:]
+	} else {
+		record.atomClass = record.atomType
+	}
+	record.symbol = rest[0]
+	record.description = rest[1]
+	if record.atomicNumber, err = strconv.Atoi(rest[2]); err != nil {
+		return record, false
+	}
+	if record.mass, err = strconv.ParseFloat(rest[3], 64); err != nil {
+		return record, false
+	}
+	if record.valence, err = strconv.Atoi(rest[4]); err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// Parses "biotype number atomName "residue" atomType"
+func parseBiotypeRecord(tokens []string) (biotypeRecord, bool) {
+	var record biotypeRecord
+	if len(tokens) < 5 {
+		return record, false
+	}
+	var err error
+	if record.biotype, err = strconv.Atoi(tokens[1]); err != nil {
+		return record, false
+	}
+	record.atomName = tokens[2]
+	record.residue = tokens[3]
+	if record.atomType, err = strconv.Atoi(tokens[4]); err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// Reads the atom classes or types a parameter is given for from the tokens after the keyword. Multipoles also list
+// the types of their frame atoms, only the first number is the type the multipole belongs to
+func parseTermIDs(tokens []string, size int) ([]int, bool) {
+	if len(tokens) < size+1 {
+		return nil, false
+	}
+	ids := make([]int, size)
+	for i := range ids {
+		id, err := strconv.Atoi(tokens[i+1])
+		if err != nil {
+			return nil, false
+		}
+		ids[i] = id
+	}
+	return ids, true
+}
+
+// Key of a parameter from its atom classes or types. Bonds, angles and torsions read the same both ways, so the
+// smaller of the two directions is used
+func getTermKey(kind string, ids []int) string {
+	reversed := make([]int, len(ids))
+	for i, id := range ids {
+		reversed[len(ids)-1-i] = id
+	}
+	for i := range ids {
+		if reversed[i] != ids[i] {
+			if reversed[i] < ids[i] {
+				ids = reversed
+			}
+			break
+		}
+	}
+	var key []string
+	for _, id := range ids {
+		key = append(key, strconv.Itoa(id))
+	}
+	return kind + " " + strings.Join(key, "-")
+}
+
+// Splits a parameter file line at whitespace, keeping double quoted descriptions as one token without their
+// quotes. Anything after a # outside quotes is a comment
+func splitParameterLine(line string) []string {
+	var tokens []string
+	var token strings.Builder
+	inToken := false
+	quoted := false
+	for _, char := range line {
+		switch {
+		case char == '"':
+			quoted = !quoted
+			inToken = true
+		case quoted:
+			token.WriteRune(char)
+		case char == '#':
+			if inToken {
+				tokens = append(tokens, token.String())
+			}
+			return tokens
+		case char == ' ' || char == '\t' || char == '\r':
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(char)
+			inToken = true
+		}
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
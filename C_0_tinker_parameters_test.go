@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	filepath2 "path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A small parameter file: atoms with and without a class, a biotype, terms written in both directions, a multipole
+// with its continuation lines and comments
+const testParameterFile = `forcefield AMOEBA-TEST
+
+# atom records
+atom 1 1 C "Methyl C" 6 12.011 4
+atom 2 2 H "Methyl H #1" 1 1.008 1
+atom 3 3 O "Hydroxyl O" 8 15.999 2
+atom 4 H "Hydroxyl H" 1 1.008 1
+
+biotype 1 CB "Methanol" 1
+
+vdw 1 3.8200 0.1010
+bond 2 1 341.00 1.1120  # written reversed
+bond 1 3 404.00 1.3450
+angle 2 1 3 64.00 107.70
+torsion 4 3 1 2 0.000 0.0 1 0.000 180.0 2 0.240 0.0 3
+multipole 1 3 2 -0.14100
+                    0.09400 0.00000 0.26700
+                   -0.33700
+                    0.00000 -0.30300
+                    0.09500 0.00000 0.64000
+polarize 1 1.3340 0.3900 2 3
+`
+
+func TestSplitParameterLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{"plain", "bond 1 2 340.0 1.09", []string{"bond", "1", "2", "340.0", "1.09"}},
+		{"quoted description", `atom 1 1 C "Methyl C" 6 12.011 4`, []string{"atom", "1", "1", "C", "Methyl C", "6", "12.011", "4"}},
+		{"hash inside quotes", `atom 2 2 H "H #1" 1 1.008 1`, []string{"atom", "2", "2", "H", "H #1", "1", "1.008", "1"}},
+		{"empty quotes", `biotype 3 HN "" 5`, []string{"biotype", "3", "HN", "", "5"}},
+		{"trailing comment", "vdw 1 3.8 0.1 # from amoebabio18", []string{"vdw", "1", "3.8", "0.1"}},
+		{"comment against token", "vdw 1 3.8#note", []string{"vdw", "1", "3.8"}},
+		{"tabs and carriage return", "bond\t1\t2  340.0\r", []string{"bond", "1", "2", "340.0"}},
+		{"comment line", "# header", nil},
+		{"blank line", "   ", nil},
+	}
+	for _, test := range tests {
+		if got := splitParameterLine(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetTermKeyCanonicalizesDirection(t *testing.T) {
+	tests := []struct {
+		kind string
+		ids, reversed []int
+		want string
+	}{
+		{"bond", []int{2, 1}, []int{1, 2}, "bond 1-2"},
+		{"angle", []int{3, 1, 2}, []int{2, 1, 3}, "angle 2-1-3"},
+		{"angle", []int{1, 5, 1}, []int{1, 5, 1}, "angle 1-5-1"},
+		{"torsion", []int{4, 3, 1, 2}, []int{2, 1, 3, 4}, "torsion 2-1-3-4"},
+		{"torsion", []int{1, 3, 2, 1}, []int{1, 2, 3, 1}, "torsion 1-2-3-1"},
+		{"vdw", []int{7}, []int{7}, "vdw 7"},
+	}
+	for _, test := range tests {
+		got := getTermKey(test.kind, append([]int{}, test.ids...))
+		gotReversed := getTermKey(test.kind, append([]int{}, test.reversed...))
+		if got != test.want || gotReversed != test.want {
+			t.Errorf("%s %v: got %q and reversed %q, want %q", test.kind, test.ids, got, gotReversed, test.want)
+		}
+	}
+}
+
+func TestLoadTinkerParameters(t *testing.T) {
+	path := filepath2.Join(t.TempDir(), "test.prm")
+	if err := os.WriteFile(path, []byte(testParameterFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parameters := loadTinkerParameters(path)
+
+	if parameters.name() != "AMOEBA-TEST" {
+		t.Errorf("name %q, want AMOEBA-TEST", parameters.name())
+	}
+	wantAtoms := map[int]atomTypeRecord{
+		1: {1, 1, "C", "Methyl C", 6, 12.011, 4},
+		2: {2, 2, "H", "Methyl H #1", 1, 1.008, 1},
+		3: {3, 3, "O", "Hydroxyl O", 8, 15.999, 2},
+		4: {4, 4, "H", "Hydroxyl H", 1, 1.008, 1},
+	}
+	if !reflect.DeepEqual(parameters.atomTypes, wantAtoms) {
+		t.Errorf("atom types %v, want %v", parameters.atomTypes, wantAtoms)
+	}
+	wantBiotypes := []biotypeRecord{{1, "CB", "Methanol", 1}}
+	if !reflect.DeepEqual(parameters.biotypes, wantBiotypes) {
+		t.Errorf("biotypes %v, want %v", parameters.biotypes, wantBiotypes)
+	}
+	wantTerms := map[string]map[string]bool{
+		"vdw": {"vdw 1": true},
+		"bond": {"bond 1-2": true, "bond 1-3": true},
+		"angle": {"angle 2-1-3": true},
+		"torsion": {"torsion 2-1-3-4": true},
+		"multipole": {"multipole 1": true},
+		"polarize": {"polarize 1": true},
+	}
+	if !reflect.DeepEqual(parameters.terms, wantTerms) {
+		t.Errorf("terms %v, want %v", parameters.terms, wantTerms)
+	}
+}
+
+// Writing the records of a file back out, as the POLTYPE merge does, must give the same parameters
+func TestParameterFileRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath2.Join(dir, "test.prm")
+	if err := os.WriteFile(path, []byte(testParameterFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, _ := loadParameterBlocks(path)
+	var lines []string
+	for _, block := range blocks {
+		lines = append(lines, block.lines...)
+	}
+	if got := len(blocks[len(blocks)-2].lines); blocks[len(blocks)-2].keyword != "multipole" || got != 5 {
+		t.Errorf("multipole record has %d lines, want 5", got)
+	}
+	rewrittenPath := filepath2.Join(dir, "rewritten.prm")
+	if err := os.WriteFile(rewrittenPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	original := loadTinkerParameters(path)
+	rewritten := loadTinkerParameters(rewrittenPath)
+	rewritten.path = original.path
+	if !reflect.DeepEqual(rewritten, original) {
+		t.Errorf("rewritten file reads as %v, want %v", rewritten, original)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Why an atom could not be given a type of the target parameter set
+type missingTypeReport struct {
+	sourceType int
+	reason string
+	atomIDs []int
+}
+
+// Moves a typed system (TXYZ) from one AMOEBA parameter set to another, e.g. amoebabio18 to a lipid specific
+// prm. route is "biotype" to map every source type to the target type with the same biotype atom and residue
+// names, or "codes" to type every atom from an atom code dictionary built from templates typed for the target set.
+// Writes <system>_<target>.txyz, the type map used and <system>_missing_types.txt for atoms whose new type is
+// unknown to the target file, which keep their source type
+func convertSystemTypes(systemFile string, sourcePrm string, targetPrm string, route string, atomCodeFile string, outDir string) {
+	source := loadTinkerParameters(sourcePrm)
+	target := loadTinkerParameters(targetPrm)
+	systemName, atoms := loadLipid(systemFile)
+	_ = os.MkdirAll(outDir, 0755)
+
+	atomIDsToTypesMap := make(map[int]int)
+	missing := make(map[string]*missingTypeReport)
+	addMissing := func(atomID int, reason string) {
+		key := strconv.Itoa(atoms[atomID].atomType) + "\t" + reason
+		if missing[key] == nil {
+			missing[key] = &missingTypeReport{sourceType: atoms[atomID].atomType, reason: reason}
+		}
+		missing[key].atomIDs = append(missing[key].atomIDs, atomID)
+	}
+
+	switch route {
+	case "biotype":
+		typeMap, ambiguous := getBiotypeTypeMap(source, target)
+		writeTypeMap(typeMap, ambiguous, source, target, filepath2.Join(outDir, source.name()+"_to_"+target.name()+"_types.txt"))
+		for atomID, thisAtom := range atoms {
+			if targetType, ok := typeMap[thisAtom.atomType]; ok {
+				atomIDsToTypesMap[atomID] = targetType
+			} else if _, ok := ambiguous[thisAtom.atomType]; ok {
+				addMissing(atomID, "biotypes map onto several target types")
+			} else if _, ok := source.atomTypes[thisAtom.atomType]; !ok {
+				addMissing(atomID, "not in source parameters")
+			} else {
+				addMissing(atomID, "no target biotype")
+			}
+		}
+	case "codes":
+		atomCodeDict, settings := getAtomCodeDictFromFile(atomCodeFile)
+		for atomID, match := range getAtomIDsToAtomTypesMap(atoms, atomCodeDict, settings) {
+			if match.matched {
+				atomIDsToTypesMap[atomID] = match.atomType
+			} else {
+				addMissing(atomID, "no atom code")
+			}
+		}
+	default:
+		log.Fatal("Unknown type remapping route: " + route + " (expected biotype or codes)")
+	}
+
+	// every new type must exist in the target file and be of the same element
+	for atomID, targetType := range atomIDsToTypesMap {
+		record, ok := target.atomTypes[targetType]
+		if !ok {
+			addMissing(atomID, "type "+strconv.Itoa(targetType)+" not in target parameters")
+			delete(atomIDsToTypesMap, atomID)
+		} else if sourceRecord, ok := source.atomTypes[atoms[atomID].atomType]; ok && sourceRecord.atomicNumber != record.atomicNumber {
+			addMissing(atomID, "type "+strconv.Itoa(targetType)+" is a different element")
+			delete(atomIDsToTypesMap, atomID)
+		}
+	}
+
+	rewriteTXYZTypes(atomIDsToTypesMap, systemFile, filepath2.Join(outDir, systemName+"_"+target.name()+".txyz"))
+	if len(missing) > 0 {
+		reportPath := filepath2.Join(outDir, systemName+"_missing_types.txt")
+		numMissing := writeMissingTypes(missing, source, reportPath)
+		fmt.Println("Warning: " + strconv.Itoa(numMissing) + " atoms of " + systemName + " have no type in " +
+			target.name() + " and keep their " + source.name() + " type. See " + reportPath)
+	}
+	fmt.Println("Converted " + strconv.Itoa(len(atomIDsToTypesMap)) + " of " + strconv.Itoa(len(atoms)) + " atoms of " +
+		systemName + " from " + source.name() + " to " + target.name() + ".")
+}
+
+// Maps every source type to the target type sharing one of its biotypes (atom name and residue, ignoring case).
+// Source types whose biotypes lead to different target types are returned separately with those types
+func getBiotypeTypeMap(source *tinkerParameters, target *tinkerParameters) (map[int]int, map[int][]int) {
+	targetTypes := make(map[string]int)
+	for _, record := range target.biotypes {
+		targetTypes[getBiotypeKey(record)] = record.atomType
+	}
+
+	candidates := make(map[int][]int)
+	for _, record := range source.biotypes {
+		targetType, ok := targetTypes[getBiotypeKey(record)]
+		if ok && !containsInt(candidates[record.atomType], targetType) {
+			candidates[record.atomType] = append(candidates[record.atomType], targetType)
+		}
+	}
+	typeMap := make(map[int]int)
+	ambiguous := make(map[int][]int)
+	for sourceType, targetTypes := range candidates {
+		if len(targetTypes) == 1 {
+			typeMap[sourceType] = targetTypes[0]
+		} else {
+			sort.Ints(targetTypes)
+			ambiguous[sourceType] = targetTypes
+		}
+	}
+	return typeMap, ambiguous
+}
+
+func getBiotypeKey(record biotypeRecord) string {
+	return strings.ToLower(record.atomName) + "\t" + strings.ToLower(strings.TrimSpace(record.residue))
+}
+
+// Writes the type map with the class and description of both types, then the ambiguous source types
+func writeTypeMap(typeMap map[int]int, ambiguous map[int][]int, source *tinkerParameters, target *tinkerParameters, outPath string) {
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create type map: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	var sourceTypes []int
+	for sourceType := range typeMap {
+		sourceTypes = append(sourceTypes, sourceType)
+	}
+	sort.Ints(sourceTypes)
+	_, _ = outFile.WriteString("# " + source.name() + "_type\tclass\tdescription\t" + target.name() + "_type\tclass\tdescription\n")
+	for _, sourceType := range sourceTypes {
+		sourceRecord := source.atomTypes[sourceType]
+		targetRecord := target.atomTypes[typeMap[sourceType]]
+		_, _ = outFile.WriteString(strconv.Itoa(sourceType) + "\t" + strconv.Itoa(sourceRecord.atomClass) + "\t" +
+			sourceRecord.description + "\t" + strconv.Itoa(typeMap[sourceType]) + "\t" +
+			strconv.Itoa(targetRecord.atomClass) + "\t" + targetRecord.description + "\n")
+	}
+
+	sourceTypes = nil
+	for sourceType := range ambiguous {
+		sourceTypes = append(sourceTypes, sourceType)
+	}
+	sort.Ints(sourceTypes)
+	for _, sourceType := range sourceTypes {
+		var targetTypes []string
+		for _, targetType := range ambiguous[sourceType] {
+			targetTypes = append(targetTypes, strconv.Itoa(targetType))
+		}
+		_, _ = outFile.WriteString("# ambiguous " + strconv.Itoa(sourceType) + "\t" + source.atomTypes[sourceType].description +
+			"\t" + strings.Join(targetTypes, ",") + "\n")
+	}
+}
+
+// Writes one line per source type and reason with the number of atoms and their IDs. Returns the number of atoms
+func writeMissingTypes(missing map[string]*missingTypeReport, source *tinkerParameters, outPath string) int {
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create missing type report: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	var reports []*missingTypeReport
+	for _, report := range missing {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(x, y int) bool {
+		if reports[x].sourceType != reports[y].sourceType {
+			return reports[x].sourceType < reports[y].sourceType
+		}
+		return reports[x].reason < reports[y].reason
+	})
+
+	numAtoms := 0
+	_, _ = outFile.WriteString("# source_type\tdescription\treason\tnum_atoms\tatoms\n")
+	for _, report := range reports {
+		sort.Ints(report.atomIDs)
+		numAtoms += len(report.atomIDs)
+		_, _ = outFile.WriteString(strconv.Itoa(report.sourceType) + "\t" + source.atomTypes[report.sourceType].description +
+			"\t" + report.reason + "\t" + strconv.Itoa(len(report.atomIDs)) + "\t" + formatAtomRanges(report.atomIDs) + "\n")
+	}
+	return numAtoms
+}
+
+func containsInt(s []int, value int) bool {
+	for _, element := range s {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
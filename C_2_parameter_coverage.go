@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A parameter a typed molecule needs: how many times it occurs and the atoms of its first occurrence
+type requiredTerm struct {
+	kind string
+	key string
+	count int
+	exampleAtoms []int
+}
+
+// Term kinds in the order they are reported
+var parameterTermKinds = []string{"atom", "vdw", "bond", "angle", "torsion", "multipole", "polarize"}
+
+// Lists the atom, vdw, bond, angle, torsion, multipole and polarize parameters that a typed TXYZ (a fragment or a
+// retyped bilayer) needs and writes those missing from all of the parameter files to
+// <molecule>_missing_parameters.txt in outDir. Atom classes are taken from the first file defining each type.
+// Returns the number of missing parameters
+func checkParameterCoverage(txyzFile string, prmFiles []string, outDir string) int {
+	moleculeName, atoms := loadLipid(txyzFile)
+	var parameterSets []*tinkerParameters
+	for _, prmFile := range prmFiles {
+		parameterSets = append(parameterSets, loadTinkerParameters(prmFile))
+	}
+
+	required := getRequiredTerms(atoms, parameterSets)
+	var missing []*requiredTerm
+	numRequired := make(map[string]int)
+	numMissing := make(map[string]int)
+	for _, term := range required {
+		numRequired[term.kind]++
+		if !isTermCovered(term, parameterSets) {
+			missing = append(missing, term)
+			numMissing[term.kind]++
+		}
+	}
+	sort.Slice(missing, func(x, y int) bool {
+		if missing[x].kind != missing[y].kind {
+			return getTermKindRank(missing[x].kind) < getTermKindRank(missing[y].kind)
+		}
+		return missing[x].key < missing[y].key
+	})
+
+	_ = os.MkdirAll(outDir, 0755)
+	outPath := filepath2.Join(outDir, moleculeName+"_missing_parameters.txt")
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		fmt.Println("Failed to create parameter coverage report: " + outPath)
+		log.Fatal(err)
+	}
+	defer outFile.Close()
+
+	var summary []string
+	for _, kind := range parameterTermKinds {
+		summary = append(summary, kind+" "+strconv.Itoa(numMissing[kind])+"/"+strconv.Itoa(numRequired[kind]))
+	}
+	_, _ = outFile.WriteString("# missing/required: " + strings.Join(summary, ", ") + "\n")
+	_, _ = outFile.WriteString("# kind\tclasses_or_types\toccurrences\texample_atoms\n")
+	for _, term := range missing {
+		var exampleAtoms []string
+		for _, atomID := range term.exampleAtoms {
+			exampleAtoms = append(exampleAtoms, strconv.Itoa(atomID))
+		}
+		_, _ = outFile.WriteString(term.kind + "\t" + strings.TrimPrefix(term.key, term.kind+" ") + "\t" +
+			strconv.Itoa(term.count) + "\t" + strings.Join(exampleAtoms, "-") + "\n")
+	}
+
+	fmt.Println("Parameter coverage of " + moleculeName + " (missing/required): " + strings.Join(summary, ", "))
+	if len(missing) > 0 {
+		fmt.Println(strconv.Itoa(len(missing)) + " parameters missing. See " + outPath)
+	}
+	return len(missing)
+}
+
+// Enumerates the parameters needed by a typed molecule, keyed like getTermKey. vdw, bond, angle and torsion terms
+// use atom classes and multipole and polarize terms atom types. Atoms whose type no parameter file defines are
+// listed as missing "atom" terms and left out of the valence terms, whose classes are unknown
+func getRequiredTerms(atoms map[int]*atom, parameterSets []*tinkerParameters) map[string]*requiredTerm {
+	classes := make(map[int]int)
+	for atomID, thisAtom := range atoms {
+		for _, parameters := range parameterSets {
+			if record, ok := parameters.atomTypes[thisAtom.atomType]; ok {
+				classes[atomID] = record.atomClass
+				break
+			}
+		}
+	}
+
+	required := make(map[string]*requiredTerm)
+	add := func(kind string, ids []int, atomIDs ...int) {
+		key := getTermKey(kind, ids)
+		if required[key] == nil {
+			required[key] = &requiredTerm{kind: kind, key: key, exampleAtoms: atomIDs}
+		}
+		required[key].count++
+	}
+	known := func(atomIDs ...int) bool {
+		for _, atomID := range atomIDs {
+			if _, ok := classes[atomID]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	var atomIDs []int
+	for atomID := range atoms {
+		atomIDs = append(atomIDs, atomID)
+	}
+	sort.Ints(atomIDs)
+	for _, b := range atomIDs {
+		thisAtom := atoms[b]
+		if !known(b) {
+			add("atom", []int{thisAtom.atomType}, b)
+			continue
+		}
+		add("vdw", []int{classes[b]}, b)
+		add("multipole", []int{thisAtom.atomType}, b)
+		add("polarize", []int{thisAtom.atomType}, b)
+
+		for i, a := range thisAtom.bondedAtoms {
+			if a > b && known(a) {
+				add("bond", []int{classes[b], classes[a]}, b, a)
+			}
+			// angles centred on b
+			for _, c := range thisAtom.bondedAtoms[i+1:] {
+				if known(a, c) {
+					add("angle", []int{classes[a], classes[b], classes[c]}, a, b, c)
+				}
+			}
+		}
+		// torsions about the bond b-c
+		for _, c := range thisAtom.bondedAtoms {
+			if c < b || !known(c) {
+				continue
+			}
+			for _, a := range thisAtom.bondedAtoms {
+				if a == c || !known(a) {
+					continue
+				}
+				for _, d := range atoms[c].bondedAtoms {
+					if d == b || d == a || !known(d) {
+						continue
+					}
+					add("torsion", []int{classes[a], classes[b], classes[c], classes[d]}, a, b, c, d)
+				}
+			}
+		}
+	}
+	return required
+}
+
+// Checks whether any parameter set has a term. Torsions may also be covered by parameters with a wildcard class
+// 0 at one or both ends
+func isTermCovered(term *requiredTerm, parameterSets []*tinkerParameters) bool {
+	if term.kind == "atom" {
+		return false
+	}
+	keys := []string{term.key}
+	if term.kind == "torsion" {
+		ids := strings.Split(strings.TrimPrefix(term.key, "torsion "), "-")
+		var classes []int
+		for _, id := range ids {
+			class, _ := strconv.Atoi(id)
+			classes = append(classes, class)
+		}
+		keys = append(keys, getTermKey("torsion", []int{0, classes[1], classes[2], classes[3]}),
+			getTermKey("torsion", []int{classes[0], classes[1], classes[2], 0}),
+			getTermKey("torsion", []int{0, classes[1], classes[2], 0}))
+	}
+	for _, parameters := range parameterSets {
+		for _, key := range keys {
+			if parameters.terms[term.kind][key] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getTermKindRank(kind string) int {
+	for i, termKind := range parameterTermKinds {
+		if termKind == kind {
+			return i
+		}
+	}
+	return len(parameterTermKinds)
+}
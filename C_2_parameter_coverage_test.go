@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	filepath2 "path/filepath"
+	"strings"
+	"testing"
+)
+
+// Methanol types except those of the hydroxyl hydrogen (4) and sodium (9): the wildcard torsion covers H-C-O-H
+const testCoverageParameterFile = `atom 1 1 C "Methyl C" 6 12.011 4
+atom 2 2 H "Methyl H" 1 1.008 1
+atom 3 3 O "Hydroxyl O" 8 15.999 2
+atom 4 4 H "Hydroxyl H" 1 1.008 1
+
+vdw 1 3.8200 0.1010
+vdw 2 2.9800 0.0240
+vdw 3 3.4050 0.1100
+bond 1 2 341.00 1.1120
+bond 3 1 404.00 1.3450
+angle 2 1 2 39.00 109.40
+angle 3 1 2 64.00 107.70
+torsion 0 1 3 4 0.000 0.0 1 0.000 180.0 2 0.240 0.0 3
+multipole 1 3 2 -0.14100
+multipole 2 1 3 0.04200
+multipole 3 1 4 -0.25300
+multipole 4 3 1 0.21000
+polarize 1 1.3340 0.3900 2 3
+polarize 2 0.4960 0.3900 1
+polarize 3 0.8370 0.3900 4
+`
+
+func TestCheckParameterCoverage(t *testing.T) {
+	dir := t.TempDir()
+	prmPath := filepath2.Join(dir, "test.prm")
+	if err := os.WriteFile(prmPath, []byte(testCoverageParameterFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// methanol C 1, O 2, H 4-6 on C, H 7 on O, and a sodium ion 3
+	atoms := getTestGraph([]string{"C", "O", "Na"}, [][2]int{{1, 2}}, []int{3, 1, 0})
+	for atomID, atomType := range map[int]int{1: 1, 2: 3, 3: 9, 4: 2, 5: 2, 6: 2, 7: 4} {
+		atoms[atomID].atomType = atomType
+	}
+	txyzPath := filepath2.Join(dir, "methanol.txyz")
+	if err := writeTXYZ(atoms, txyzPath, "methanol"); err != nil {
+		t.Fatal(err)
+	}
+
+	if numMissing := checkParameterCoverage(txyzPath, []string{prmPath}, dir); numMissing != 5 {
+		t.Errorf("%d parameters missing, want 5", numMissing)
+	}
+	report, err := os.ReadFile(filepath2.Join(dir, "methanol_missing_parameters.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"# missing/required: atom 1/1, vdw 1/4, bond 1/3, angle 1/3, torsion 0/1, multipole 0/4, polarize 1/4",
+		"# kind\tclasses_or_types\toccurrences\texample_atoms",
+		"atom\t9\t1\t3",
+		"vdw\t4\t1\t7",
+		"bond\t3-4\t1\t2-7",
+		"angle\t1-3-4\t1\t1-2-7",
+		"polarize\t4\t1\t7",
+	}
+	if got := strings.Split(strings.TrimSpace(string(report)), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("report\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	filepath2 "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Parameter keywords whose leading numbers are atom classes, and how many there are. Multipole and polarize records
+// name atom types and are read separately, see getRecordIDPositions
+var mergeClassKeywords = map[string]int{"vdw": 1, "vdwpr": 2, "vdwpair": 2, "bond": 2, "angle": 3, "anglep": 3,
+	"angle3": 3, "angle4": 3, "angle5": 3, "strbnd": 3, "ureybrad": 3, "opbend": 4, "torsion": 4, "pitors": 2,
+	"strtors": 4, "angtors": 4}
+
+// Keywords whose classes read the same in reverse, e.g. a torsion a-b-c-d is also d-c-b-a
+var reversibleKeywords = map[string]bool{"vdwpr": true, "vdwpair": true, "bond": true, "angle": true, "anglep": true,
+	"angle3": true, "angle4": true, "angle5": true, "ureybrad": true, "torsion": true, "pitors": true}
+
+// Order in which merged parameters are written
+var mergeKeywordOrder = []string{"vdw", "vdwpr", "vdwpair", "bond", "angle", "anglep", "angle3", "angle4", "angle5",
+	"strbnd", "ureybrad", "opbend", "torsion", "pitors", "strtors", "angtors", "multipole", "polarize"}
+
+// One record of a parameter file: the keyword line and, for multipoles, the lines continuing it
+type parameterBlock struct {
+	keyword string
+	lines []string
+}
+
+// A library fragment with its POLTYPE results
+type poltypeFragment struct {
+	name string
+	smiles string
+	atoms map[int]*atom
+	caps map[int]bool
+	// bonds from every atom to the nearest cap atom, a measure of how well the fragment describes the atom
+	capDistance map[int]int
+	// POLTYPE type of every fragment atom, and the class and atom record of every type defined by the key
+	types map[int]int
+	classes map[int]int
+	atomRecords map[int]parameterBlock
+	blocks []parameterBlock
+	parametersLine string
+	status string
+}
+
+// The fragment atom chosen to parameterize one atom of a lipid
+type atomOwner struct {
+	fragment int
+	fragAtom int
+	distance int
+}
+
+// A merged record and the fragment it was taken from
+type mergedRecord struct {
+	block parameterBlock
+	ids []int
+	value string
+	fragment int
+	native bool
+}
+
+// Gathers the POLTYPE results (final.key and final.xyz in each fragment directory) of the fragments in the library
+// catalogs and merges them into one key for a set of lipids, <outName>.key in outDir. Every lipid atom is matched
+// to its instances in the library fragments through the occurrence lists of fragSelector (uniqueFragsDirs) and
+// the coordinates the instances share with their parent in moleculesDir. Each atom takes its type from the
+// instance furthest from a cap, catalogs and catalog lines earlier in the list winning ties. Types of the other
+// instances are aliased to the chosen ones, and terms with types only found on caps or aliased to more than one
+// type are dropped. Duplicate terms keep the one from the fragment owning all of their types, or else the first
+// one. The lipids are written with the merged types to <lipid>_merged.txyz and the merge to
+// <outName>_merge_report.txt
+func mergePoltypeParameters(catalogPaths []string, uniqueFragsDirs []string, moleculesDir string, lipidNames []string,
+	firstType int, outDir string, outName string) {
+
+	lipids := make(map[string]map[int]*atom)
+	for _, lipidName := range lipidNames {
+		_, lipids[lipidName] = loadLipid(filepath2.Join(moleculesDir, lipidName+".txyz"))
+	}
+	occurrences := make(map[string][]string)
+	for _, uniqueFragsDir := range uniqueFragsDirs {
+		for smiles, paths := range loadOccurrencePoses(uniqueFragsDir) {
+			occurrences[smiles] = append(occurrences[smiles], paths...)
+		}
+	}
+
+	var fragments []*poltypeFragment
+	for _, catalogPath := range catalogPaths {
+		fragments = append(fragments, loadPoltypeFragments(catalogPath)...)
+	}
+
+	// instances of every fragment type among the lipid atoms, and the best instance of every lipid atom
+	coverage := make([]map[int][]lipidAtom, len(fragments))
+	owners := make(map[lipidAtom]atomOwner)
+	for f, fragment := range fragments {
+		coverage[f] = make(map[int][]lipidAtom)
+		if fragment.status != "" {
+			continue
+		}
+		numInstances := 0
+		for _, path := range occurrences[fragment.smiles] {
+			lipidName := getParentLipidName(path)
+			parent, ok := lipids[lipidName]
+			if !ok {
+				continue
+			}
+			instance := mapFragmentToLipid(fragment, path, parent)
+			if instance == nil {
+				fmt.Println("Warning: could not place occurrence " + path + " of " + fragment.name + " in " + lipidName)
+				continue
+			}
+			numInstances++
+			for fragAtom, lipidAtomID := range instance {
+				key := lipidAtom{lipidName, lipidAtomID}
+				coverage[f][fragment.types[fragAtom]] = append(coverage[f][fragment.types[fragAtom]], key)
+				owner, owned := owners[key]
+				if !owned || fragment.capDistance[fragAtom] > owner.distance {
+					owners[key] = atomOwner{f, fragAtom, fragment.capDistance[fragAtom]}
+				}
+			}
+		}
+		if numInstances == 0 {
+			fragment.status = "no occurrence in the lipid set"
+		}
+	}
+
+	// merged types, numbered in fragment and type order, and classes alongside them
+	type fragmentType struct{ fragment, atomType int }
+	mergedTypes := make(map[fragmentType]int)
+	mergedClasses := make(map[fragmentType]int)
+	mergedTypeClasses := make(map[int]int)
+	typeOwners := make(map[int]int)
+	classOwners := make(map[int]int)
+	var owned []fragmentType
+	for _, owner := range owners {
+		ownedType := fragmentType{owner.fragment, fragments[owner.fragment].types[owner.fragAtom]}
+		if _, ok := mergedTypes[ownedType]; !ok {
+			mergedTypes[ownedType] = 0
+			owned = append(owned, ownedType)
+		}
+	}
+	sort.Slice(owned, func(x, y int) bool {
+		if owned[x].fragment != owned[y].fragment {
+			return owned[x].fragment < owned[y].fragment
+		}
+		return owned[x].atomType < owned[y].atomType
+	})
+	nextClass := firstType
+	for i, ownedType := range owned {
+		mergedTypes[ownedType] = firstType + i
+		typeOwners[firstType+i] = ownedType.fragment
+		ownedClass := fragmentType{ownedType.fragment, fragments[ownedType.fragment].classes[ownedType.atomType]}
+		if _, ok := mergedClasses[ownedClass]; !ok {
+			mergedClasses[ownedClass] = nextClass
+			classOwners[nextClass] = ownedClass.fragment
+			nextClass++
+		}
+		mergedTypeClasses[firstType+i] = mergedClasses[ownedClass]
+	}
+
+	// what the types and classes of every fragment stand for in the merged key: 0 for types only on caps or on no
+	// lipid atom, -1 for types standing for several merged types
+	typeAliases := make([]map[int]int, len(fragments))
+	classAliases := make([]map[int]int, len(fragments))
+	for f, fragment := range fragments {
+		typeAliases[f] = make(map[int]int)
+		classAliases[f] = make(map[int]int)
+		for atomType := range fragment.atomRecords {
+			if merged, ok := mergedTypes[fragmentType{f, atomType}]; ok {
+				typeAliases[f][atomType] = merged
+				continue
+			}
+			alias := 0
+			for _, key := range coverage[f][atomType] {
+				owner := owners[key]
+				merged := mergedTypes[fragmentType{owner.fragment, fragments[owner.fragment].types[owner.fragAtom]}]
+				if alias == 0 {
+					alias = merged
+				} else if alias != merged {
+					alias = -1
+					break
+				}
+			}
+			typeAliases[f][atomType] = alias
+		}
+		for atomType, alias := range typeAliases[f] {
+			class := fragment.classes[atomType]
+			classAlias := 0
+			if alias > 0 {
+				classAlias = mergedTypeClasses[alias]
+			} else if alias < 0 {
+				classAlias = -1
+			}
+			previous, seen := classAliases[f][class]
+			if !seen || previous == 0 {
+				classAliases[f][class] = classAlias
+			} else if classAlias != 0 && classAlias != previous {
+				classAliases[f][class] = -1
+			}
+		}
+	}
+
+	// translate and merge the terms of all fragments
+	records := make(map[string][]mergedRecord)
+	dropped := make(map[string]int)
+	skippedKeywords := make(map[string]int)
+	for f, fragment := range fragments {
+		if fragment.status != "" {
+			continue
+		}
+		for _, block := range fragment.blocks {
+			if block.keyword == "atom" {
+				continue
+			}
+			positions, isType, ok := getRecordIDPositions(block)
+			if !ok {
+				skippedKeywords[block.keyword]++
+				continue
+			}
+			tokens := strings.Fields(block.lines[0])
+			var ids []int
+			native := true
+			reason := ""
+			for i, position := range positions {
+				id, _ := strconv.Atoi(tokens[position])
+				sign := 1
+				if id < 0 {
+					sign = -1
+					id = -id
+				}
+				// numbers the key does not define belong to the parameter file it builds on and are kept
+				aliases, idOwners := classAliases[f], classOwners
+				if isType[i] {
+					aliases, idOwners = typeAliases[f], typeOwners
+				}
+				alias, defined := aliases[id]
+				if !defined || id == 0 {
+					ids = append(ids, sign*id)
+					continue
+				}
+				if alias == 0 {
+					reason = "types only found on caps"
+				} else if alias < 0 {
+					reason = "types standing for several merged types"
+				}
+				if reason != "" {
+					break
+				}
+				native = native && idOwners[alias] == f
+				ids = append(ids, sign*alias)
+			}
+			if reason != "" {
+				dropped[reason]++
+				continue
+			}
+			line := block.lines[0]
+			var idStrings []string
+			for i, position := range positions {
+				line = replaceField(line, position, strconv.Itoa(ids[i]))
+				idStrings = append(idStrings, strconv.Itoa(ids[i]))
+			}
+			var value []string
+			for _, token := range tokens[1:] {
+				value = append(value, token)
+			}
+			for _, continuation := range block.lines[1:] {
+				value = append(value, strings.Fields(continuation)...)
+			}
+			for _, position := range positions {
+				value[position-1] = ""
+			}
+			key := block.keyword + " " + strings.Join(idStrings, " ")
+			if reversibleKeywords[block.keyword] {
+				key = getTermKey(block.keyword, ids)
+			}
+			lines := append([]string{line}, block.lines[1:]...)
+			records[key] = append(records[key], mergedRecord{parameterBlock{block.keyword, lines}, ids,
+				strings.Join(strings.Fields(strings.Join(value, " ")), " "), f, native})
+		}
+	}
+
+	_ = os.MkdirAll(outDir, 0755)
+	reportPath := filepath2.Join(outDir, outName+"_merge_report.txt")
+	report, err := os.Create(reportPath)
+	if err != nil {
+		fmt.Println("Failed to create merge report: " + reportPath)
+		log.Fatal(err)
+	}
+	defer report.Close()
+
+	// pick one record per term, reporting terms with different values
+	var keys []string
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(x, y int) bool {
+		kx, ky := records[keys[x]][0], records[keys[y]][0]
+		if kx.block.keyword != ky.block.keyword {
+			return getMergeKeywordRank(kx.block.keyword) < getMergeKeywordRank(ky.block.keyword)
+		}
+		for i := 0; i < len(kx.ids) && i < len(ky.ids); i++ {
+			if kx.ids[i] != ky.ids[i] {
+				return kx.ids[i] < ky.ids[i]
+			}
+		}
+		return len(kx.ids) < len(ky.ids)
+	})
+	chosen, numDuplicates, conflicts := chooseMergedRecords(keys, records, fragments)
+
+	parametersLine := ""
+	for _, fragment := range fragments {
+		if fragment.status != "" || fragment.parametersLine == "" {
+			continue
+		}
+		if parametersLine == "" {
+			parametersLine = fragment.parametersLine
+		} else if fragment.parametersLine != parametersLine {
+			fmt.Println("Warning: " + fragment.name + " was parameterized on top of \"" + fragment.parametersLine +
+				"\" rather than \"" + parametersLine + "\"")
+		}
+	}
+
+	keyPath := filepath2.Join(outDir, outName+".key")
+	keyFile, err := os.Create(keyPath)
+	if err != nil {
+		fmt.Println("Failed to create merged key: " + keyPath)
+		log.Fatal(err)
+	}
+	defer keyFile.Close()
+	writer := bufio.NewWriter(keyFile)
+	if parametersLine != "" {
+		_, _ = writer.WriteString(parametersLine + "\n\n")
+	}
+	for i, ownedType := range owned {
+		fragment := fragments[ownedType.fragment]
+		line := fragment.atomRecords[ownedType.atomType].lines[0]
+		line = replaceField(line, 1, strconv.Itoa(firstType+i))
+		line = replaceField(line, 2, strconv.Itoa(mergedTypeClasses[firstType+i]))
+		_, _ = writer.WriteString(line + "\n")
+	}
+	keyword := ""
+	for _, record := range chosen {
+		if record.block.keyword != keyword {
+			_, _ = writer.WriteString("\n")
+			keyword = record.block.keyword
+		}
+		for _, line := range record.block.lines {
+			_, _ = writer.WriteString(line + "\n")
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		fmt.Println("Failed to write merged key: " + keyPath)
+		log.Fatal(err)
+	}
+
+	// lipids with their merged types
+	_, _ = report.WriteString("# fragments\n")
+	ownedAtoms := make([]int, len(fragments))
+	for _, owner := range owners {
+		ownedAtoms[owner.fragment]++
+	}
+	for f, fragment := range fragments {
+		status := fragment.status
+		if status == "" {
+			status = "types " + strconv.Itoa(ownedAtoms[f]) + " lipid atoms"
+		}
+		_, _ = report.WriteString(fragment.name + "\t" + status + "\n")
+	}
+	_, _ = report.WriteString("# lipids\n")
+	totalUntyped := 0
+	for _, lipidName := range lipidNames {
+		atomIDsToTypesMap := make(map[int]int)
+		var untyped []int
+		for atomID := range lipids[lipidName] {
+			owner, ok := owners[lipidAtom{lipidName, atomID}]
+			if !ok {
+				untyped = append(untyped, atomID)
+				continue
+			}
+			atomIDsToTypesMap[atomID] = mergedTypes[fragmentType{owner.fragment, fragments[owner.fragment].types[owner.fragAtom]}]
+		}
+		sort.Ints(untyped)
+		totalUntyped += len(untyped)
+		rewriteTXYZTypes(atomIDsToTypesMap, filepath2.Join(moleculesDir, lipidName+".txyz"), filepath2.Join(outDir, lipidName+"_merged.txyz"))
+		line := lipidName + "\t" + strconv.Itoa(len(atomIDsToTypesMap)) + "/" + strconv.Itoa(len(lipids[lipidName])) + " atoms typed"
+		if len(untyped) > 0 {
+			line += "\tuntyped " + formatAtomRanges(untyped)
+		}
+		_, _ = report.WriteString(line + "\n")
+	}
+	_, _ = report.WriteString("# terms\n" + strconv.Itoa(len(chosen)) + " written, " + strconv.Itoa(numDuplicates) +
+		" duplicates merged, " + strconv.Itoa(len(conflicts)) + " conflicts\n")
+	for _, reason := range []string{"types only found on caps", "types standing for several merged types"} {
+		_, _ = report.WriteString(strconv.Itoa(dropped[reason]) + " dropped with " + reason + "\n")
+	}
+	var skipped []string
+	for keyword, count := range skippedKeywords {
+		skipped = append(skipped, keyword+" "+strconv.Itoa(count))
+	}
+	sort.Strings(skipped)
+	if len(skipped) > 0 {
+		_, _ = report.WriteString("skipped keywords: " + strings.Join(skipped, ", ") + "\n")
+	}
+	_, _ = report.WriteString("# conflicts\n")
+	for _, conflict := range conflicts {
+		_, _ = report.WriteString(conflict + "\n")
+	}
+
+	fmt.Println("Merged " + strconv.Itoa(len(owned)) + " atom types and " + strconv.Itoa(len(chosen)) + " terms into " + keyPath)
+	if totalUntyped > 0 || len(conflicts) > 0 {
+		fmt.Println("Warning: " + strconv.Itoa(totalUntyped) + " lipid atoms untyped and " + strconv.Itoa(len(conflicts)) +
+			" conflicting terms. See " + reportPath)
+	}
+}
+
+// An atom of one lipid of the merged set
+type lipidAtom struct {
+	lipid string
+	atomID int
+}
+
+// Loads the fragments of a library catalog in catalog order with their POLTYPE results. Fragments without results
+// are returned with a status saying so
+func loadPoltypeFragments(catalogPath string) []*poltypeFragment {
+	file, err := os.Open(catalogPath)
+	if err != nil {
+		fmt.Println("Failed to open library catalog: " + catalogPath)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	var fragments []*poltypeFragment
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) < 3 {
+			continue
+		}
+		fragment := &poltypeFragment{smiles: tokens[0]}
+		fragments = append(fragments, fragment)
+		fragment.name, fragment.atoms = loadLipid(tokens[2])
+		fragment.caps = getCapAtoms(tokens[2])
+		fragment.capDistance = getCapDistances(fragment.atoms, fragment.caps)
+
+		fragDir := filepath2.Dir(tokens[2])
+		keyPath := filepath2.Join(fragDir, "final.key")
+		xyzPath := filepath2.Join(fragDir, "final.xyz")
+		keyExists, _ := exists(keyPath)
+		xyzExists, _ := exists(xyzPath)
+		if !keyExists || !xyzExists {
+			fragment.status = "no POLTYPE output"
+			continue
+		}
+		fragment.blocks, fragment.parametersLine = loadParameterBlocks(keyPath)
+		fragment.classes = make(map[int]int)
+		fragment.atomRecords = make(map[int]parameterBlock)
+		for _, block := range fragment.blocks {
+			if block.keyword != "atom" {
+				continue
+			}
+			record, ok := parseAtomTypeRecord(splitParameterLine(block.lines[0]))
+			if ok {
+				fragment.classes[record.atomType] = record.atomClass
+				fragment.atomRecords[record.atomType] = block
+			}
+		}
+
+		// POLTYPE keeps the atom order of its input, check it anyway
+		_, typed := loadLipid(xyzPath)
+		mapping := make(map[int]int)
+		for atomID, thisAtom := range fragment.atoms {
+			if typedAtom, ok := typed[atomID]; ok && typedAtom.element == thisAtom.element {
+				mapping[atomID] = atomID
+			}
+		}
+		if len(mapping) != len(fragment.atoms) || len(typed) != len(fragment.atoms) {
+			var ok bool
+			if mapping, ok = getAtomMapping(fragment.atoms, typed); !ok {
+				fragment.status = "final.xyz does not match the fragment"
+				continue
+			}
+		}
+		fragment.types = make(map[int]int)
+		for atomID, typedID := range mapping {
+			fragment.types[atomID] = typed[typedID].atomType
+		}
+	}
+	return fragments
+}
+
+// Places the non-cap atoms of a fragment in its parent lipid through one of its occurrences: the fragment is
+// mapped onto the occurrence by graph isomorphism, and the occurrence onto the lipid by the coordinates it was cut
+// with. Returns fragment atom ID -> lipid atom ID, or nil if the occurrence cannot be placed
+func mapFragmentToLipid(fragment *poltypeFragment, occurrencePath string, lipid map[int]*atom) map[int]int {
+	_, occurrence := loadLipid(occurrencePath)
+	occurrenceCaps := getCapAtoms(occurrencePath)
+	mapping, ok := getAtomMapping(fragment.atoms, occurrence)
+	if !ok {
+		return nil
+	}
+	instance := make(map[int]int)
+	for fragAtom, occurrenceAtom := range mapping {
+		if fragment.caps[fragAtom] || occurrenceCaps[occurrenceAtom] {
+			continue
+		}
+		lipidAtomID := findAtomAt(lipid, occurrence[occurrenceAtom].element, occurrence[occurrenceAtom].pos)
+		if lipidAtomID == 0 {
+			return nil
+		}
+		instance[fragAtom] = lipidAtomID
+	}
+	return instance
+}
+
+// Returns the atom of an element within 0.01 A of a position, or 0
+func findAtomAt(atoms map[int]*atom, element string, pos []float64) int {
+	for atomID, thisAtom := range atoms {
+		if thisAtom.element == element && vecDistance(thisAtom.pos, pos) < 0.01 {
+			return atomID
+		}
+	}
+	return 0
+}
+
+// Bonds from every atom to the nearest cap atom. Without caps every atom gets the number of atoms
+func getCapDistances(atoms map[int]*atom, caps map[int]bool) map[int]int {
+	distances := make(map[int]int)
+	var queue []int
+	for atomID := range caps {
+		distances[atomID] = 0
+		queue = append(queue, atomID)
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, bondedAtom := range atoms[current].bondedAtoms {
+			if _, seen := distances[bondedAtom]; !seen {
+				distances[bondedAtom] = distances[current] + 1
+				queue = append(queue, bondedAtom)
+			}
+		}
+	}
+	for atomID := range atoms {
+		if _, ok := distances[atomID]; !ok {
+			distances[atomID] = len(atoms)
+		}
+	}
+	return distances
+}
+
+// Reads the names of the lipids to merge parameters for, one per line
+func loadLipidNames(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Failed to open lipid list: " + path)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	var lipidNames []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lipidNames = append(lipidNames, strings.Fields(line)[0])
+		}
+	}
+	return lipidNames
+}
+
+// Lipid a fragment TXYZ was cut from, from its name <lipid>_single_<root> or <lipid>_double_<root1>_<root2>
+func getParentLipidName(fragmentPath string) string {
+	name := strings.Split(filepath2.Base(fragmentPath), ".")[0]
+	for _, kind := range []string{"_single_", "_double_", "_dimer_"} {
+		if i := strings.LastIndex(name, kind); i >= 0 {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+// Reads the records of a Tinker key or parameter file, joining multipole continuation lines to their record. Also
+// returns the parameters line naming the file the key builds on, if any
+func loadParameterBlocks(path string) ([]parameterBlock, string) {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Failed to open parameter file: " + path)
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	var blocks []parameterBlock
+	parametersLine := ""
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		tokens := splitParameterLine(line)
+		if len(tokens) == 0 {
+			continue
+		}
+		keyword := strings.ToLower(tokens[0])
+		if _, err := strconv.ParseFloat(tokens[0], 64); err == nil {
+			if len(blocks) > 0 && blocks[len(blocks)-1].keyword == "multipole" {
+				blocks[len(blocks)-1].lines = append(blocks[len(blocks)-1].lines, line)
+			}
+			continue
+		}
+		if keyword == "parameters" {
+			parametersLine = strings.TrimSpace(line)
+			continue
+		}
+		blocks = append(blocks, parameterBlock{keyword, []string{line}})
+	}
+	return blocks, parametersLine
+}
+
+// Positions of the atom class or type numbers in the first line of a record, and which of them are types.
+// Multipoles list their type and frame types before the charge, polarize records their type and, after the
+// polarizability and damping values, the types of their polarization group. Returns false for keywords the merge
+// does not handle
+func getRecordIDPositions(block parameterBlock) ([]int, []bool, bool) {
+	tokens := strings.Fields(block.lines[0])
+	var positions []int
+	var isType []bool
+	switch block.keyword {
+	case "multipole":
+		for i := 1; i < len(tokens)-1; i++ {
+			if _, err := strconv.Atoi(tokens[i]); err != nil {
+				break
+			}
+			positions = append(positions, i)
+			isType = append(isType, true)
+		}
+	case "polarize":
+		if len(tokens) < 2 {
+			return nil, nil, false
+		}
+		positions = append(positions, 1)
+		isType = append(isType, true)
+		pastValues := false
+		for i := 2; i < len(tokens); i++ {
+			if _, err := strconv.Atoi(tokens[i]); err != nil {
+				pastValues = true
+			} else if pastValues {
+				positions = append(positions, i)
+				isType = append(isType, true)
+			}
+		}
+	default:
+		size, ok := mergeClassKeywords[block.keyword]
+		if !ok || len(tokens) <= size {
+			return nil, nil, false
+		}
+		for i := 1; i <= size; i++ {
+			if _, err := strconv.Atoi(tokens[i]); err != nil {
+				return nil, nil, false
+			}
+			positions = append(positions, i)
+			isType = append(isType, false)
+		}
+	}
+	return positions, isType, len(positions) > 0
+}
+
+// Picks one record per term in key order: the one from the fragment owning all of its types, or else the first.
+// Returns the chosen records, the number of records from other fragments with the same value and a report line
+// for every record with a different value
+func chooseMergedRecords(keys []string, records map[string][]mergedRecord, fragments []*poltypeFragment) ([]mergedRecord, int, []string) {
+	var chosen []mergedRecord
+	numDuplicates := 0
+	var conflicts []string
+	for _, key := range keys {
+		candidates := records[key]
+		best := candidates[0]
+		for _, candidate := range candidates {
+			if candidate.native {
+				best = candidate
+				break
+			}
+		}
+		chosen = append(chosen, best)
+		for _, candidate := range candidates {
+			if candidate.fragment == best.fragment && candidate.value == best.value {
+				continue
+			}
+			if candidate.value == best.value {
+				numDuplicates++
+			} else {
+				conflicts = append(conflicts, key+"\tkept "+fragments[best.fragment].name+": "+best.value+
+					"\tdropped "+fragments[candidate.fragment].name+": "+candidate.value)
+			}
+		}
+	}
+	return chosen, numDuplicates, conflicts
+}
+
+func getMergeKeywordRank(keyword string) int {
+	for i, mergeKeyword := range mergeKeywordOrder {
+		if mergeKeyword == keyword {
+			return i
+		}
+	}
+	return len(mergeKeywordOrder)
+}
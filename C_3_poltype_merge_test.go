@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetRecordIDPositions(t *testing.T) {
+	tests := []struct {
+		name string
+		keyword string
+		line string
+		positions []int
+		isType []bool
+		ok bool
+	}{
+		{"vdw", "vdw", "vdw 1 3.8200 0.1010", []int{1}, []bool{false}, true},
+		{"bond", "bond", "bond 2 1 341.00 1.1120", []int{1, 2}, []bool{false, false}, true},
+		{"torsion", "torsion", "torsion 4 3 1 2 0.000 0.0 1", []int{1, 2, 3, 4}, []bool{false, false, false, false}, true},
+		{"opbend with zero classes", "opbend", "opbend 5 1 0 0 14.40", []int{1, 2, 3, 4}, []bool{false, false, false, false}, true},
+		{"multipole with negative frame types", "multipole", "multipole 5 -6 -7 -0.14100", []int{1, 2, 3}, []bool{true, true, true}, true},
+		{"multipole with integer charge", "multipole", "multipole 1 3 2 0", []int{1, 2, 3}, []bool{true, true, true}, true},
+		{"polarize with group", "polarize", "polarize 1 1.3340 0.3900 2 3", []int{1, 4, 5}, []bool{true, true, true}, true},
+		{"polarize without group", "polarize", "polarize 1 1.3340 0.3900", []int{1}, []bool{true}, true},
+		{"too few classes", "bond", "bond 1", nil, nil, false},
+		{"class not a number", "angle", "angle 1 x 3 64.00", nil, nil, false},
+		{"unhandled keyword", "solute", "solute 1 2.0 3.0", nil, nil, false},
+	}
+	for _, test := range tests {
+		positions, isType, ok := getRecordIDPositions(parameterBlock{test.keyword, []string{test.line}})
+		if ok != test.ok || !reflect.DeepEqual(positions, test.positions) || !reflect.DeepEqual(isType, test.isType) {
+			t.Errorf("%s: got %v %v %v, want %v %v %v", test.name, positions, isType, ok, test.positions, test.isType, test.ok)
+		}
+	}
+}
+
+func TestChooseMergedRecords(t *testing.T) {
+	fragments := []*poltypeFragment{{name: "PC_single_1"}, {name: "PE_single_2"}, {name: "PS_single_3"}}
+	record := func(fragment int, value string, native bool) mergedRecord {
+		line := "bond 401 402 " + value
+		return mergedRecord{parameterBlock{"bond", []string{line}}, []int{401, 402}, value, fragment, native}
+	}
+	tests := []struct {
+		name string
+		candidates []mergedRecord
+		// fragment of the chosen record, duplicates merged and conflicts reported
+		chosen, duplicates int
+		conflicts []string
+	}{
+		{"new term", []mergedRecord{record(1, "341.00 1.1120", false)}, 1, 0, nil},
+		{"identical terms keep the first", []mergedRecord{record(0, "341.00 1.1120", false),
+			record(1, "341.00 1.1120", false), record(2, "341.00 1.1120", false)}, 0, 2, nil},
+		{"identical terms keep the native one", []mergedRecord{record(0, "341.00 1.1120", false),
+			record(1, "341.00 1.1120", true)}, 1, 1, nil},
+		{"conflicting terms keep the first", []mergedRecord{record(0, "341.00 1.1120", false),
+			record(2, "404.00 1.3450", false)}, 0, 0,
+			[]string{"bond 401-402\tkept PC_single_1: 341.00 1.1120\tdropped PS_single_3: 404.00 1.3450"}},
+		{"conflicting terms keep the native one", []mergedRecord{record(0, "341.00 1.1120", false),
+			record(1, "341.00 1.1120", false), record(2, "404.00 1.3450", true)}, 2, 0,
+			[]string{"bond 401-402\tkept PS_single_3: 404.00 1.3450\tdropped PC_single_1: 341.00 1.1120",
+				"bond 401-402\tkept PS_single_3: 404.00 1.3450\tdropped PE_single_2: 341.00 1.1120"}},
+	}
+	for _, test := range tests {
+		records := map[string][]mergedRecord{"bond 401-402": test.candidates}
+		chosen, duplicates, conflicts := chooseMergedRecords([]string{"bond 401-402"}, records, fragments)
+		if len(chosen) != 1 || chosen[0].fragment != test.chosen {
+			t.Errorf("%s: chose %v, want the record of fragment %d", test.name, chosen, test.chosen)
+		}
+		if duplicates != test.duplicates || !reflect.DeepEqual(conflicts, test.conflicts) {
+			t.Errorf("%s: got %d duplicates and conflicts %q, want %d and %q", test.name, duplicates, conflicts,
+				test.duplicates, test.conflicts)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"math"
 	"os"
+	"os/signal"
 	filepath2 "path/filepath"
 )
 
-// OPENBABEL exe locations
+// Cheminformatics backend for all conversion stages: "obabel", "rdkit", "native" or "fake", see newConverter
+const converterBackend string = "obabel"
+
+// OPENBABEL exe locations, used when obabel is not found on PATH
 const obabel string = "C:\\Program Files\\OpenBabel-3.1.1\\obabel.exe"
 const obminimize string = "C:\\Program Files\\OpenBabel-3.1.1\\obminimize.exe"
 
@@ -17,9 +21,16 @@ const obminimize string = "C:\\Program Files\\OpenBabel-3.1.1\\obminimize.exe"
 const carbonCarbonBondDistance float64 = 1.54
 // Hydrogen-Carbon bond length in angstroms. Used to add hydrogens to molecule fragments after cutting the molecule
 const hydrogenCarbonBondDistance float64 = 1.10
+// Ideal sp3 bond angle in radians. Used to place the hydrogens of cap methyl groups
+const tetrahedralAngle float64 = 109.4712 * math.Pi / 180
+
+// Relax the methyl caps of every fragment with the builtin minimizer as it is cut from its molecule
+const relaxCapsOnFragmentation bool = false
+// Optimizer steps used for that relaxation
+const fragmentationCapSteps int = 200
 
-// How many go routines to launch at once
-const goRoutinesBatchSize int = 128
+// How many workers run batch stages (obabel conversions, fragmentation, bilayers) at once. 0 uses GOMAXPROCS
+const numWorkers int = 0
 // the number of monomers to be incorporated
 const topFragsNum int = 100
 // How many times a dimer must appear to be incorporated
@@ -28,22 +39,115 @@ const dimerCutoff int = 10
 // Program Control Variables for main() function
 const libraryGenMode bool = true
 
+	// bring an existing run up to date with a new database release instead of running the stages below from scratch
+	const incrementalMode bool = false
 	const readDatabase bool = false
 	const smi2txyz bool = false
 	const fragment bool = false
 	const xyz2smi bool = false
 	const procFreqs bool = false
+	// keep fragment occurrences in the embedded database fragments.db instead of a .txyz and .can file each in the
+	// fragment directories
+	const useFragmentDatabase bool = false
+	// instance that represents each fragment: "first" for the first one found, or "cluster" for the medoid of the
+	// largest cluster of its geometries across parent molecules. Further cluster medoids are kept as alternatives
+	const representativeSelection string = "first"
+	const representativeRMSDThreshold float64 = 1.0
+	const maxClusteredInstances int = 200
+	const numRepresentatives int = 1
 	const generateLibraries bool = true
 	const singleFragLimit int = 100
 	const doubleFragLimit int = 25
+	// how library fragments are chosen: "frequency" (all fragments above the limits above), or "greedy"/"exact"
+	// to maximize the number of fully covered molecules with at most singleFragBudget/doubleFragBudget fragments
+	const librarySelection string = "frequency"
+	const singleFragBudget int = 100
+	const doubleFragBudget int = 25
+	// relax the methyl caps of library fragments before SDF export, keeping the parent atoms fixed
+	const minimizeCaps bool = false
+	// "obminimize" or "builtin" (no external tools, optimizer set by capMinimizationAlgorithm)
+	const capMinimizationMethod string = "obminimize"
+	const capForceField string = "MMFF94"
+	const capMinimizationAlgorithm string = "lbfgs"
+	const capMinimizationSteps int = 500
+	// search torsion rotamers and parent poses of library fragments for a low energy conformer for POLTYPE
+	const generateConformers bool = false
+	const maxConformers int = 50
+	const keepConformers int = 5
+	const conformerRMSDThreshold float64 = 0.5
+	const conformerMinimizationSteps int = 100
+	const conformersFromPoses bool = true
+	const maxConformerPoses int = 20
+	// replace the library TXYZ with the lowest energy conformer, which moves the atoms taken from the parent molecule
+	// unless the input geometry wins. The builtin force field has no electrostatics, so by default the library keeps
+	// the parent geometry and the conformers are only written beside it
+	const useLowestConformer bool = false
+	const analyzeCoverage bool = false
+	// step in N between points of the coverage curves
+	const coverageCurveStep int = 5
+	// settings of the poltype.ini written for every library fragment, with overrides by fragment size, charge or
+	// elements (see poltypeConfig). "" writes the same default settings for every fragment
+	const poltypeConfigFile string = ""
+
+const userMoleculeMode bool = false
+
+const databaseMode bool = false
+
+	// import the fragment directories of a run made without useFragmentDatabase into fragments.db
+	const buildDatabase bool = true
+	const queryDatabase bool = false
 
 const bilayerConversionMode bool = false
 
 	const generateCodeDict bool = true
 	const reviseBilayers bool = false
+	// bonds out from each atom described by its atom code. 2 is the original two-shell code; deeper codes separate
+	// atoms that only differ further away, at the cost of needing larger template molecules
+	const atomCodeRadius int = 2
+	// extra atom and bond features in atom codes, and whether to hash codes to compact keys. These are stored in
+	// the dictionary header and used again when bilayers are retyped
+	const atomCodeBondOrders bool = false
+	const atomCodeRings bool = false
+	const atomCodeCharges bool = false
+	const atomCodeAromaticity bool = false
+	const hashAtomCodes bool = false
+	// how codes with several atom types among the template molecules are settled: "none" (stop and report them),
+	// "majority" or "deeper". Codes listed with a type in the override file win over the policy
+	const atomCodeConflictPolicy string = "deeper"
+	const atomCodeOverrideFile string = ""
+	// also store unambiguous codes of radii down to this one, to fall back on for atoms whose full code is
+	// unknown. 0 for no fallback
+	const atomCodeFallbackRadius int = 1
+	// "codes" to type every atom from its atom code, "templates" to recognise each molecule as one of the typed
+	// molecules and copy its types, typing molecules without a template from atom codes if retypeUnmatchedWithCodes
+	const bilayerRetypingMethod string = "codes"
+	const retypeUnmatchedWithCodes bool = true
+	// refuse to write bilayers with atoms that match no atom code or molecules that match no template
+	const strictRetyping bool = false
+
+const forceFieldMode bool = false
+
+	const convertTypes bool = true
+	// move a typed system between AMOEBA parameter sets: "biotype" maps types through shared biotypes, "codes"
+	// types atoms from an atom code dictionary built from templates typed for the target set
+	const typeRemapRoute string = "biotype"
+	// list the vdw, bond, angle, torsion, multipole and polarize parameters still missing for a typed TXYZ
+	const checkCoverage bool = false
+	// gather the POLTYPE results of the library fragments into one key for the lipids listed in mergedLipidsFile,
+	// numbering the merged atom types and classes from mergedFirstType
+	const mergePoltype bool = false
+	const mergedLipidsFile string = "lipid_set.txt"
+	const mergedFirstType int = 401
 
 // Program begins here
 func main() {
+	// stop handing out new jobs to worker pools on Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	pipelineContext = ctx
+
+	activeConverter = newConverter(converterBackend)
+
 	filePath := "C:\\Users\\jtgou\\lipids2\\structures.sdf"
 
 	// filePath := "/home/jtg2769/lipids/LMSD_20191002.sdf"
@@ -71,8 +175,15 @@ func main() {
 	// uniqueDimersDir := filepath2.Join(dir,"unique_dimers")
 	os.Mkdir(dir,0755)
 
+	if useFragmentDatabase || databaseMode {
+		fragmentDB = openFragmentStore(filepath2.Join(dir, "fragments.db"), singleFragmentsDir, doubleFragmentsDir, dimersDir)
+		defer fragmentDB.close()
+	}
 
-	if libraryGenMode {
+	if libraryGenMode && incrementalMode {
+		fmt.Println("Updating fragments and frequency tables from new database release...")
+		incrementalUpdate(filePath, dir, moleculesDir, singleFragmentsDir, doubleFragmentsDir, dimersDir, library)
+	} else if libraryGenMode {
 		if readDatabase {
 			fmt.Println("Reading database and converting contents to SMI molecule files...")
 			readLipidMaps(filePath, moleculesDir)
@@ -87,82 +198,147 @@ func main() {
 		}
 		if xyz2smi {
 			fmt.Println("Converting TXYZ fragments to CAN (unique SMILES) fragments...")
-			obabelConversion2(singleFragmentsDir, ".txyz", ".sdf", "remove", false)
-			obabelConversion2(singleFragmentsDir, ".sdf", ".can", "no", false)
+			if useFragmentDatabase {
+				canonicalizeStoredFragments(singleFragmentsDir)
+			} else {
+				obabelConversion2(singleFragmentsDir, ".txyz", ".sdf", "remove", false)
+				obabelConversion2(singleFragmentsDir, ".sdf", ".can", "no", false)
+			}
 			// obabelConversion2(doubleFragmentsDir, ".txyz", ".can", "remove", false)
 		}
 		if procFreqs {
 			fmt.Println("Counting single and double fragment occurrences from CAN fragments...")
-			fragSelector(dir, singleFragmentsDir, doubleFragmentsDir, uniqueSingleFragsDir, uniqueDoubleFragsDir)
+			representatives := representativeSettings{method: representativeSelection, rmsdThreshold: representativeRMSDThreshold,
+				maxInstances: maxClusteredInstances, numRepresentatives: numRepresentatives}
+			fragSelector(dir, singleFragmentsDir, doubleFragmentsDir, uniqueSingleFragsDir, uniqueDoubleFragsDir, representatives)
+		}
+		if analyzeCoverage {
+			fmt.Println("Analyzing molecule coverage of top single and double fragments...")
+			// restrict to a list of lipid names (one per line), or "" for every fragmented molecule
+			moleculeListPath := ""
+			coverageAnalysis(dir, singleFragmentsDir, doubleFragmentsDir, moleculeListPath, coverageCurveStep)
 		}
 		if generateLibraries {
 			fmt.Println("Generating library of most common single fragments TXYZs")
+			capMinimization := minimizationSettings{method: capMinimizationMethod, forceField: capForceField,
+				algorithm: capMinimizationAlgorithm, steps: capMinimizationSteps, convergence: 1e-6}
+			conformerSearch := conformerSettings{maxConformers: maxConformers, keepConformers: keepConformers,
+				rmsdThreshold: conformerRMSDThreshold, minimizationSteps: conformerMinimizationSteps,
+				usePoses: conformersFromPoses, maxPoses: maxConformerPoses, useLowest: useLowestConformer, seed: 1}
+			// keep the library geometry in the SDFs if caps were relaxed or replaced by the lowest conformer
+			keepGeometry := minimizeCaps || (generateConformers && useLowestConformer)
+			// optional file of "LM_ID prefix weight" lines to favour some lipid classes in coverage based selection
+			classWeightsPath := ""
 			inPath := filepath2.Join(dir, "top_single_fragments.txt")
-			generateLibrary(inPath, librarySFcatalog, librarySFDir, singleFragLimit)
+			if librarySelection == "frequency" {
+				generateLibrary(inPath, librarySFcatalog, librarySFDir, singleFragLimit)
+			} else {
+				selectLibrary(inPath, singleFragmentsDir, librarySFcatalog, librarySFDir, singleFragBudget, librarySelection, classWeightsPath)
+			}
+
+			if minimizeCaps {
+				fmt.Println("Minimizing caps of single fragments...")
+				minimizeLibraryCaps(librarySFDir, capMinimization)
+			}
+			if generateConformers {
+				fmt.Println("Generating conformers of single fragments...")
+				conformerPaths := generateLibraryConformers(librarySFcatalog, librarySFDir, uniqueSingleFragsDir, conformerSearch)
+				obabelConvertFiles(conformerPaths, ".sdf", "add", false)
+			}
 
 			// make SDFs for POLTYPE
-			obabelConversion(librarySFDir, ".txyz", ".sdf", "add", true, false)
-			createPoltypeINIs(librarySFDir)
+			obabelConversion(librarySFDir, ".txyz", ".sdf", "add", !keepGeometry, false)
+			obabelConvertFiles(getRepresentativePaths(librarySFDir), ".sdf", "add", false)
+			poltypeConfigPath := ""
+			if poltypeConfigFile != "" {
+				poltypeConfigPath = filepath2.Join(dir, poltypeConfigFile)
+			}
+			poltypeSettings := loadPoltypeConfig(poltypeConfigPath)
+			createPoltypeINIs(librarySFDir, poltypeSettings)
 
 
 			fmt.Println("Generating library of most common double fragments TXYZs")
 			inPath = filepath2.Join(dir, "top_double_fragments.txt")
-			generateLibrary(inPath, libraryDFcatalog, libraryDFDir, doubleFragLimit)
+			if librarySelection == "frequency" {
+				generateLibrary(inPath, libraryDFcatalog, libraryDFDir, doubleFragLimit)
+			} else {
+				selectLibrary(inPath, doubleFragmentsDir, libraryDFcatalog, libraryDFDir, doubleFragBudget, librarySelection, classWeightsPath)
+			}
+
+			if minimizeCaps {
+				fmt.Println("Minimizing caps of double fragments...")
+				minimizeLibraryCaps(libraryDFDir, capMinimization)
+			}
+			if generateConformers {
+				fmt.Println("Generating conformers of double fragments...")
+				conformerPaths := generateLibraryConformers(libraryDFcatalog, libraryDFDir, uniqueDoubleFragsDir, conformerSearch)
+				obabelConvertFiles(conformerPaths, ".sdf", "add", false)
+			}
 
 			// make SDFs for POLTYPE
-			obabelConversion(libraryDFDir, ".txyz", ".sdf", "add", true, false)
-			createPoltypeINIs(libraryDFDir)
+			obabelConversion(libraryDFDir, ".txyz", ".sdf", "add", !keepGeometry, false)
+			obabelConvertFiles(getRepresentativePaths(libraryDFDir), ".sdf", "add", false)
+			createPoltypeINIs(libraryDFDir, poltypeSettings)
+			if useFragmentDatabase {
+				fragmentDB.setLibrary(library)
+			}
+		}
+	} else if userMoleculeMode {
+		// A new lipid (TXYZ, SDF or SMILES) to be matched against the fragment library built above
+		userMoleculePath := filepath2.Join(dir, "user_molecules", "new_lipid.sdf")
+		userOutDir := filepath2.Join(dir, "user_molecules", "output")
+		fmt.Println("Matching fragments of " + userMoleculePath + " against fragment library...")
+		conversionManager(userMoleculePath, library, userOutDir)
+	} else if databaseMode {
+		if buildDatabase {
+			fmt.Println("Importing fragment directories into fragment database...")
+			importFragmentDirectories(dir, []string{singleFragmentsDir, doubleFragmentsDir}, library)
+		}
+		if queryDatabase {
+			// see runDatabaseQuery for the available queries
+			query := "contains single OCC[N+](C)(C)C"
+			runDatabaseQuery(fragmentDB, query)
 		}
 	} else if bilayerConversionMode {
 		dir := "C:\\Users\\jtgou\\OneDrive\\Documents\\UT_Austin\\ren_lab\\lipids\\pren\\molecules"
 		outDir := "C:\\Users\\jtgou\\OneDrive\\Documents\\UT_Austin\\ren_lab\\lipids\\pren\\atomCodeDict"
 		outName := "atomCodeDict.txt"
 		if generateCodeDict {
-			generateAtomCodeDictFile(dir, outDir, outName)
+			atomCodes := atomCodeSettings{radius: atomCodeRadius, bondOrders: atomCodeBondOrders, rings: atomCodeRings,
+				charges: atomCodeCharges, aromaticity: atomCodeAromaticity, hashed: hashAtomCodes,
+				fallbackRadius: atomCodeFallbackRadius}
+			resolution := conflictResolution{policy: atomCodeConflictPolicy, overridePath: atomCodeOverrideFile}
+			generateAtomCodeDictFile(dir, outDir, outName, atomCodes, resolution)
 		}
 
 		if reviseBilayers {
 			bilayerInDir := "C:\\Users\\jtgou\\OneDrive\\Documents\\UT_Austin\\ren_lab\\lipids\\pren\\molecules"
 			bilayerOutDir := "C:\\Users\\jtgou\\OneDrive\\Documents\\UT_Austin\\ren_lab\\lipids\\pren\\bilayers"
 			atomCodeFile := filepath2.Join(outDir, outName)
-			processBilayers(bilayerInDir, atomCodeFile, bilayerOutDir)
+			if bilayerRetypingMethod == "templates" && !retypeUnmatchedWithCodes {
+				atomCodeFile = ""
+			}
+			processBilayers(bilayerInDir, bilayerRetypingMethod, atomCodeFile, dir, bilayerOutDir, strictRetyping)
 		}
-	}
-
-}
-
-func createPoltypeINIs(dir string) {
-	fileInfo, err := ioutil.ReadDir(dir)
-	if err != nil {
-		fmt.Println("failed to read directory: " + dir)
-		log.Fatal(err)
-	}
-	for i := 0; i < len(fileInfo); i++ {
-
-		if filepath2.Ext(fileInfo[i].Name()) == ".sdf" {
-			sdfName := fileInfo[i].Name()
-			iniName := "poltype.ini"
-			iniFile := filepath2.Join(dir, iniName)
-			//fmt.Println(iniFile)
-			createPoltypeINI(iniFile, sdfName)
-		} else if fileInfo[i].IsDir() {
-			createPoltypeINIs(filepath2.Join(dir, fileInfo[i].Name()))
+	} else if forceFieldMode {
+		dir := "C:\\Users\\jtgou\\OneDrive\\Documents\\UT_Austin\\ren_lab\\lipids\\pren"
+		systemFile := filepath2.Join(dir, "bilayers", "POPC_amoeba.txyz")
+		sourcePrm := filepath2.Join(dir, "params", "amoebabio18.prm")
+		targetPrm := filepath2.Join(dir, "params", "amoebalipid.prm")
+		if convertTypes {
+			atomCodeFile := filepath2.Join(dir, "atomCodeDict", "atomCodeDict.txt")
+			convertSystemTypes(systemFile, sourcePrm, targetPrm, typeRemapRoute, atomCodeFile, filepath2.Join(dir, "converted"))
+		}
+		if checkCoverage {
+			checkParameterCoverage(systemFile, []string{targetPrm}, filepath2.Join(dir, "coverage"))
+		}
+		if mergePoltype {
+			catalogs := []string{librarySFcatalog, libraryDFcatalog}
+			uniqueFragsDirs := []string{uniqueSingleFragsDir, uniqueDoubleFragsDir}
+			lipidNames := loadLipidNames(filepath2.Join(library, mergedLipidsFile))
+			mergePoltypeParameters(catalogs, uniqueFragsDirs, moleculesDir, lipidNames, mergedFirstType,
+				filepath2.Join(library, "merged_parameters"), "lipids")
 		}
-	}
-}
-
-func createPoltypeINI(thisPath string, sdfName string) {
-	thisFile, err := os.Create(thisPath)
-	if err != nil {
-		fmt.Println("Failed to create new fragment file: " + thisPath)
-		log.Fatal(err)
 	}
 
-	// write header
-	_, err = thisFile.WriteString("structure=" + sdfName + "\n")
-	_, err = thisFile.WriteString("numproc=4\n")
-	_, err = thisFile.WriteString("maxmem=20GB\n")
-	_, err = thisFile.WriteString("maxdisk=100GB\n")
-	_, err = thisFile.WriteString("externalapi=RenLabCluster\n")
-	_, err = thisFile.WriteString("username=jtg2769\n")
 }
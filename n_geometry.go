@@ -0,0 +1,413 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Basic operations on 3D vectors stored as []float64 like atom.pos
+
+func vecAdd(a []float64, b []float64) []float64 {
+	return []float64{a[0] + b[0], a[1] + b[1], a[2] + b[2]}
+}
+
+func vecSub(a []float64, b []float64) []float64 {
+	return []float64{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+}
+
+func vecScale(a []float64, s float64) []float64 {
+	return []float64{a[0] * s, a[1] * s, a[2] * s}
+}
+
+func vecDot(a []float64, b []float64) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func vecCross(a []float64, b []float64) []float64 {
+	return []float64{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func vecNorm(a []float64) float64 {
+	return math.Sqrt(vecDot(a, a))
+}
+
+// returns a unit vector along a, or the x axis for a zero vector
+func vecUnit(a []float64) []float64 {
+	norm := vecNorm(a)
+	if norm == 0 {
+		return []float64{1, 0, 0}
+	}
+	return vecScale(a, 1/norm)
+}
+
+func vecDistance(a []float64, b []float64) float64 {
+	return vecNorm(vecSub(a, b))
+}
+
+// returns any unit vector perpendicular to a
+func vecPerpendicular(a []float64) []float64 {
+	other := []float64{1, 0, 0}
+	if math.Abs(vecUnit(a)[0]) > 0.9 {
+		other = []float64{0, 1, 0}
+	}
+	return vecUnit(vecCross(a, other))
+}
+
+// returns the mean position of a set of points
+func centroid(points [][]float64) []float64 {
+	center := []float64{0, 0, 0}
+	if len(points) == 0 {
+		return center
+	}
+	for _, point := range points {
+		center = vecAdd(center, point)
+	}
+	return vecScale(center, 1/float64(len(points)))
+}
+
+// applies a 3x3 rotation matrix to a vector
+func rotate(rotation [3][3]float64, a []float64) []float64 {
+	return []float64{
+		rotation[0][0]*a[0] + rotation[0][1]*a[1] + rotation[0][2]*a[2],
+		rotation[1][0]*a[0] + rotation[1][1]*a[1] + rotation[1][2]*a[2],
+		rotation[2][0]*a[0] + rotation[2][1]*a[1] + rotation[2][2]*a[2],
+	}
+}
+
+// Finds the rotation that best superimposes mobile onto target (points paired by index) after both are centred,
+// and the RMSD of that superposition. Uses Horn's quaternion form of the Kabsch problem, so the result is always
+// a proper rotation. Returns the rotation, the two centroids and the RMSD
+func kabsch(mobile [][]float64, target [][]float64) ([3][3]float64, []float64, []float64, float64) {
+	mobileCenter := centroid(mobile)
+	targetCenter := centroid(target)
+
+	// correlation matrix of the centred point sets
+	var corr [3][3]float64
+	sumSq := 0.0
+	for i := range mobile {
+		a := vecSub(mobile[i], mobileCenter)
+		b := vecSub(target[i], targetCenter)
+		sumSq += vecDot(a, a) + vecDot(b, b)
+		for x := 0; x < 3; x++ {
+			for y := 0; y < 3; y++ {
+				corr[x][y] += a[x] * b[y]
+			}
+		}
+	}
+
+	sxx, sxy, sxz := corr[0][0], corr[0][1], corr[0][2]
+	syx, syy, syz := corr[1][0], corr[1][1], corr[1][2]
+	szx, szy, szz := corr[2][0], corr[2][1], corr[2][2]
+	key := [4][4]float64{
+		{sxx + syy + szz, syz - szy, szx - sxz, sxy - syx},
+		{syz - szy, sxx - syy - szz, sxy + syx, szx + sxz},
+		{szx - sxz, sxy + syx, -sxx + syy - szz, syz + szy},
+		{sxy - syx, szx + sxz, syz + szy, -sxx - syy + szz},
+	}
+	eigenvalues, eigenvectors := jacobiEigen4(key)
+	best := 0
+	for i := 1; i < 4; i++ {
+		if eigenvalues[i] > eigenvalues[best] {
+			best = i
+		}
+	}
+	q := [4]float64{eigenvectors[0][best], eigenvectors[1][best], eigenvectors[2][best], eigenvectors[3][best]}
+
+	rotation := [3][3]float64{
+		{q[0]*q[0] + q[1]*q[1] - q[2]*q[2] - q[3]*q[3], 2 * (q[1]*q[2] - q[0]*q[3]), 2 * (q[1]*q[3] + q[0]*q[2])},
+		{2 * (q[1]*q[2] + q[0]*q[3]), q[0]*q[0] - q[1]*q[1] + q[2]*q[2] - q[3]*q[3], 2 * (q[2]*q[3] - q[0]*q[1])},
+		{2 * (q[1]*q[3] - q[0]*q[2]), 2 * (q[2]*q[3] + q[0]*q[1]), q[0]*q[0] - q[1]*q[1] - q[2]*q[2] + q[3]*q[3]},
+	}
+
+	rmsd := 0.0
+	if len(mobile) > 0 {
+		rmsd = math.Sqrt(math.Max(sumSq-2*eigenvalues[best], 0) / float64(len(mobile)))
+	}
+	return rotation, mobileCenter, targetCenter, rmsd
+}
+
+// RMSD of two paired point sets after optimal superposition
+func kabschRMSD(mobile [][]float64, target [][]float64) float64 {
+	_, _, _, rmsd := kabsch(mobile, target)
+	return rmsd
+}
+
+// Eigen decomposition of a symmetric 4x4 matrix by cyclic Jacobi rotations. Eigenvectors are the columns
+func jacobiEigen4(matrix [4][4]float64) ([4]float64, [4][4]float64) {
+	a := matrix
+	var v [4][4]float64
+	for i := 0; i < 4; i++ {
+		v[i][i] = 1
+	}
+	for sweep := 0; sweep < 50; sweep++ {
+		offDiagonal := 0.0
+		for p := 0; p < 4; p++ {
+			for q := p + 1; q < 4; q++ {
+				offDiagonal += a[p][q] * a[p][q]
+			}
+		}
+		if offDiagonal < 1e-22 {
+			break
+		}
+		for p := 0; p < 4; p++ {
+			for q := p + 1; q < 4; q++ {
+				if math.Abs(a[p][q]) < 1e-300 {
+					continue
+				}
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := 1 / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				if theta < 0 {
+					t = -t
+				}
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+				for k := 0; k < 4; k++ {
+					akp := a[k][p]
+					akq := a[k][q]
+					a[k][p] = c*akp - s*akq
+					a[k][q] = s*akp + c*akq
+				}
+				for k := 0; k < 4; k++ {
+					apk := a[p][k]
+					aqk := a[q][k]
+					a[p][k] = c*apk - s*aqk
+					a[q][k] = s*apk + c*aqk
+				}
+				for k := 0; k < 4; k++ {
+					vkp := v[k][p]
+					vkq := v[k][q]
+					v[k][p] = c*vkp - s*vkq
+					v[k][q] = s*vkp + c*vkq
+				}
+			}
+		}
+	}
+	return [4]float64{a[0][0], a[1][1], a[2][2], a[3][3]}, v
+}
+
+// rotates point about the axis through origin along axisDir by angle radians (Rodrigues' formula)
+func rotateAboutAxis(point []float64, origin []float64, axisDir []float64, angle float64) []float64 {
+	k := vecUnit(axisDir)
+	p := vecSub(point, origin)
+	cosA := math.Cos(angle)
+	sinA := math.Sin(angle)
+	rotated := vecAdd(vecAdd(vecScale(p, cosA), vecScale(vecCross(k, p), sinA)), vecScale(k, vecDot(k, p)*(1-cosA)))
+	return vecAdd(rotated, origin)
+}
+
+// returns mobile superimposed onto target (points paired by index)
+func superimpose(mobile [][]float64, target [][]float64) [][]float64 {
+	rotation, mobileCenter, targetCenter, _ := kabsch(mobile, target)
+	aligned := make([][]float64, len(mobile))
+	for i := range mobile {
+		aligned[i] = vecAdd(rotate(rotation, vecSub(mobile[i], mobileCenter)), targetCenter)
+	}
+	return aligned
+}
+
+// Angle a-b-c in radians
+func getBondAngle(a []float64, b []float64, c []float64) float64 {
+	cosAngle := vecDot(vecUnit(vecSub(a, b)), vecUnit(vecSub(c, b)))
+	return math.Acos(math.Max(-1, math.Min(1, cosAngle)))
+}
+
+// Dihedral angle a-b-c-d in radians
+func getDihedral(a []float64, b []float64, c []float64, d []float64) float64 {
+	b1 := vecSub(b, a)
+	b2 := vecSub(c, b)
+	b3 := vecSub(d, c)
+	n1 := vecCross(b1, b2)
+	n2 := vecCross(b2, b3)
+	m1 := vecCross(n1, vecUnit(b2))
+	return math.Atan2(vecDot(m1, n2), vecDot(n1, n2))
+}
+
+// RMSD between two instances of the same fragment after superposition, pairing atoms by graph isomorphism rather
+// than by atom number, and taking the lowest RMSD over the symmetries of the fragment. Hydrogens are left out if
+// heavyOnly is set. Returns false if the graphs do not match
+func getMappedRMSD(atoms1 map[int]*atom, atoms2 map[int]*atom, heavyOnly bool) (float64, bool) {
+	mapping, ok := getAtomMapping(atoms1, atoms2)
+	if !ok {
+		return 0, false
+	}
+	coords1, coords2 := getMappedCoords(atoms1, atoms2, mapping, heavyOnly)
+	return getSymmetricRMSD(coords2, coords1, getSymmetryPermutations(atoms1, heavyOnly)), true
+}
+
+// Automorphisms tried when looking for the lowest RMSD between two instances of a symmetric fragment
+const maxSymmetryPermutations int = 1000
+
+// Returns the automorphisms of a molecule as permutations of its atoms in the order of getMappedCoords: atom n
+// goes to position permutation[n]. Only heavy atoms are permuted if heavyOnly is set. With hydrogens the
+// automorphisms can outnumber maxSymmetryPermutations, and only the first ones found are returned
+func getSymmetryPermutations(atoms map[int]*atom, heavyOnly bool) [][]int {
+	var atomIDs []int
+	for atomID, thisAtom := range atoms {
+		if !heavyOnly || thisAtom.element != "H" {
+			atomIDs = append(atomIDs, atomID)
+		}
+	}
+	sort.Ints(atomIDs)
+	position := make(map[int]int)
+	for n, atomID := range atomIDs {
+		position[atomID] = n
+	}
+
+	var permutations [][]int
+	automorphisms := getAutomorphisms(atoms, atomMatchOptions{ignoreHydrogens: heavyOnly}, maxSymmetryPermutations)
+	for _, automorphism := range automorphisms {
+		permutation := make([]int, len(atomIDs))
+		for n, atomID := range atomIDs {
+			permutation[n] = position[automorphism[atomID]]
+		}
+		permutations = append(permutations, permutation)
+	}
+	return permutations
+}
+
+// Lowest RMSD after superposition over the given permutations of the points of mobile, so that symmetry
+// equivalent atoms (methyls of choline, oxygens of phosphate or carboxylate) are paired up as well as they can be
+func getSymmetricRMSD(mobile [][]float64, target [][]float64, permutations [][]int) float64 {
+	best := kabschRMSD(mobile, target)
+	permuted := make([][]float64, len(mobile))
+	for _, permutation := range permutations {
+		for n := range mobile {
+			permuted[n] = mobile[permutation[n]]
+		}
+		best = math.Min(best, kabschRMSD(permuted, target))
+	}
+	return best
+}
+
+// Returns the positions of the mapped atom pairs (atoms1 ID -> atoms2 ID) in atoms1 ID order
+func getMappedCoords(atoms1 map[int]*atom, atoms2 map[int]*atom, mapping map[int]int, heavyOnly bool) ([][]float64, [][]float64) {
+	var atomIDs []int
+	for atomID := range mapping {
+		if !heavyOnly || atoms1[atomID].element != "H" {
+			atomIDs = append(atomIDs, atomID)
+		}
+	}
+	sort.Ints(atomIDs)
+	coords1 := make([][]float64, len(atomIDs))
+	coords2 := make([][]float64, len(atomIDs))
+	for n, atomID := range atomIDs {
+		coords1[n] = atoms1[atomID].pos
+		coords2[n] = atoms2[mapping[atomID]].pos
+	}
+	return coords1, coords2
+}
+
+///////////////////
+// Internal coordinates
+///////////////////
+
+// One row of a Z-matrix: the atom is placed at bond length from bondTo, at angle (radians) bondTo-angleTo and at
+// dihedral (radians) about bondTo-angleTo from dihedralTo. References not needed by the first atoms are 0
+type internalCoordinate struct {
+	atomID int
+	bondTo, angleTo, dihedralTo int
+	bond, angle, dihedral float64
+}
+
+// Converts a molecule to a Z-matrix in breadth first order, each atom referring to atoms placed before it and
+// preferring the bonded path back through the molecule for its references
+func getInternalCoordinates(atoms map[int]*atom) []internalCoordinate {
+	order := getBreadthFirstOrder(atoms)
+	placed := make(map[int]int)
+	zmatrix := make([]internalCoordinate, 0, len(order))
+	for n, atomID := range order {
+		row := internalCoordinate{atomID: atomID}
+		refs := getReferenceAtoms(atoms, atomID, order[:n], placed)
+		if len(refs) > 0 {
+			row.bondTo = refs[0]
+			row.bond = vecDistance(atoms[atomID].pos, atoms[refs[0]].pos)
+		}
+		if len(refs) > 1 {
+			row.angleTo = refs[1]
+			row.angle = getBondAngle(atoms[atomID].pos, atoms[refs[0]].pos, atoms[refs[1]].pos)
+		}
+		if len(refs) > 2 {
+			row.dihedralTo = refs[2]
+			row.dihedral = getDihedral(atoms[atomID].pos, atoms[refs[0]].pos, atoms[refs[1]].pos, atoms[refs[2]].pos)
+		}
+		placed[atomID] = n
+		zmatrix = append(zmatrix, row)
+	}
+	return zmatrix
+}
+
+// Picks up to three distinct, already placed, non-collinear reference atoms for atomID: bonded neighbours first,
+// then their neighbours, then any earlier atom
+func getReferenceAtoms(atoms map[int]*atom, atomID int, earlier []int, placed map[int]int) []int {
+	var candidates []int
+	seen := map[int]bool{atomID: true}
+	addCandidate := func(candidate int) {
+		if _, ok := placed[candidate]; ok && !seen[candidate] {
+			seen[candidate] = true
+			candidates = append(candidates, candidate)
+		}
+	}
+	for _, bondedAtom := range atoms[atomID].bondedAtoms {
+		addCandidate(bondedAtom)
+	}
+	for n := 0; n < len(candidates) && n < 2; n++ {
+		for _, bondedAtom := range atoms[candidates[n]].bondedAtoms {
+			addCandidate(bondedAtom)
+		}
+	}
+	for n := len(earlier) - 1; n >= 0; n-- {
+		addCandidate(earlier[n])
+	}
+
+	var refs []int
+	for _, candidate := range candidates {
+		if len(refs) == 3 {
+			break
+		}
+		if len(refs) == 2 {
+			// a dihedral needs the three references off a straight line
+			angle := getBondAngle(atoms[refs[0]].pos, atoms[refs[1]].pos, atoms[candidate].pos)
+			if math.Abs(math.Sin(angle)) < 1e-3 {
+				continue
+			}
+		}
+		refs = append(refs, candidate)
+	}
+	return refs
+}
+
+// Rebuilds Cartesian positions from a Z-matrix. The first atom sits at the origin, the second on the x axis and
+// the third in the xy plane
+func getCartesianCoordinates(zmatrix []internalCoordinate) map[int][]float64 {
+	positions := make(map[int][]float64)
+	for n, row := range zmatrix {
+		switch {
+		case n == 0 || row.bondTo == 0:
+			positions[row.atomID] = []float64{0, 0, 0}
+		case row.angleTo == 0:
+			positions[row.atomID] = vecAdd(positions[row.bondTo], []float64{row.bond, 0, 0})
+		case row.dihedralTo == 0:
+			b := positions[row.bondTo]
+			axis := vecUnit(vecSub(positions[row.angleTo], b))
+			perpendicular := vecUnit(vecCross(axis, []float64{0, 0, 1}))
+			if vecNorm(vecCross(axis, []float64{0, 0, 1})) < 1e-6 {
+				perpendicular = vecPerpendicular(axis)
+			}
+			direction := vecAdd(vecScale(axis, math.Cos(row.angle)), vecScale(perpendicular, math.Sin(row.angle)))
+			positions[row.atomID] = vecAdd(b, vecScale(direction, row.bond))
+		default:
+			positions[row.atomID] = placeAtom(positions[row.dihedralTo], positions[row.angleTo], positions[row.bondTo],
+				row.bond, row.angle, row.dihedral)
+		}
+	}
+	return positions
+}
+
+// Places atom d from c at distance bond, with angle b-c-d and dihedral a-b-c-d (radians)
+func placeAtom(a []float64, b []float64, c []float64, bond float64, angle float64, dihedral float64) []float64 {
+	bc := vecUnit(vecSub(c, b))
+	normal := vecUnit(vecCross(vecSub(b, a), bc))
+	m := vecCross(normal, bc)
+	local := []float64{-bond * math.Cos(angle), bond * math.Sin(angle) * math.Cos(dihedral), -bond * math.Sin(angle) * math.Sin(dihedral)}
+	return vecAdd(c, vecAdd(vecAdd(vecScale(bc, local[0]), vecScale(m, local[1])), vecScale(normal, local[2])))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+// Choline, N(CH3)3-CH2-CH2-OH: N 1, methyl C 2-4, C 5-6, O 7, methyl H 8-16, CH2 H 17-20, OH 21
+func getTestCholine() map[int]*atom {
+	positions := map[int][]float64{
+		1: {0, 0, 0}, 2: {0.866, 0.866, 0.866}, 3: {-0.866, -0.866, 0.866}, 4: {-0.866, 0.866, -0.866},
+		5: {0.866, -0.866, -0.866}, 6: {0.044, -1.770, -1.770}, 7: {-0.688, -0.978, -2.694},
+		8: {1.496, 1.496, 0.237}, 9: {0.237, 1.496, 1.496}, 10: {1.496, 0.237, 1.496},
+		11: {-0.237, -1.496, 1.496}, 12: {-1.496, -0.237, 1.496}, 13: {-1.496, -1.496, 0.237},
+		14: {-1.496, 0.237, -1.496}, 15: {-1.496, 1.496, -0.237}, 16: {-0.237, 1.496, -1.496},
+		17: {1.496, -0.237, -1.496}, 18: {1.496, -1.496, -0.237}, 19: {0.708, -2.441, -2.315},
+		20: {-0.648, -2.356, -1.166}, 21: {-1.198, -1.569, -3.252},
+	}
+	bonds := map[int][]int{
+		1: {2, 3, 4, 5}, 2: {1, 8, 9, 10}, 3: {1, 11, 12, 13}, 4: {1, 14, 15, 16}, 5: {1, 6, 17, 18},
+		6: {5, 7, 19, 20}, 7: {6, 21},
+	}
+	for heavyID, bonded := range map[int][]int{2: {8, 9, 10}, 3: {11, 12, 13}, 4: {14, 15, 16}, 5: {17, 18}, 6: {19, 20}, 7: {21}} {
+		for _, hydrogenID := range bonded {
+			bonds[hydrogenID] = []int{heavyID}
+		}
+	}
+	atoms := make(map[int]*atom)
+	for atomID, pos := range positions {
+		element := "H"
+		switch {
+		case atomID == 1:
+			element = "N"
+		case atomID <= 6:
+			element = "C"
+		case atomID == 7:
+			element = "O"
+		}
+		atoms[atomID] = &atom{element: element, pos: pos, bondedAtoms: bonds[atomID], parent: atomID}
+	}
+	return atoms
+}
+
+func getSortedPositions(atoms map[int]*atom) [][]float64 {
+	var atomIDs []int
+	for atomID := range atoms {
+		atomIDs = append(atomIDs, atomID)
+	}
+	sort.Ints(atomIDs)
+	positions := make([][]float64, len(atomIDs))
+	for n, atomID := range atomIDs {
+		positions[n] = atoms[atomID].pos
+	}
+	return positions
+}
+
+func assertClose(t *testing.T, what string, got []float64, want []float64) {
+	t.Helper()
+	if vecDistance(got, want) > 1e-6 {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+func TestKabschRecoversKnownRotation(t *testing.T) {
+	original := getSortedPositions(getTestCholine())
+	axis := []float64{1, 2, 3}
+	angle := 0.7
+	translation := []float64{3, -1, 2}
+	moved := make([][]float64, len(original))
+	for i, pos := range original {
+		moved[i] = vecAdd(rotateAboutAxis(pos, []float64{0, 0, 0}, axis, angle), translation)
+	}
+
+	rotation, originalCenter, movedCenter, rmsd := kabsch(original, moved)
+	if rmsd > 1e-6 {
+		t.Errorf("RMSD of an exact rotation is %g", rmsd)
+	}
+	for _, basis := range [][]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}} {
+		assertClose(t, "rotated basis vector", rotate(rotation, basis), rotateAboutAxis(basis, []float64{0, 0, 0}, axis, angle))
+	}
+	assertClose(t, "translation", vecSub(movedCenter, rotate(rotation, originalCenter)), translation)
+	for i, pos := range superimpose(original, moved) {
+		assertClose(t, "superimposed point", pos, moved[i])
+	}
+}
+
+func TestMappedRMSDOfSymmetricMolecule(t *testing.T) {
+	atoms1 := getTestCholine()
+	// the same molecule with methyls 2 and 3 and their hydrogens trading places, which is only a relabelling
+	atoms2 := getTestCholine()
+	for _, pair := range [][2]int{{2, 3}, {8, 11}, {9, 12}, {10, 13}} {
+		atoms2[pair[0]].pos, atoms2[pair[1]].pos = atoms2[pair[1]].pos, atoms2[pair[0]].pos
+	}
+
+	identity := make(map[int]int)
+	for atomID := range atoms1 {
+		identity[atomID] = atomID
+	}
+	coords1, coords2 := getMappedCoords(atoms1, atoms2, identity, true)
+	if rmsd := kabschRMSD(coords2, coords1); rmsd < 0.5 {
+		t.Fatalf("the swapped methyls should be far apart by atom number, got RMSD %g", rmsd)
+	}
+	rmsd, ok := getMappedRMSD(atoms1, atoms2, true)
+	if !ok || rmsd > 1e-6 {
+		t.Errorf("mapped heavy atom RMSD is %g (%v), want 0", rmsd, ok)
+	}
+}
+
+func TestInternalCoordinatesRoundTrip(t *testing.T) {
+	atoms := getTestCholine()
+	zmatrix := getInternalCoordinates(atoms)
+	if len(zmatrix) != len(atoms) {
+		t.Fatalf("Z-matrix has %d rows for %d atoms", len(zmatrix), len(atoms))
+	}
+	for _, row := range zmatrix[1:] {
+		if want := vecDistance(atoms[row.atomID].pos, atoms[row.bondTo].pos); math.Abs(row.bond-want) > 1e-9 {
+			t.Errorf("bond of atom %d to %d is %g, want %g", row.atomID, row.bondTo, row.bond, want)
+		}
+	}
+
+	positions := getCartesianCoordinates(zmatrix)
+	rebuilt := make(map[int]*atom)
+	for atomID := range atoms {
+		rebuilt[atomID] = &atom{pos: positions[atomID]}
+	}
+	if rmsd := kabschRMSD(getSortedPositions(rebuilt), getSortedPositions(atoms)); rmsd > 1e-6 {
+		t.Errorf("rebuilt molecule is %g A RMSD from the original", rmsd)
+	}
+}
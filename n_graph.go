@@ -0,0 +1,346 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What besides element and connectivity two atoms must share to be matched onto each other
+type atomMatchOptions struct {
+	// require equal atom types (TXYZ column 6)
+	matchTypes bool
+	// optional per-atom charges of the two molecules, compared within chargeTolerance where both are given
+	charges1 map[int]float64
+	charges2 map[int]float64
+	chargeTolerance float64
+	// map heavy atoms only. Matched atoms still carry the same number of hydrogens, which saves the factor of 6 per
+	// methyl when only heavy atom positions matter
+	ignoreHydrogens bool
+}
+
+// Rounds of neighbourhood label refinement used to prune candidate atoms when matching two molecules
+const matchRefinementRounds int = 3
+
+// State of a VF2 style search for isomorphisms between two molecule graphs. Query atoms are taken in breadth
+// first order, so each one after the first of its component has an already mapped neighbour whose partner's
+// neighbours are the only candidates
+type graphMatcher struct {
+	g1, g2 map[int]*atom
+	options atomMatchOptions
+	order []int
+	ids2 []int
+	labels1, labels2 map[int]string
+	core1, core2 map[int]int
+	// first pair of the search, used to ask whether any isomorphism maps one given atom onto another
+	fixed1, fixed2 int
+}
+
+// Finds a mapping of the atoms of query onto the atoms of target (query atom ID -> target atom ID) that preserves
+// elements and bonds. Used to line up two instances of the same fragment taken from different parent molecules,
+// whose atom numbering differs
+func getAtomMapping(query map[int]*atom, target map[int]*atom) (map[int]int, bool) {
+	mappings := getAtomMappings(query, target, atomMatchOptions{}, 1)
+	if len(mappings) == 0 {
+		return nil, false
+	}
+	return mappings[0], true
+}
+
+// Returns up to limit isomorphisms between two molecules (all of them if limit <= 0)
+func getAtomMappings(query map[int]*atom, target map[int]*atom, options atomMatchOptions, limit int) []map[int]int {
+	var mappings []map[int]int
+	forEachAtomMapping(query, target, options, func(mapping map[int]int) bool {
+		mappings = append(mappings, mapping)
+		return limit <= 0 || len(mappings) < limit
+	})
+	return mappings
+}
+
+// Returns up to limit automorphisms of a molecule (all of them if limit <= 0). The count
+// grows quickly with symmetric groups (every methyl contributes a factor of 6), so a limit is usually wanted
+func getAutomorphisms(atoms map[int]*atom, options atomMatchOptions, limit int) []map[int]int {
+	options.charges2 = options.charges1
+	return getAtomMappings(atoms, atoms, options, limit)
+}
+
+// Calls found for every isomorphism between the two molecules until it returns false
+func forEachAtomMapping(query map[int]*atom, target map[int]*atom, options atomMatchOptions, found func(map[int]int) bool) {
+	matcher := newGraphMatcher(query, target, options)
+	if matcher == nil {
+		return
+	}
+	matcher.match(0, found)
+}
+
+// Returns whether some isomorphism maps atom1 of query onto atom2 of target
+func isMappingPossible(query map[int]*atom, target map[int]*atom, options atomMatchOptions, atom1 int, atom2 int) bool {
+	matcher := newGraphMatcher(query, target, options)
+	if matcher == nil {
+		return false
+	}
+	matcher.fixed1 = atom1
+	matcher.fixed2 = atom2
+	// start the search from the fixed atom so the pair is decided first
+	matcher.order = getBreadthFirstOrderFrom(query, atom1)
+	possible := false
+	matcher.match(0, func(map[int]int) bool {
+		possible = true
+		return false
+	})
+	return possible
+}
+
+func newGraphMatcher(query map[int]*atom, target map[int]*atom, options atomMatchOptions) *graphMatcher {
+	if len(query) != len(target) {
+		return nil
+	}
+	m := &graphMatcher{g1: query, g2: target, options: options}
+	m.order = getBreadthFirstOrder(query)
+	if options.ignoreHydrogens {
+		var heavyOrder []int
+		for _, atomID := range m.order {
+			if query[atomID].element != "H" {
+				heavyOrder = append(heavyOrder, atomID)
+			}
+		}
+		m.order = heavyOrder
+	}
+	for atomID := range target {
+		m.ids2 = append(m.ids2, atomID)
+	}
+	sort.Ints(m.ids2)
+	m.labels1 = getRefinedLabels(query, matchRefinementRounds, false)
+	m.labels2 = getRefinedLabels(target, matchRefinementRounds, false)
+
+	// molecules with different label counts cannot be isomorphic
+	counts := make(map[string]int)
+	for _, label := range m.labels1 {
+		counts[label]++
+	}
+	for _, label := range m.labels2 {
+		counts[label]--
+	}
+	for _, count := range counts {
+		if count != 0 {
+			return nil
+		}
+	}
+	m.core1 = make(map[int]int)
+	m.core2 = make(map[int]int)
+	return m
+}
+
+func (m *graphMatcher) match(depth int, found func(map[int]int) bool) bool {
+	if depth == len(m.order) {
+		mapping := make(map[int]int, len(m.core1))
+		for atom1, atom2 := range m.core1 {
+			mapping[atom1] = atom2
+		}
+		return found(mapping)
+	}
+
+	atom1 := m.order[depth]
+	for _, atom2 := range m.getCandidates(atom1) {
+		if !m.isFeasible(atom1, atom2) {
+			continue
+		}
+		m.core1[atom1] = atom2
+		m.core2[atom2] = atom1
+		keepGoing := m.match(depth+1, found)
+		delete(m.core1, atom1)
+		delete(m.core2, atom2)
+		if !keepGoing {
+			return false
+		}
+	}
+	return true
+}
+
+// Unmapped target atoms that atom1 could map onto: the unmapped neighbours of the partner of a mapped neighbour
+// of atom1, or every unmapped target atom if atom1 starts a new component
+func (m *graphMatcher) getCandidates(atom1 int) []int {
+	if atom1 == m.fixed1 && m.fixed2 != 0 {
+		return []int{m.fixed2}
+	}
+	for _, bondedAtom := range m.g1[atom1].bondedAtoms {
+		if partner, ok := m.core1[bondedAtom]; ok {
+			var candidates []int
+			for _, candidate := range m.g2[partner].bondedAtoms {
+				if _, mapped := m.core2[candidate]; !mapped {
+					candidates = append(candidates, candidate)
+				}
+			}
+			sort.Ints(candidates)
+			return candidates
+		}
+	}
+	var candidates []int
+	for _, candidate := range m.ids2 {
+		if _, mapped := m.core2[candidate]; !mapped {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// Checks that atom1 and atom2 agree in label, type and charge and that mapping them keeps every bond between
+// mapped atoms in both directions
+func (m *graphMatcher) isFeasible(atom1 int, atom2 int) bool {
+	a1 := m.g1[atom1]
+	a2 := m.g2[atom2]
+	if a2 == nil || m.labels1[atom1] != m.labels2[atom2] {
+		return false
+	}
+	if m.options.matchTypes && a1.atomType != a2.atomType {
+		return false
+	}
+	charge1, ok1 := m.options.charges1[atom1]
+	charge2, ok2 := m.options.charges2[atom2]
+	if ok1 && ok2 && math.Abs(charge1-charge2) > m.options.chargeTolerance {
+		return false
+	}
+
+	mappedNeighbours1 := 0
+	for _, bondedAtom := range a1.bondedAtoms {
+		if partner, ok := m.core1[bondedAtom]; ok {
+			if !isBonded(m.g2, atom2, partner) {
+				return false
+			}
+			mappedNeighbours1++
+		}
+	}
+	mappedNeighbours2 := 0
+	for _, bondedAtom := range a2.bondedAtoms {
+		if _, ok := m.core2[bondedAtom]; ok {
+			mappedNeighbours2++
+		}
+	}
+	return mappedNeighbours1 == mappedNeighbours2
+}
+
+// Returns the topological symmetry class of every atom: atoms in the same orbit of the automorphism group share
+// the smallest atom ID of the orbit as their class. Candidates are first narrowed down by label refinement, then
+// each pair is confirmed by finding an automorphism that maps one onto the other
+func getSymmetryClasses(atoms map[int]*atom, options atomMatchOptions) map[int]int {
+	options.charges2 = options.charges1
+	labels := getRefinedLabels(atoms, len(atoms), true)
+
+	var atomIDs []int
+	for atomID := range atoms {
+		atomIDs = append(atomIDs, atomID)
+	}
+	sort.Ints(atomIDs)
+
+	classes := make(map[int]int)
+	for _, atomID := range atomIDs {
+		if _, ok := classes[atomID]; ok {
+			continue
+		}
+		classes[atomID] = atomID
+		for _, otherID := range atomIDs {
+			if _, ok := classes[otherID]; ok || labels[otherID] != labels[atomID] {
+				continue
+			}
+			if isMappingPossible(atoms, atoms, options, atomID, otherID) {
+				classes[otherID] = atomID
+			}
+		}
+	}
+	return classes
+}
+
+// Iteratively refines element and degree labels with the sorted labels of bonded atoms for the given number of
+// rounds, or until the partition of atoms stops changing if untilStable is set. Equal labels are necessary for
+// atoms to be symmetry equivalent. Labels of two molecules are only comparable after the same number of rounds
+func getRefinedLabels(atoms map[int]*atom, rounds int, untilStable bool) map[int]string {
+	labels := make(map[int]string)
+	for atomID, thisAtom := range atoms {
+		labels[atomID] = thisAtom.element + strconv.Itoa(len(thisAtom.bondedAtoms))
+	}
+	numClasses := countDistinct(labels)
+	for round := 0; round < rounds; round++ {
+		refined := make(map[int]string)
+		for atomID, thisAtom := range atoms {
+			var neighbourLabels []string
+			for _, bondedAtom := range thisAtom.bondedAtoms {
+				if _, ok := atoms[bondedAtom]; ok {
+					neighbourLabels = append(neighbourLabels, labels[bondedAtom])
+				}
+			}
+			sort.Strings(neighbourLabels)
+			hash := fnv.New64a()
+			_, _ = hash.Write([]byte(labels[atomID] + "(" + strings.Join(neighbourLabels, ",") + ")"))
+			refined[atomID] = strconv.FormatUint(hash.Sum64(), 36)
+		}
+		labels = refined
+		refinedClasses := countDistinct(labels)
+		if untilStable && refinedClasses == numClasses {
+			break
+		}
+		numClasses = refinedClasses
+	}
+	return labels
+}
+
+func countDistinct(labels map[int]string) int {
+	distinct := make(map[string]bool)
+	for _, label := range labels {
+		distinct[label] = true
+	}
+	return len(distinct)
+}
+
+// Returns the atom IDs of a molecule in breadth first order, starting each connected component at its lowest ID
+func getBreadthFirstOrder(atoms map[int]*atom) []int {
+	return getBreadthFirstOrderFrom(atoms, 0)
+}
+
+// Breadth first order starting from start (if it is an atom of the molecule), then from the lowest unvisited IDs
+func getBreadthFirstOrderFrom(atoms map[int]*atom, start int) []int {
+	var atomIDs []int
+	if _, ok := atoms[start]; ok {
+		atomIDs = append(atomIDs, start)
+	}
+	var rest []int
+	for atomID := range atoms {
+		if atomID != start {
+			rest = append(rest, atomID)
+		}
+	}
+	sort.Ints(rest)
+	atomIDs = append(atomIDs, rest...)
+
+	var order []int
+	visited := make(map[int]bool)
+	for _, first := range atomIDs {
+		if visited[first] {
+			continue
+		}
+		visited[first] = true
+		queue := []int{first}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			order = append(order, current)
+			for _, bondedAtom := range atoms[current].bondedAtoms {
+				if _, ok := atoms[bondedAtom]; ok && !visited[bondedAtom] {
+					visited[bondedAtom] = true
+					queue = append(queue, bondedAtom)
+				}
+			}
+		}
+	}
+	return order
+}
+
+func isBonded(atoms map[int]*atom, atom1 int, atom2 int) bool {
+	for _, bondedAtom := range atoms[atom1].bondedAtoms {
+		if bondedAtom == atom2 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+)
+
+// Builds a molecule graph without coordinates: heavy atoms 1..n with the given elements and bonds, then
+// hydrogens[n] hydrogens on heavy atom n+1, numbered after the heavy atoms
+func getTestGraph(elements []string, bonds [][2]int, hydrogens []int) map[int]*atom {
+	atoms := make(map[int]*atom)
+	addAtom := func(element string) int {
+		atomID := len(atoms) + 1
+		atoms[atomID] = &atom{element: element, pos: []float64{0, 0, 0}, parent: atomID}
+		return atomID
+	}
+	bond := func(a int, b int) {
+		atoms[a].bondedAtoms = append(atoms[a].bondedAtoms, b)
+		atoms[b].bondedAtoms = append(atoms[b].bondedAtoms, a)
+	}
+	for _, element := range elements {
+		addAtom(element)
+	}
+	for _, pair := range bonds {
+		bond(pair[0], pair[1])
+	}
+	for n, count := range hydrogens {
+		for k := 0; k < count; k++ {
+			bond(n+1, addAtom("H"))
+		}
+	}
+	return atoms
+}
+
+func getTestNeopentane() map[int]*atom {
+	return getTestGraph([]string{"C", "C", "C", "C", "C"}, [][2]int{{1, 2}, {1, 3}, {1, 4}, {1, 5}}, []int{0, 3, 3, 3, 3})
+}
+
+// Dimethyl phosphate anion, P(=O)(O-)(OCH3)2: P 1, terminal O 2-3, ester O 4-5, C 6-7
+func getTestDimethylPhosphate() map[int]*atom {
+	return getTestGraph([]string{"P", "O", "O", "O", "O", "C", "C"},
+		[][2]int{{1, 2}, {1, 3}, {1, 4}, {1, 5}, {4, 6}, {5, 7}}, []int{0, 0, 0, 0, 0, 3, 3})
+}
+
+func countClasses(classes map[int]int) int {
+	distinct := make(map[int]bool)
+	for _, class := range classes {
+		distinct[class] = true
+	}
+	return len(distinct)
+}
+
+func TestAutomorphismsAndSymmetryClasses(t *testing.T) {
+	tests := []struct {
+		name  string
+		atoms map[int]*atom
+		// automorphisms of the whole molecule and of its heavy atoms, number of symmetry classes
+		automorphisms, heavyAutomorphisms, classes int
+		// atoms that must share a class
+		equivalent []int
+	}{
+		{"neopentane", getTestNeopentane(), 24 * 6 * 6 * 6 * 6, 24, 3, []int{2, 3, 4, 5}},
+		{"choline", getTestCholine(), 6 * 6 * 6 * 6 * 2 * 2, 6, 9, []int{2, 3, 4}},
+		{"dimethyl phosphate", getTestDimethylPhosphate(), 2 * 2 * 6 * 6, 4, 5, []int{2, 3}},
+	}
+	for _, test := range tests {
+		if got := len(getAutomorphisms(test.atoms, atomMatchOptions{}, 0)); got != test.automorphisms {
+			t.Errorf("%s: %d automorphisms, want %d", test.name, got, test.automorphisms)
+		}
+		heavy := getAutomorphisms(test.atoms, atomMatchOptions{ignoreHydrogens: true}, 0)
+		if len(heavy) != test.heavyAutomorphisms {
+			t.Errorf("%s: %d heavy atom automorphisms, want %d", test.name, len(heavy), test.heavyAutomorphisms)
+		}
+		for _, mapping := range heavy {
+			for atomID := range mapping {
+				if test.atoms[atomID].element == "H" {
+					t.Fatalf("%s: hydrogen %d mapped although hydrogens are ignored", test.name, atomID)
+				}
+			}
+		}
+
+		classes := getSymmetryClasses(test.atoms, atomMatchOptions{})
+		if got := countClasses(classes); got != test.classes {
+			t.Errorf("%s: %d symmetry classes, want %d: %v", test.name, got, test.classes, classes)
+		}
+		for _, atomID := range test.equivalent {
+			if classes[atomID] != classes[test.equivalent[0]] {
+				t.Errorf("%s: atoms %d and %d should be equivalent", test.name, test.equivalent[0], atomID)
+			}
+		}
+	}
+
+	// the terminal and ester oxygens of the phosphate are not equivalent
+	classes := getSymmetryClasses(getTestDimethylPhosphate(), atomMatchOptions{})
+	if classes[2] == classes[4] {
+		t.Errorf("terminal and ester oxygens share class %d", classes[2])
+	}
+}
+
+func TestNonIsomorphicMolecules(t *testing.T) {
+	ethanol := getTestGraph([]string{"C", "C", "O"}, [][2]int{{1, 2}, {2, 3}}, []int{3, 2, 1})
+	dimethylEther := getTestGraph([]string{"C", "O", "C"}, [][2]int{{1, 2}, {2, 3}}, []int{3, 0, 3})
+	if mapping, ok := getAtomMapping(ethanol, dimethylEther); ok {
+		t.Errorf("ethanol mapped onto dimethyl ether: %v", mapping)
+	}
+	if mappings := getAtomMappings(dimethylEther, ethanol, atomMatchOptions{}, 0); len(mappings) != 0 {
+		t.Errorf("dimethyl ether mapped onto ethanol %d times", len(mappings))
+	}
+
+	// same graph, but the atom types differ once types have to match
+	typed := getTestNeopentane()
+	typed[1].atomType = 2
+	if _, ok := getAtomMapping(getTestNeopentane(), typed); !ok {
+		t.Errorf("neopentane should map onto itself when types are not compared")
+	}
+	if mappings := getAtomMappings(getTestNeopentane(), typed, atomMatchOptions{matchTypes: true}, 0); len(mappings) != 0 {
+		t.Errorf("neopentane mapped onto a differently typed copy %d times", len(mappings))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Context shared by all worker pools of a run. main() replaces it with one that is cancelled on interrupt
+var pipelineContext = context.Background()
+
+// How often the progress line of a worker pool is refreshed
+const progressInterval = 500 * time.Millisecond
+
+// returns the number of workers to use: numWorkers if set, otherwise GOMAXPROCS
+func getNumWorkers() int {
+	if numWorkers > 0 {
+		return numWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// Runs job(0) ... job(numJobs-1) on a bounded pool of workers, printing a progress line with an ETA under label.
+// Each worker takes the next job as soon as it finishes its last, so one slow job does not hold up the others.
+// When ctx is cancelled no new jobs are started; running jobs finish and ctx.Err() is returned
+func runWorkerPool(ctx context.Context, label string, numJobs int, job func(i int)) error {
+	if numJobs == 0 {
+		return nil
+	}
+
+	jobs := make(chan int)
+	var done int64
+	start := time.Now()
+
+	wg := sync.WaitGroup{}
+	workers := min(getNumWorkers(), numJobs)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				job(i)
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				printProgress(label, int(atomic.LoadInt64(&done)), numJobs, start)
+			case <-stopProgress:
+				printProgress(label, int(atomic.LoadInt64(&done)), numJobs, start)
+				fmt.Println()
+				close(progressDone)
+				return
+			}
+		}
+	}()
+
+	var err error
+feed:
+	for i := 0; i < numJobs; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(stopProgress)
+	<-progressDone
+
+	if err != nil {
+		fmt.Println(label + ": cancelled after " + strconv.Itoa(int(atomic.LoadInt64(&done))) + " of " + strconv.Itoa(numJobs) + " jobs")
+	}
+	return err
+}
+
+func printProgress(label string, done int, total int, start time.Time) {
+	elapsed := time.Since(start)
+	eta := "--"
+	if done > 0 {
+		remaining := time.Duration(float64(elapsed) / float64(done) * float64(total-done))
+		eta = remaining.Round(time.Second).String()
+	}
+	fmt.Printf("\r%s: %d/%d (%.1f%%) elapsed %s ETA %s   ", label, done, total, 100*float64(done)/float64(total),
+		elapsed.Round(time.Second), eta)
+}